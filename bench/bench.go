@@ -0,0 +1,243 @@
+// package bench measures any dr.Storage, as package test checks it, so that
+// implementations can be compared, and regressions caught, e.g.
+//
+//	func BenchmarkStorage(b *testing.B) {
+//		bench.BenchmarkAll(b, bench.Bencher{New: New})
+//	}
+//
+// then go test -run none -bench . -benchmem
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+// functions needed for each implementation to benchmark it
+type Bencher struct {
+	New func() dr.Storage
+}
+
+// sizes of category, and numbers of categories, to benchmark with
+var Sizes = []int{10, 1000, 10000}
+
+// goroutines per GOMAXPROCS for the parallel benchmarks
+var Concurrency = []int{1, 4, 16}
+
+// BenchmarkAll runs each of the benchmarks below
+func BenchmarkAll(b *testing.B, bencher Bencher) {
+	b.Run("Add", func(b *testing.B) { BenchmarkAdd(b, bencher) })
+	b.Run("GetReusable", func(b *testing.B) { BenchmarkGetReusable(b, bencher) })
+	b.Run("GetSingleUse", func(b *testing.B) { BenchmarkGetSingleUse(b, bencher) })
+	b.Run("GetParallel", func(b *testing.B) { BenchmarkGetParallel(b, bencher) })
+	b.Run("List", func(b *testing.B) { BenchmarkList(b, bencher) })
+	b.Run("ListParallel", func(b *testing.B) { BenchmarkListParallel(b, bencher) })
+	b.Run("Categories", func(b *testing.B) { BenchmarkCategories(b, bencher) })
+	b.Run("Mixed", func(b *testing.B) { BenchmarkMixed(b, bencher) })
+}
+
+func resource(category string, i int, reusable bool) dr.Dr {
+	id := strconv.Itoa(i)
+	return dr.Dr{
+		Category:    category,
+		ID:          id,
+		Resource:    "Resource-" + category + "." + id,
+		Description: "Item-" + category + "." + id,
+		TTL:         3600,
+		Reusable:    reusable,
+	}
+}
+
+// fill adds n resources to category
+func fill(b *testing.B, storage dr.Storage, category string, n int, reusable bool) {
+	for i := 0; i < n; i++ {
+		if err := storage.Add(resource(category, i, reusable)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAdd(b *testing.B, bencher Bencher) {
+
+	storage := bencher.New()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := storage.Add(resource("a", i, false)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetReusable(b *testing.B, bencher Bencher) {
+
+	storage := bencher.New()
+	fill(b, storage, "a", 1000, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := storage.Get("a", strconv.Itoa(i%1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetParallel gets reusable resources on many goroutines at once,
+// which need not hold each other up
+func BenchmarkGetParallel(b *testing.B, bencher Bencher) {
+
+	for _, concurrency := range Concurrency {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+
+			storage := bencher.New()
+			fill(b, storage, "a", 1000, true)
+			b.ReportAllocs()
+			b.SetParallelism(concurrency)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := storage.Get("a", strconv.Itoa(i%1000)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkGetSingleUse includes the cost of adding each resource, which is
+// measured on its own by BenchmarkAdd
+func BenchmarkGetSingleUse(b *testing.B, bencher Bencher) {
+
+	storage := bencher.New()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := storage.Add(resource("a", i, false)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := storage.Get("a", strconv.Itoa(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkList(b *testing.B, bencher Bencher) {
+
+	for _, size := range Sizes {
+		b.Run(fmt.Sprintf("resources=%d", size), func(b *testing.B) {
+
+			storage := bencher.New()
+			fill(b, storage, "a", size, false)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.List("a"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListParallel lists a category on many goroutines at once, which
+// need not hold each other up
+func BenchmarkListParallel(b *testing.B, bencher Bencher) {
+
+	for _, concurrency := range Concurrency {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+
+			storage := bencher.New()
+			fill(b, storage, "a", 100, false)
+			b.ReportAllocs()
+			b.SetParallelism(concurrency)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := storage.List("a"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCategories(b *testing.B, bencher Bencher) {
+
+	for _, size := range Sizes {
+		b.Run(fmt.Sprintf("categories=%d", size), func(b *testing.B) {
+
+			storage := bencher.New()
+			for i := 0; i < size; i++ {
+				if err := storage.Add(resource("c"+strconv.Itoa(i), 0, true)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.Categories(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMixed runs a workload of mostly Gets, with some Adds, Lists and
+// Categories, on many goroutines at once, as a busy server might
+func BenchmarkMixed(b *testing.B, bencher Bencher) {
+
+	for _, concurrency := range Concurrency {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+
+			storage := bencher.New()
+			for _, category := range []string{"a", "b", "c", "d"} {
+				fill(b, storage, category, 100, true)
+			}
+
+			var next int64
+			b.ReportAllocs()
+			b.SetParallelism(concurrency)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+
+				rng := rand.New(rand.NewSource(atomic.AddInt64(&next, 1)))
+
+				for pb.Next() {
+					category := string(rune('a' + rng.Intn(4)))
+					switch k := rng.Intn(100); {
+					case k < 70:
+						storage.Get(category, strconv.Itoa(rng.Intn(100)))
+					case k < 85:
+						// single-use, so as not to grow the categories
+						// that are listed
+						i := int(atomic.AddInt64(&next, 1))
+						storage.Add(resource("e", i, false))
+						storage.Get("e", strconv.Itoa(i))
+					case k < 95:
+						storage.List(category)
+					default:
+						storage.Categories()
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package dr
+
+import "strings"
+
+// MatchCategory reports whether pattern matches category. A pattern without
+// wildcards only matches the category of the same name.
+func MatchCategory(pattern string, category string) bool {
+
+	patternLevels := strings.Split(pattern, PathSeparator)
+	categoryLevels := strings.Split(category, PathSeparator)
+
+	for i, level := range patternLevels {
+
+		if level == AnyDepth && i == len(patternLevels)-1 {
+			return true
+		}
+
+		if i >= len(categoryLevels) {
+			return false
+		}
+
+		if level != Wildcard && level != categoryLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(categoryLevels)
+}
+
+// IsPattern reports whether a category contains wildcards
+func IsPattern(category string) bool {
+	return strings.Contains(category, Wildcard)
+}
+
+// LegalCategory reports whether a category can be used as a name, i.e. it
+// has no wildcards, separators or empty levels
+func LegalCategory(category string) bool {
+
+	if strings.Contains(category, Separator) || IsPattern(category) {
+		return false
+	}
+
+	for _, level := range strings.Split(category, PathSeparator) {
+		if level == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CategoryLevels totals the counts of resources in each category at every
+// level above it too, so {"labs/ed/a":1, "labs/ed/b":2} gives
+// {"labs":3, "labs/ed":3, "labs/ed/a":1, "labs/ed/b":2}
+func CategoryLevels(counts map[string]int) map[string]int {
+
+	levels := make(map[string]int)
+
+	for category, count := range counts {
+		parts := strings.Split(category, PathSeparator)
+		for i := range parts {
+			levels[strings.Join(parts[:i+1], PathSeparator)] += count
+		}
+	}
+
+	return levels
+}
@@ -0,0 +1,63 @@
+package dr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchCategory(t *testing.T) {
+
+	for _, test := range []struct {
+		pattern  string
+		category string
+		expected bool
+	}{
+		{"labs", "labs", true},
+		{"labs", "labs/ed", false},
+		{"labs/ed", "labs", false},
+		{"labs/*", "labs/ed", true},
+		{"labs/*", "labs", false},
+		{"labs/*", "labs/ed/pendulum", false},
+		{"labs/*/pendulum", "labs/ed/pendulum", true},
+		{"labs/*/pendulum", "labs/ed/spinner", false},
+		{"labs/**", "labs", true},
+		{"labs/**", "labs/ed/pendulum", true},
+		{"labs/**", "lab", false},
+		{"labs/**", "labsx/ed", false},
+		{"**", "anything/at/all", true},
+		{"*", "a", true},
+		{"*", "a/b", false},
+	} {
+		if got := MatchCategory(test.pattern, test.category); got != test.expected {
+			t.Errorf("MatchCategory(%q, %q) = %v, expected %v", test.pattern, test.category, got, test.expected)
+		}
+	}
+}
+
+func TestLegalCategory(t *testing.T) {
+
+	for category, expected := range map[string]bool{
+		"a":                       true,
+		"labs/edinburgh/pendulum": true,
+		"a.b":                     false,
+		"labs/*":                  false,
+		"labs//ed":                false,
+		"/labs":                   false,
+		"labs/":                   false,
+		"":                        false,
+	} {
+		if got := LegalCategory(category); got != expected {
+			t.Errorf("LegalCategory(%q) = %v, expected %v", category, got, expected)
+		}
+	}
+}
+
+func TestCategoryLevels(t *testing.T) {
+
+	got := CategoryLevels(map[string]int{"labs/ed/a": 1, "labs/ed/b": 2, "labs/gla": 4, "x": 1})
+	expected := map[string]int{"labs": 7, "labs/ed": 3, "labs/ed/a": 1, "labs/ed/b": 2, "labs/gla": 4, "x": 1}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected levels\ngot:%v\nexp:%v\n", got, expected)
+	}
+}
@@ -0,0 +1,692 @@
+// package chaos wraps any dr.Storage to make it slow and unreliable on
+// purpose, so tests can check how restapi and its clients cope with partial
+// failure. Faults are drawn from a seeded random number generator, so a test
+// that makes the same calls in the same order sees the same faults each time.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/wait"
+)
+
+// ErrInjected is the error injected by a Fault that doesn't list any
+var ErrInjected = errors.New("Injected fault")
+
+// Fault describes how calls to a method misbehave. Methods are named
+// without Context, so a Fault for "Get" also applies to GetContext.
+type Fault struct {
+	Rate    float64       // chance of failing each call, from 0 to 1
+	Errors  []error       // one picked at random for each failure; ErrInjected if none
+	Lost    bool          // fail after the call is made, as if the reply were lost
+	Latency time.Duration // delay before every call
+	Jitter  time.Duration // up to this much more delay, at random
+}
+
+// Flap makes HealthCheck pass Up times, then fail Down times, over and over
+type Flap struct {
+	Up   int
+	Down int
+}
+
+type Config struct {
+	Seed    int64
+	Default Fault            // for methods without a Fault of their own
+	Methods map[string]Fault // by method name, e.g. "Get"
+	Flap    Flap             // off if Down is zero
+}
+
+// injector is shared by a Storage and the Storages of its tenants, so that
+// faults are drawn from the one sequence
+type injector struct {
+	config Config
+	rng    *rand.Rand
+	checks int // HealthChecks so far, for flapping
+	sync.Mutex
+}
+
+// Storage injects faults into calls to the underlying storage. It passes on
+// the optional interfaces (except dr.Notifier) with faults of their own.
+type Storage struct {
+	store    dr.ContextStorage
+	original dr.Storage // for the optional interfaces
+	injector *injector
+}
+
+func New(store dr.Storage, config Config) *Storage {
+
+	methods := make(map[string]Fault)
+	for method, fault := range config.Methods {
+		methods[method] = fault
+	}
+	config.Methods = methods
+
+	return &Storage{
+		store:    dr.WithContext(store),
+		original: store,
+		injector: &injector{config: config, rng: rand.New(rand.NewSource(config.Seed))},
+	}
+}
+
+// SetFault changes how calls to a method misbehave from now on, e.g. to
+// start failing part way through a test
+func (s *Storage) SetFault(method string, fault Fault) {
+
+	s.injector.Lock()
+	defer s.injector.Unlock()
+
+	s.injector.config.Methods[method] = fault
+}
+
+// SetDefault changes how methods without a Fault of their own misbehave
+func (s *Storage) SetDefault(fault Fault) {
+
+	s.injector.Lock()
+	defer s.injector.Unlock()
+
+	s.injector.config.Default = fault
+}
+
+// inject delays the call, then reports whether it fails, with what error,
+// and whether only after it is made. If ctx is done during the delay, the
+// call fails with ctx.Err() without being made.
+func (s *Storage) inject(ctx context.Context, method string) (bool, error) {
+
+	i := s.injector
+
+	i.Lock()
+
+	fault, ok := i.config.Methods[method]
+	if !ok {
+		fault = i.config.Default
+	}
+
+	delay := fault.Latency
+	if fault.Jitter > 0 {
+		delay += time.Duration(i.rng.Int63n(int64(fault.Jitter)))
+	}
+
+	var err error
+
+	if fault.Rate > 0 && i.rng.Float64() < fault.Rate {
+		err = ErrInjected
+		if len(fault.Errors) > 0 {
+			err = fault.Errors[i.rng.Intn(len(fault.Errors))]
+		}
+	}
+
+	i.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return fault.Lost && err != nil, err
+}
+
+// flap reports whether HealthCheck should fail this time
+func (s *Storage) flap() bool {
+
+	i := s.injector
+
+	i.Lock()
+	defer i.Unlock()
+
+	flap := i.config.Flap
+
+	if flap.Down <= 0 {
+		return false
+	}
+
+	check := i.checks % (flap.Up + flap.Down)
+	i.checks++
+
+	return check >= flap.Up
+}
+
+func (s *Storage) Add(resource dr.Dr) error {
+	return s.AddContext(context.Background(), resource)
+}
+
+func (s *Storage) AddBatch(resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return s.AddBatchContext(context.Background(), resources, mode)
+}
+
+func (s *Storage) AddGenerated(resource dr.Dr) (dr.Dr, error) {
+	return s.AddGeneratedContext(context.Background(), resource)
+}
+
+func (s *Storage) Categories() (map[string]int, error) {
+	return s.CategoriesContext(context.Background())
+}
+
+func (s *Storage) CategoriesMatching(pattern string) (map[string]int, error) {
+	return s.CategoriesMatchingContext(context.Background(), pattern)
+}
+
+func (s *Storage) CategoriesSelected(selector dr.Selector) (map[string]int, error) {
+	return s.CategoriesSelectedContext(context.Background(), selector)
+}
+
+func (s *Storage) Delete(category string, id string) (dr.Dr, error) {
+	return s.DeleteContext(context.Background(), category, id)
+}
+
+func (s *Storage) DeleteBatch(category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return s.DeleteBatchContext(context.Background(), category, ids, mode)
+}
+
+func (s *Storage) Export(each func(dr.Dr) error) error {
+	return s.ExportContext(context.Background(), each)
+}
+
+func (s *Storage) Get(category string, id string) (dr.Dr, error) {
+	return s.GetContext(context.Background(), category, id)
+}
+
+func (s *Storage) HealthCheck() error {
+	return s.HealthCheckContext(context.Background())
+}
+
+func (s *Storage) List(category string) (map[string]dr.Dr, error) {
+	return s.ListContext(context.Background(), category)
+}
+
+func (s *Storage) ListMatching(pattern string) (map[string]map[string]dr.Dr, error) {
+	return s.ListMatchingContext(context.Background(), pattern)
+}
+
+func (s *Storage) ListPage(category string, options dr.ListOptions) (dr.Page, error) {
+	return s.ListPageContext(context.Background(), category, options)
+}
+
+func (s *Storage) ListSelected(category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	return s.ListSelectedContext(context.Background(), category, selector)
+}
+
+func (s *Storage) Reset() error {
+	return s.ResetContext(context.Background())
+}
+
+func (s *Storage) Search(selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	return s.SearchContext(context.Background(), selector)
+}
+
+func (s *Storage) AddContext(ctx context.Context, resource dr.Dr) error {
+
+	lost, fault := s.inject(ctx, "Add")
+	if fault != nil && !lost {
+		return fault
+	}
+
+	err := s.store.AddContext(ctx, resource)
+	if lost {
+		return fault
+	}
+
+	return err
+}
+
+func (s *Storage) AddBatchContext(ctx context.Context, resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	lost, fault := s.inject(ctx, "AddBatch")
+	if fault != nil && !lost {
+		return []dr.BatchResult{}, fault
+	}
+
+	results, err := s.store.AddBatchContext(ctx, resources, mode)
+	if lost {
+		return []dr.BatchResult{}, fault
+	}
+
+	return results, err
+}
+
+func (s *Storage) AddGeneratedContext(ctx context.Context, resource dr.Dr) (dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "AddGenerated")
+	if fault != nil && !lost {
+		return dr.Dr{}, fault
+	}
+
+	added, err := s.store.AddGeneratedContext(ctx, resource)
+	if lost {
+		return dr.Dr{}, fault
+	}
+
+	return added, err
+}
+
+func (s *Storage) CategoriesContext(ctx context.Context) (map[string]int, error) {
+
+	lost, fault := s.inject(ctx, "Categories")
+	if fault != nil && !lost {
+		return map[string]int{}, fault
+	}
+
+	categories, err := s.store.CategoriesContext(ctx)
+	if lost {
+		return map[string]int{}, fault
+	}
+
+	return categories, err
+}
+
+func (s *Storage) CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error) {
+
+	lost, fault := s.inject(ctx, "CategoriesMatching")
+	if fault != nil && !lost {
+		return map[string]int{}, fault
+	}
+
+	categories, err := s.store.CategoriesMatchingContext(ctx, pattern)
+	if lost {
+		return map[string]int{}, fault
+	}
+
+	return categories, err
+}
+
+func (s *Storage) CategoriesSelectedContext(ctx context.Context, selector dr.Selector) (map[string]int, error) {
+
+	lost, fault := s.inject(ctx, "CategoriesSelected")
+	if fault != nil && !lost {
+		return map[string]int{}, fault
+	}
+
+	categories, err := s.store.CategoriesSelectedContext(ctx, selector)
+	if lost {
+		return map[string]int{}, fault
+	}
+
+	return categories, err
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "Delete")
+	if fault != nil && !lost {
+		return dr.Dr{}, fault
+	}
+
+	deleted, err := s.store.DeleteContext(ctx, category, id)
+	if lost {
+		return dr.Dr{}, fault
+	}
+
+	return deleted, err
+}
+
+func (s *Storage) DeleteBatchContext(ctx context.Context, category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	lost, fault := s.inject(ctx, "DeleteBatch")
+	if fault != nil && !lost {
+		return []dr.BatchResult{}, fault
+	}
+
+	results, err := s.store.DeleteBatchContext(ctx, category, ids, mode)
+	if lost {
+		return []dr.BatchResult{}, fault
+	}
+
+	return results, err
+}
+
+// ExportContext can fail before the export starts, or after it has finished,
+// rather than part way through
+func (s *Storage) ExportContext(ctx context.Context, each func(dr.Dr) error) error {
+
+	lost, fault := s.inject(ctx, "Export")
+	if fault != nil && !lost {
+		return fault
+	}
+
+	err := s.store.ExportContext(ctx, each)
+	if lost {
+		return fault
+	}
+
+	return err
+}
+
+func (s *Storage) GetContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "Get")
+	if fault != nil && !lost {
+		return dr.Dr{}, fault
+	}
+
+	resource, err := s.store.GetContext(ctx, category, id)
+	if lost {
+		return dr.Dr{}, fault
+	}
+
+	return resource, err
+}
+
+// HealthCheckContext fails as Flap says, as well as by any Fault
+func (s *Storage) HealthCheckContext(ctx context.Context) error {
+
+	if s.flap() {
+		return dr.ErrUnhealthy
+	}
+
+	lost, fault := s.inject(ctx, "HealthCheck")
+	if fault != nil && !lost {
+		return fault
+	}
+
+	err := s.store.HealthCheckContext(ctx)
+	if lost {
+		return fault
+	}
+
+	return err
+}
+
+func (s *Storage) ListContext(ctx context.Context, category string) (map[string]dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "List")
+	if fault != nil && !lost {
+		return map[string]dr.Dr{}, fault
+	}
+
+	list, err := s.store.ListContext(ctx, category)
+	if lost {
+		return map[string]dr.Dr{}, fault
+	}
+
+	return list, err
+}
+
+func (s *Storage) ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "ListMatching")
+	if fault != nil && !lost {
+		return map[string]map[string]dr.Dr{}, fault
+	}
+
+	lists, err := s.store.ListMatchingContext(ctx, pattern)
+	if lost {
+		return map[string]map[string]dr.Dr{}, fault
+	}
+
+	return lists, err
+}
+
+func (s *Storage) ListPageContext(ctx context.Context, category string, options dr.ListOptions) (dr.Page, error) {
+
+	lost, fault := s.inject(ctx, "ListPage")
+	if fault != nil && !lost {
+		return dr.Page{Resources: []dr.Dr{}}, fault
+	}
+
+	page, err := s.store.ListPageContext(ctx, category, options)
+	if lost {
+		return dr.Page{Resources: []dr.Dr{}}, fault
+	}
+
+	return page, err
+}
+
+func (s *Storage) ListSelectedContext(ctx context.Context, category string, selector dr.Selector) (map[string]dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "ListSelected")
+	if fault != nil && !lost {
+		return map[string]dr.Dr{}, fault
+	}
+
+	list, err := s.store.ListSelectedContext(ctx, category, selector)
+	if lost {
+		return map[string]dr.Dr{}, fault
+	}
+
+	return list, err
+}
+
+func (s *Storage) ResetContext(ctx context.Context) error {
+
+	lost, fault := s.inject(ctx, "Reset")
+	if fault != nil && !lost {
+		return fault
+	}
+
+	err := s.store.ResetContext(ctx)
+	if lost {
+		return fault
+	}
+
+	return err
+}
+
+func (s *Storage) SearchContext(ctx context.Context, selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+
+	lost, fault := s.inject(ctx, "Search")
+	if fault != nil && !lost {
+		return map[string]map[string]dr.Dr{}, fault
+	}
+
+	lists, err := s.store.SearchContext(ctx, selector)
+	if lost {
+		return map[string]map[string]dr.Dr{}, fault
+	}
+
+	return lists, err
+}
+
+// optional interfaces, passed on to the underlying storage if it has them
+
+// Notify is passed on without faults, as a missed notification would only
+// look like a slow one, which Latency already covers
+func (s *Storage) Notify(category string) <-chan struct{} {
+	return wait.Notify(s.original, category)
+}
+
+// call makes a call that only returns an error, with faults injected
+func (s *Storage) call(method string, f func() error) error {
+
+	lost, fault := s.inject(context.Background(), method)
+	if fault != nil && !lost {
+		return fault
+	}
+
+	err := f()
+	if lost {
+		return fault
+	}
+
+	return err
+}
+
+func (s *Storage) AddTemplate(template dr.Dr, generator dr.Generator) error {
+	templates, ok := s.original.(dr.TemplateStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("AddTemplate", func() error {
+		return templates.AddTemplate(template, generator)
+	})
+}
+
+func (s *Storage) DeletePolicy(category string) error {
+	policies, ok := s.original.(dr.PolicyStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("DeletePolicy", func() error {
+		return policies.DeletePolicy(category)
+	})
+}
+
+func (s *Storage) GetPolicy(category string) (dr.Policy, error) {
+	policies, ok := s.original.(dr.PolicyStorage)
+	if !ok {
+		return dr.Policy{}, dr.ErrNotSupported
+	}
+	var policy dr.Policy
+	err := s.call("GetPolicy", func() (err error) {
+		policy, err = policies.GetPolicy(category)
+		return err
+	})
+	return policy, err
+}
+
+func (s *Storage) Policies() (map[string]dr.Policy, error) {
+	policies, ok := s.original.(dr.PolicyStorage)
+	if !ok {
+		return map[string]dr.Policy{}, dr.ErrNotSupported
+	}
+	all := map[string]dr.Policy{}
+	err := s.call("Policies", func() (err error) {
+		all, err = policies.Policies()
+		return err
+	})
+	return all, err
+}
+
+func (s *Storage) SetPolicy(category string, policy dr.Policy) error {
+	policies, ok := s.original.(dr.PolicyStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("SetPolicy", func() error {
+		return policies.SetPolicy(category, policy)
+	})
+}
+
+func (s *Storage) DeleteSchema(category string) error {
+	schemas, ok := s.original.(dr.SchemaStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("DeleteSchema", func() error {
+		return schemas.DeleteSchema(category)
+	})
+}
+
+func (s *Storage) GetSchema(category string) (string, error) {
+	schemas, ok := s.original.(dr.SchemaStorage)
+	if !ok {
+		return "", dr.ErrNotSupported
+	}
+	var schema string
+	err := s.call("GetSchema", func() (err error) {
+		schema, err = schemas.GetSchema(category)
+		return err
+	})
+	return schema, err
+}
+
+func (s *Storage) Schemas() (map[string]string, error) {
+	schemas, ok := s.original.(dr.SchemaStorage)
+	if !ok {
+		return map[string]string{}, dr.ErrNotSupported
+	}
+	all := map[string]string{}
+	err := s.call("Schemas", func() (err error) {
+		all, err = schemas.Schemas()
+		return err
+	})
+	return all, err
+}
+
+func (s *Storage) SetSchema(category string, schema string) error {
+	schemas, ok := s.original.(dr.SchemaStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("SetSchema", func() error {
+		return schemas.SetSchema(category, schema)
+	})
+}
+
+func (s *Storage) GracePeriod() (int64, error) {
+	trash, ok := s.original.(dr.TrashStorage)
+	if !ok {
+		return 0, dr.ErrNotSupported
+	}
+	var seconds int64
+	err := s.call("GracePeriod", func() (err error) {
+		seconds, err = trash.GracePeriod()
+		return err
+	})
+	return seconds, err
+}
+
+func (s *Storage) Restore(category string, id string) (dr.Dr, error) {
+	trash, ok := s.original.(dr.TrashStorage)
+	if !ok {
+		return dr.Dr{}, dr.ErrNotSupported
+	}
+	var resource dr.Dr
+	err := s.call("Restore", func() (err error) {
+		resource, err = trash.Restore(category, id)
+		return err
+	})
+	return resource, err
+}
+
+func (s *Storage) SetGracePeriod(seconds int64) error {
+	trash, ok := s.original.(dr.TrashStorage)
+	if !ok {
+		return dr.ErrNotSupported
+	}
+	return s.call("SetGracePeriod", func() error {
+		return trash.SetGracePeriod(seconds)
+	})
+}
+
+func (s *Storage) Trash() (map[string]map[string]dr.Dr, error) {
+	trash, ok := s.original.(dr.TrashStorage)
+	if !ok {
+		return map[string]map[string]dr.Dr{}, dr.ErrNotSupported
+	}
+	lists := map[string]map[string]dr.Dr{}
+	err := s.call("Trash", func() (err error) {
+		lists, err = trash.Trash()
+		return err
+	})
+	return lists, err
+}
+
+// Tenant injects faults into the tenant's storage too, drawn from the same
+// sequence, so it stays reproducible
+func (s *Storage) Tenant(name string) (dr.Storage, error) {
+	tenants, ok := s.original.(dr.TenantStorage)
+	if !ok {
+		return nil, dr.ErrNotSupported
+	}
+	var tenant dr.Storage
+	err := s.call("Tenant", func() (err error) {
+		tenant, err = tenants.Tenant(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{store: dr.WithContext(tenant), original: tenant, injector: s.injector}, nil
+}
+
+func (s *Storage) Tenants() ([]string, error) {
+	tenants, ok := s.original.(dr.TenantStorage)
+	if !ok {
+		return []string{}, dr.ErrNotSupported
+	}
+	names := []string{}
+	err := s.call("Tenants", func() (err error) {
+		names, err = tenants.Tenants()
+		return err
+	})
+	return names, err
+}
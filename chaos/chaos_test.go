@@ -0,0 +1,210 @@
+package chaos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/ram"
+	"github.com/timdrysdale/dr/restapi"
+	"github.com/timdrysdale/dr/test"
+)
+
+// without faults, the wrapper must behave as the storage it wraps
+func TestInterface(t *testing.T) {
+	tester := test.Tester{
+		New:          func() dr.Storage { return New(ram.New(), Config{}) },
+		NewWithClock: func(clock clockwork.Clock) dr.Storage { return New(ram.NewWithClock(clock), Config{}) },
+	}
+	test.TestInterface(t, tester)
+	test.TestBatch(t, tester)
+	test.TestContext(t, tester)
+	test.TestPolicy(t, tester)
+	test.TestTemplate(t, tester)
+	test.TestTenants(t, tester)
+	test.TestTrash(t, tester)
+	test.TestConcurrency(t, tester)
+	test.TestModel(t, tester)
+}
+
+// failures returns which of n calls to Categories fail
+func failures(s *Storage, n int) []bool {
+	failed := make([]bool, n)
+	for i := range failed {
+		_, err := s.Categories()
+		failed[i] = err == ErrInjected
+	}
+	return failed
+}
+
+func TestReproducible(t *testing.T) {
+
+	config := Config{Seed: 42, Default: Fault{Rate: 0.3}}
+
+	first := failures(New(ram.New(), config), 1000)
+	second := failures(New(ram.New(), config), 1000)
+
+	count := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("call %d differs between runs with the same seed", i)
+		}
+		if first[i] {
+			count++
+		}
+	}
+
+	if count < 250 || count > 350 {
+		t.Errorf("expected about 300 failures, got %d", count)
+	}
+
+	config.Seed = 43
+	other := failures(New(ram.New(), config), 1000)
+
+	same := true
+	for i := range first {
+		same = same && first[i] == other[i]
+	}
+
+	if same {
+		t.Errorf("different seeds should give different failures")
+	}
+}
+
+func TestMethods(t *testing.T) {
+
+	s := New(ram.New(), Config{
+		Default: Fault{Rate: 1},
+		Methods: map[string]Fault{
+			"Add": {},
+			"Get": {Rate: 1, Errors: []error{dr.ErrUnhealthy}},
+		},
+	})
+
+	if err := s.Add(dr.Dr{Category: "c", ID: "a", Resource: "r"}); err != nil {
+		t.Errorf("Add should not fail, got %v", err)
+	}
+
+	if _, err := s.GetContext(context.Background(), "c", "a"); err != dr.ErrUnhealthy {
+		t.Errorf("Get should fail with the given error, got %v", err)
+	}
+
+	if _, err := s.List("c"); err != ErrInjected {
+		t.Errorf("List should fail by default, got %v", err)
+	}
+
+	if _, err := s.GetPolicy("c"); err != ErrInjected {
+		t.Errorf("optional interfaces should fail too, got %v", err)
+	}
+
+	s.SetDefault(Fault{})
+	s.SetFault("Get", Fault{})
+
+	if resource, err := s.Get("c", "a"); err != nil || resource.Resource != "r" {
+		t.Errorf("Get should work once the fault is cleared, got %v %v", resource, err)
+	}
+}
+
+func TestLost(t *testing.T) {
+
+	underlying := ram.New()
+	s := New(underlying, Config{Methods: map[string]Fault{"Get": {Rate: 1, Lost: true}}})
+
+	s.Add(dr.Dr{Category: "c", ID: "a", Resource: "r"})
+
+	if resource, err := s.Get("c", "a"); err != ErrInjected || resource.Resource != "" {
+		t.Errorf("Get should fail, got %v %v", resource, err)
+	}
+
+	if _, err := underlying.Get("c", "a"); err != dr.ErrResourceNotFound {
+		t.Errorf("single-use resource should be used up by the lost Get, got %v", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+
+	underlying := ram.New()
+	s := New(underlying, Config{Default: Fault{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}})
+
+	start := time.Now()
+	s.Add(dr.Dr{Category: "c", ID: "a", Resource: "r"})
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("unexpected delay %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.GetContext(ctx, "c", "a"); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	if _, err := underlying.Get("c", "a"); err != nil {
+		t.Errorf("Get that timed out should not have been made, got %v", err)
+	}
+}
+
+func TestFlap(t *testing.T) {
+
+	s := New(ram.New(), Config{Flap: Flap{Up: 2, Down: 1}})
+
+	for i, healthy := range []bool{true, true, false, true, true, false} {
+		if err := s.HealthCheck(); (err == nil) != healthy {
+			t.Errorf("check %d: expected healthy %v, got %v", i, healthy, err)
+		}
+	}
+}
+
+func TestRestapi(t *testing.T) {
+
+	s := New(ram.New(), Config{Flap: Flap{Up: 1, Down: 1}})
+	router := restapi.New(s)
+
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError, http.StatusOK} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/healthcheck", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(resp, req)
+		if resp.Code != status {
+			t.Errorf("expected %d, got %d", status, resp.Code)
+		}
+	}
+
+	s.SetFault("Get", Fault{Rate: 1, Lost: true})
+	s.Add(dr.Dr{Category: "c", ID: "a", Resource: "r"})
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources/c/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("lost Get should be reported as an error, got %d", resp.Code)
+	}
+}
+
+func TestRestapiNotSupported(t *testing.T) {
+
+	// storage with none of the optional features
+	router := restapi.New(New(struct{ dr.Storage }{ram.New()}, Config{}))
+
+	for _, path := range []string{"/api/admin/policies", "/api/admin/schemas", "/api/admin/tenants", "/api/admin/trash"} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotImplemented {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusNotImplemented, resp.Code)
+		}
+	}
+}
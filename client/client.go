@@ -0,0 +1,104 @@
+// package client gets resources from a restapi server with their Resource
+// sealed to a key pair of the client's own, so that it stays unreadable all
+// the way from the server, and opens them
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/seal"
+)
+
+var ErrNotSealed = errors.New("Server did not seal the resource")
+
+type Client struct {
+	BaseURL    string // e.g. https://dr.example.org
+	HTTPClient *http.Client
+	public     *[32]byte
+	private    *[32]byte
+}
+
+// New makes a client with a fresh key pair
+func New(baseURL string) (*Client, error) {
+
+	public, private, err := seal.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		public:     public,
+		private:    private,
+	}, nil
+}
+
+func (c *Client) PublicKey() *[32]byte {
+	return c.public
+}
+
+// Get gets a resource, which is used up if it is single-use
+func (c *Client) Get(ctx context.Context, category string, id string) (dr.Dr, error) {
+	return c.get(ctx, c.BaseURL+"/api/resources/"+category+"/"+id)
+}
+
+// Take waits up to wait for a resource in the category, and gets it
+func (c *Client) Take(ctx context.Context, category string, wait time.Duration) (dr.Dr, error) {
+	query := url.Values{"wait": {wait.String()}, "take": {"true"}}
+	return c.get(ctx, c.BaseURL+"/api/resources/"+category+"/?"+query.Encode())
+}
+
+func (c *Client) get(ctx context.Context, location string) (dr.Dr, error) {
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set(seal.PublicKeyHeader, seal.EncodeKey(c.public))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	defer resp.Body.Close()
+
+	return Open(resp, c.public, c.private)
+}
+
+// Open reads the resource from a response to a request that sent the public
+// key in seal.PublicKeyHeader, and opens its Resource with the private key
+func Open(resp *http.Response, public *[32]byte, private *[32]byte) (dr.Dr, error) {
+
+	var resource dr.Dr
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resource, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resource, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+
+	if err := json.Unmarshal(body, &resource); err != nil {
+		return resource, err
+	}
+
+	if resp.Header.Get(seal.SealedHeader) != seal.Scheme {
+		return resource, ErrNotSealed //don't trust a server that ignores the key
+	}
+
+	return seal.Open(resource, public, private)
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/ram"
+	"github.com/timdrysdale/dr/restapi"
+)
+
+func TestGetAndTake(t *testing.T) {
+
+	storage := ram.New()
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "a", Resource: "secret-a"})
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "b", Resource: "secret-b"})
+
+	server := httptest.NewServer(restapi.New(storage))
+	defer server.Close()
+
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource, err := c.Get(context.Background(), "labs/ed", "a")
+	if err != nil || resource.Resource != "secret-a" {
+		t.Errorf("unexpected %v %v", resource, err)
+	}
+
+	resource, err = c.Take(context.Background(), "labs/ed", time.Second)
+	if err != nil || resource.Resource != "secret-b" {
+		t.Errorf("unexpected %v %v", resource, err)
+	}
+
+	if _, err := c.Get(context.Background(), "labs/ed", "a"); err == nil {
+		t.Errorf("single-use resource should be gone")
+	}
+}
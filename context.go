@@ -0,0 +1,155 @@
+package dr
+
+import "context"
+
+// WithContext returns store as a ContextStorage. Storage that does not
+// implement ContextStorage itself is adapted so that it is not called once
+// the context is done, although a call already under way cannot be cancelled.
+func WithContext(store Storage) ContextStorage {
+	if cs, ok := store.(ContextStorage); ok {
+		return cs
+	}
+	return contextAdapter{store}
+}
+
+type consumerKey struct{}
+
+// WithConsumer records who is asking for resources, for the benefit of
+// generators that mint resources for a particular consumer
+func WithConsumer(ctx context.Context, consumer string) context.Context {
+	return context.WithValue(ctx, consumerKey{}, consumer)
+}
+
+// Consumer returns who WithConsumer recorded as asking, if anyone
+func Consumer(ctx context.Context) string {
+	consumer, _ := ctx.Value(consumerKey{}).(string)
+	return consumer
+}
+
+type contextAdapter struct {
+	store Storage
+}
+
+func (c contextAdapter) AddContext(ctx context.Context, dr Dr) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.Add(dr)
+}
+
+func (c contextAdapter) AddBatchContext(ctx context.Context, resources []Dr, mode BatchMode) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return []BatchResult{}, err
+	}
+	return c.store.AddBatch(resources, mode)
+}
+
+func (c contextAdapter) AddGeneratedContext(ctx context.Context, dr Dr) (Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return Dr{}, err
+	}
+	return c.store.AddGenerated(dr)
+}
+
+func (c contextAdapter) CategoriesContext(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return c.store.Categories()
+}
+
+func (c contextAdapter) CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return c.store.CategoriesMatching(pattern)
+}
+
+func (c contextAdapter) CategoriesSelectedContext(ctx context.Context, selector Selector) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return c.store.CategoriesSelected(selector)
+}
+
+func (c contextAdapter) DeleteContext(ctx context.Context, category string, id string) (Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return Dr{}, err
+	}
+	return c.store.Delete(category, id)
+}
+
+func (c contextAdapter) DeleteBatchContext(ctx context.Context, category string, ids []string, mode BatchMode) ([]BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return []BatchResult{}, err
+	}
+	return c.store.DeleteBatch(category, ids, mode)
+}
+
+func (c contextAdapter) ExportContext(ctx context.Context, each func(Dr) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.Export(func(resource Dr) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return each(resource)
+	})
+}
+
+func (c contextAdapter) GetContext(ctx context.Context, category string, id string) (Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return Dr{}, err
+	}
+	return c.store.Get(category, id)
+}
+
+func (c contextAdapter) HealthCheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.HealthCheck()
+}
+
+func (c contextAdapter) ListContext(ctx context.Context, category string) (map[string]Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]Dr{}, err
+	}
+	return c.store.List(category)
+}
+
+func (c contextAdapter) ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]map[string]Dr{}, err
+	}
+	return c.store.ListMatching(pattern)
+}
+
+func (c contextAdapter) ListPageContext(ctx context.Context, category string, options ListOptions) (Page, error) {
+	if err := ctx.Err(); err != nil {
+		return Page{Resources: []Dr{}}, err
+	}
+	return c.store.ListPage(category, options)
+}
+
+func (c contextAdapter) ListSelectedContext(ctx context.Context, category string, selector Selector) (map[string]Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]Dr{}, err
+	}
+	return c.store.ListSelected(category, selector)
+}
+
+func (c contextAdapter) ResetContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.Reset()
+}
+
+func (c contextAdapter) SearchContext(ctx context.Context, selector Selector) (map[string]map[string]Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]map[string]Dr{}, err
+	}
+	return c.store.Search(selector)
+}
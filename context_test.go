@@ -0,0 +1,40 @@
+package dr_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/mock"
+)
+
+func TestWithContextAdaptsPlainStorage(t *testing.T) {
+
+	m := mock.New()
+	store := dr.WithContext(struct{ dr.Storage }{m}) //hide m's own context methods
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := store.GetContext(ctx, "a", "b"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	cancel()
+
+	if _, err := store.GetContext(ctx, "a", "b"); err != context.Canceled {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if m.GetMethod()["Get"] != 1 {
+		t.Errorf("Didn't call Get once, but %d times", m.GetMethod()["Get"])
+	}
+}
+
+func TestWithContextKeepsContextStorage(t *testing.T) {
+
+	m := mock.New()
+
+	if store, ok := dr.WithContext(m).(*mock.MockStorage); !ok || store != m {
+		t.Errorf("Adapted storage that already takes a context")
+	}
+}
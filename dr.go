@@ -1,33 +1,275 @@
 package dr
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"strings"
+)
 
 type Storage interface {
 	Add(dr Dr) error
+	AddBatch(resources []Dr, mode BatchMode) ([]BatchResult, error)
+	// AddGenerated adds a resource that has no ID yet, giving it one that
+	// is not already in use, and returns it as added
+	AddGenerated(dr Dr) (Dr, error)
 	Categories() (map[string]int, error)
+	CategoriesMatching(pattern string) (map[string]int, error)
+	CategoriesSelected(selector Selector) (map[string]int, error)
 	Delete(category string, id string) (Dr, error)
+	DeleteBatch(category string, ids []string, mode BatchMode) ([]BatchResult, error)
+	// Export calls each with every resource, in order of category then ID,
+	// including the Resource field and remaining TTL, so that adding them to
+	// another Storage recreates the same state. It stops at the first error
+	// from each. Resources within a second of expiry are left out, because a
+	// TTL of zero would make them live forever.
+	Export(each func(Dr) error) error
 	Get(category string, id string) (Dr, error)
 	HealthCheck() error
 	List(category string) (map[string]Dr, error)
+	ListMatching(pattern string) (map[string]map[string]Dr, error) // by category, then ID
+	ListPage(category string, options ListOptions) (Page, error)
+	ListSelected(category string, selector Selector) (map[string]Dr, error)
 	Reset() error
+	Search(selector Selector) (map[string]map[string]Dr, error) // in every category
+}
+
+// ContextStorage is Storage with a context on every method, so that
+// cancellation and deadlines (e.g. from an http.Request) reach the backend.
+// Use WithContext to obtain one from any Storage.
+type ContextStorage interface {
+	AddContext(ctx context.Context, dr Dr) error
+	AddBatchContext(ctx context.Context, resources []Dr, mode BatchMode) ([]BatchResult, error)
+	AddGeneratedContext(ctx context.Context, dr Dr) (Dr, error)
+	CategoriesContext(ctx context.Context) (map[string]int, error)
+	CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error)
+	CategoriesSelectedContext(ctx context.Context, selector Selector) (map[string]int, error)
+	DeleteContext(ctx context.Context, category string, id string) (Dr, error)
+	DeleteBatchContext(ctx context.Context, category string, ids []string, mode BatchMode) ([]BatchResult, error)
+	ExportContext(ctx context.Context, each func(Dr) error) error
+	GetContext(ctx context.Context, category string, id string) (Dr, error)
+	HealthCheckContext(ctx context.Context) error
+	ListContext(ctx context.Context, category string) (map[string]Dr, error)
+	ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]Dr, error)
+	ListPageContext(ctx context.Context, category string, options ListOptions) (Page, error)
+	ListSelectedContext(ctx context.Context, category string, selector Selector) (map[string]Dr, error)
+	ResetContext(ctx context.Context) error
+	SearchContext(ctx context.Context, selector Selector) (map[string]map[string]Dr, error)
+}
+
+// Notifier is optionally implemented by storage that can announce new
+// resources, so that consumers waiting on an empty category need not poll.
+// The returned channel is closed the next time a resource is added to the
+// category, or the storage is reset.
+type Notifier interface {
+	Notify(category string) <-chan struct{}
+}
+
+// Importer is optionally implemented by storage that changes resources on
+// the way in, e.g. by encrypting them, so that resources from an Export can
+// be added again as they were exported. Importing is otherwise AddBatch.
+type Importer interface {
+	ImportContext(ctx context.Context, resources []Dr, mode BatchMode) ([]BatchResult, error)
+}
+
+// PolicyStorage is optionally implemented by storage that can enforce a
+// Policy for each category on every Add
+type PolicyStorage interface {
+	DeletePolicy(category string) error
+	GetPolicy(category string) (Policy, error)
+	Policies() (map[string]Policy, error)
+	SetPolicy(category string, policy Policy) error
+}
+
+// Policy sets the rules for adding resources to a category. Zero values
+// impose no rule, so the zero Policy allows what a category without one does.
+type Policy struct {
+	DefaultTTL              int64    // given to resources added without a TTL
+	ForbidReusable          bool     // only single-use resources may be added
+	MaxDescriptionSize      int      // bytes
+	MaxResources            int      // in the category at any one time
+	MaxResourceSize         int      // bytes
+	MaxTTL                  int64    // resources that would live forever are refused too
+	RequiredDescriptionKeys []string // Description must be a JSON object with these keys
+	IDScheme                string   // for AddGenerated, IDSchemeUUIDv7 (default) or IDSchemeULID
+}
+
+// Schemes for the IDs made by AddGenerated, both of which start with the time
+const (
+	IDSchemeUUIDv7 = "uuidv7"
+	IDSchemeULID   = "ulid"
+)
+
+// TemplateStorage is optionally implemented by storage that can hold templates,
+// which are listed like ordinary single-use resources, but are not used up by
+// Get. Instead each Get returns a copy of the template with a Resource freshly
+// minted by its Generator, so a category can offer an endless supply of
+// single-use resources without being stocked with each one in advance.
+// Templates are left out of Export, because their generators are Go code.
+type TemplateStorage interface {
+	AddTemplate(template Dr, generator Generator) error
+}
+
+// Generator mints the Resource for each Get of a template, which it is given
+// along with whatever the template's own Resource says about how to do that.
+// It may be called with the storage locked, so should be quick, and for many
+// Gets at once, so must be safe for concurrent use.
+type Generator interface {
+	Generate(template Dr) (string, error)
+}
+
+// ContextGenerator is optionally implemented by a Generator that needs to know
+// about the Get it is minting for, e.g. which Consumer is asking
+type ContextGenerator interface {
+	GenerateContext(ctx context.Context, template Dr) (string, error)
+}
+
+// GeneratorFunc lets an ordinary function be used as a Generator
+type GeneratorFunc func(template Dr) (string, error)
+
+func (f GeneratorFunc) Generate(template Dr) (string, error) {
+	return f(template)
+}
+
+// SchemaStorage is optionally implemented by storage that can check the
+// Description of every resource added to a category against a JSON Schema
+type SchemaStorage interface {
+	DeleteSchema(category string) error
+	GetSchema(category string) (string, error)
+	Schemas() (map[string]string, error)
+	SetSchema(category string, schema string) error
+}
+
+// SchemaError lists why a Description does not match its category's schema.
+// It wraps ErrDescriptionSchema, for use with errors.Is.
+type SchemaError struct {
+	Category string
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return ErrDescriptionSchema.Error() + ": " + strings.Join(e.Problems, "; ")
+}
+
+func (e *SchemaError) Unwrap() error {
+	return ErrDescriptionSchema
+}
+
+// TrashStorage is optionally implemented by storage that can keep deleted
+// resources for a grace period, so that accidental deletions can be undone.
+// Resources deleted or reset go into the trash, but those used up by Get, or
+// that expire, do not. They are purged once the grace period is over, or when
+// they would have expired anyway, and are restored with whatever TTL they
+// have left. A grace period of zero, the default, turns the trash off.
+// Trash lists them without the Resource, as for List, which only Restore
+// gives back.
+type TrashStorage interface {
+	GracePeriod() (int64, error)
+	Restore(category string, id string) (Dr, error)
+	SetGracePeriod(seconds int64) error
+	Trash() (map[string]map[string]Dr, error) // by category, then ID
+}
+
+// TenantStorage is optionally implemented by storage that can keep several
+// tenants, e.g. courses, apart. Each tenant is a Storage of its own, with its
+// own categories, policies and schemas, so that resetting one leaves the rest
+// alone. The storage itself is the default tenant, named "".
+type TenantStorage interface {
+	Tenant(name string) (Storage, error)
+	Tenants() ([]string, error) // other than the default
 }
 
 type Dr struct {
 	Category    string
 	Description string
 	ID          string
+	Labels      map[string]string `json:",omitempty"`
 	Resource    string
 	Reusable    bool
 	TTL         int64
 }
 
+// ListOptions select one page of a category listing. The Cursor is opaque,
+// and is taken from Page.Next of the previous page (empty for the first page).
+// A Limit of zero or less returns everything after the Cursor.
+type ListOptions struct {
+	Cursor     string
+	Descending bool
+	Limit      int
+	Sort       string
+}
+
+// Page holds resources in the requested order, with the Resource field removed
+// as for List. Next is empty when there are no further pages.
+type Page struct {
+	Next      string
+	Resources []Dr
+}
+
+// BatchMode says what AddBatch and DeleteBatch do when some items fail
+type BatchMode int
+
+const (
+	AllOrNothing BatchMode = iota // apply no items if any fail
+	BestEffort                    // apply every item that can be
+)
+
+// BatchResult reports on one item of a batch, in the order given. Err is
+// ErrBatchAborted for an item that was fine but not applied because another
+// item failed in AllOrNothing mode.
+type BatchResult struct {
+	Category string
+	ID       string
+	Err      error
+}
+
+// sort orders for ListPage, with ties broken by ID
+const (
+	SortByID     = "id"
+	SortByExpiry = "expiry" // resources that never expire come last
+	SortByAdded  = "added"
+)
+
 const Separator = "." //to ease usage of simple key-value stores, via key = <category>.<ID>
 
+// Categories form a hierarchy, e.g. labs/edinburgh/pendulum, that can be
+// matched by patterns in which * stands for any one level, and a final **
+// for any number of levels (including none), e.g. labs/*/pendulum or labs/**
+const (
+	PathSeparator = "/"
+	Wildcard      = "*"
+	AnyDepth      = "**"
+)
+
 var ErrUndefinedCategory = errors.New("Undefined Category")
 var ErrUndefinedID = errors.New("Undefined ID")
 var ErrIllegalCategory = errors.New("Illegal Category")
 var ErrIllegalID = errors.New("Illegal ID")
+var ErrIllegalIDScheme = errors.New("Illegal ID scheme")
+var ErrIllegalTemplate = errors.New("Illegal template")
+var ErrIllegalLabel = errors.New("Illegal label")
+var ErrIllegalSelector = errors.New("Illegal selector")
+var ErrIllegalTenant = errors.New("Illegal tenant")
+var ErrTenantNotFound = errors.New("Tenant not found")
+var ErrIllegalGracePeriod = errors.New("Illegal grace period")
+var ErrResourceExists = errors.New("Resource already exists")
+var ErrIllegalCursor = errors.New("Illegal cursor")
+var ErrIllegalSort = errors.New("Illegal sort order")
 var ErrResourceNotFound = errors.New("Resource not found")
 var ErrEmptyList = errors.New("List is empty")
 var ErrEmptyStorage = errors.New("Storage is empty")
 var ErrUnhealthy = errors.New("Unhealthy storage")
+var ErrNotSupported = errors.New("Not supported by the underlying storage")
+var ErrBatchFailed = errors.New("Batch failed")
+var ErrBatchAborted = errors.New("Batch aborted")
+var ErrPolicyNotFound = errors.New("Policy not found")
+var ErrIllegalPolicy = errors.New("Illegal policy")
+var ErrTTLTooLong = errors.New("TTL exceeds category maximum")
+var ErrReusableNotAllowed = errors.New("Reusable resources not allowed in category")
+var ErrCategoryFull = errors.New("Category is full")
+var ErrStorageFull = errors.New("Storage is full")
+var ErrDescriptionTooLarge = errors.New("Description too large")
+var ErrResourceTooLarge = errors.New("Resource too large")
+var ErrDescriptionKeys = errors.New("Description lacks required keys")
+var ErrSchemaNotFound = errors.New("Schema not found")
+var ErrIllegalSchema = errors.New("Illegal schema")
+var ErrDescriptionSchema = errors.New("Description does not match schema")
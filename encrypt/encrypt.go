@@ -0,0 +1,580 @@
+// package encrypt keeps the Resource of every resource encrypted in the
+// storage underneath it, so that dumps, snapshots and exports of that storage
+// never contain readable secrets. Each Resource is encrypted with AES-GCM
+// under a key of its own, which is itself encrypted under a key from a
+// KeyProvider (envelope encryption), and is only decrypted again by Get.
+package encrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/idgen"
+	"github.com/timdrysdale/dr/wait"
+)
+
+var ErrMalformed = errors.New("Malformed encrypted resource")
+
+// prefix marks an encrypted Resource, which is followed by the key ID, the
+// wrapped data key and the ciphertext, all base64url encoded and . separated
+const prefix = "enc.v1."
+
+// Storage encrypts Resources on the way into the underlying storage, and
+// decrypts them on the way out. Exports contain the encrypted form, which
+// can be imported again, with ImportContext (as ndjson.Read does), through
+// any Storage that has the keys. Resources
+// that were never encrypted, such as those minted by templates, are passed
+// through as they are. Note that a policy's MaxResourceSize applies to the
+// encrypted form, which is about 100 bytes longer.
+type Storage struct {
+	store    dr.ContextStorage
+	original dr.Storage // for the optional interfaces
+	keys     KeyProvider
+}
+
+func New(store dr.Storage, keys KeyProvider) *Storage {
+	return &Storage{store: dr.WithContext(store), original: store, keys: keys}
+}
+
+// seal encrypts the Resource, binding it to the category and ID so it can't
+// be moved to another one. A Resource that looks encrypted already is
+// encrypted again, like any other, so only ImportContext can pass on one
+// that was exported.
+func (s *Storage) seal(resource dr.Dr) (dr.Dr, error) {
+
+	if resource.Resource == "" {
+		return resource, nil
+	}
+
+	id, kek, err := s.keys.Current()
+	if err != nil {
+		return resource, err
+	}
+
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return resource, err
+	}
+
+	aad := boundTo(resource)
+
+	wrapped, err := gcmSeal(kek, dek, aad)
+	if err != nil {
+		return resource, err
+	}
+
+	ciphertext, err := gcmSeal(dek, []byte(resource.Resource), aad)
+	if err != nil {
+		return resource, err
+	}
+
+	resource.Resource = prefix + encode([]byte(id)) + "." + encode(wrapped) + "." + encode(ciphertext)
+
+	return resource, nil
+}
+
+// open decrypts the Resource, if it is encrypted
+func (s *Storage) open(resource dr.Dr) (dr.Dr, error) {
+
+	id, wrapped, ciphertext, err := parse(resource.Resource)
+	if err == errPlain {
+		return resource, nil
+	}
+	if err != nil {
+		return resource, err
+	}
+
+	kek, err := s.keys.Key(id)
+	if err != nil {
+		return resource, err
+	}
+
+	aad := boundTo(resource)
+
+	dek, err := gcmOpen(kek, wrapped, aad)
+	if err != nil {
+		return resource, err
+	}
+
+	plaintext, err := gcmOpen(dek, ciphertext, aad)
+	if err != nil {
+		return resource, err
+	}
+
+	resource.Resource = string(plaintext)
+
+	return resource, nil
+}
+
+// boundTo is the additional data a Resource is encrypted with, which must
+// be the same to decrypt it. Neither categories nor IDs contain a newline.
+func boundTo(resource dr.Dr) []byte {
+	return []byte(resource.Category + "\n" + resource.ID)
+}
+
+var errPlain = errors.New("not encrypted")
+
+func parse(s string) (string, []byte, []byte, error) {
+
+	if !strings.HasPrefix(s, prefix) {
+		return "", nil, nil, errPlain
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, prefix), ".")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrMalformed
+	}
+
+	decoded := make([][]byte, 3)
+
+	for i, part := range parts {
+		b, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", nil, nil, ErrMalformed
+		}
+		decoded[i] = b
+	}
+
+	return string(decoded[0]), decoded[1], decoded[2], nil
+}
+
+func gcmSeal(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key []byte, sealed []byte, aad []byte) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// KeyUsage counts the resources encrypted under each key, so that after
+// rotating to a new key, it is clear when the old one is no longer needed.
+// Resources are not re-encrypted in place, because a single-use resource
+// taken in the meantime would come back, but they are usually short-lived.
+func (s *Storage) KeyUsage(ctx context.Context) (map[string]int, error) {
+
+	usage := make(map[string]int)
+
+	err := s.store.ExportContext(ctx, func(resource dr.Dr) error {
+		if id, _, _, err := parse(resource.Resource); err == nil {
+			usage[id]++
+		}
+		return nil
+	})
+
+	return usage, err
+}
+
+// dr.Storage
+
+func (s *Storage) Add(resource dr.Dr) error {
+	return s.AddContext(context.Background(), resource)
+}
+
+func (s *Storage) AddBatch(resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return s.AddBatchContext(context.Background(), resources, mode)
+}
+
+func (s *Storage) AddGenerated(resource dr.Dr) (dr.Dr, error) {
+	return s.AddGeneratedContext(context.Background(), resource)
+}
+
+func (s *Storage) Categories() (map[string]int, error) {
+	return s.CategoriesContext(context.Background())
+}
+
+func (s *Storage) CategoriesMatching(pattern string) (map[string]int, error) {
+	return s.CategoriesMatchingContext(context.Background(), pattern)
+}
+
+func (s *Storage) CategoriesSelected(selector dr.Selector) (map[string]int, error) {
+	return s.CategoriesSelectedContext(context.Background(), selector)
+}
+
+func (s *Storage) Delete(category string, id string) (dr.Dr, error) {
+	return s.DeleteContext(context.Background(), category, id)
+}
+
+func (s *Storage) DeleteBatch(category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return s.DeleteBatchContext(context.Background(), category, ids, mode)
+}
+
+func (s *Storage) Export(each func(dr.Dr) error) error {
+	return s.ExportContext(context.Background(), each)
+}
+
+func (s *Storage) Get(category string, id string) (dr.Dr, error) {
+	return s.GetContext(context.Background(), category, id)
+}
+
+func (s *Storage) HealthCheck() error {
+	return s.HealthCheckContext(context.Background())
+}
+
+func (s *Storage) List(category string) (map[string]dr.Dr, error) {
+	return s.ListContext(context.Background(), category)
+}
+
+func (s *Storage) ListMatching(pattern string) (map[string]map[string]dr.Dr, error) {
+	return s.ListMatchingContext(context.Background(), pattern)
+}
+
+func (s *Storage) ListPage(category string, options dr.ListOptions) (dr.Page, error) {
+	return s.ListPageContext(context.Background(), category, options)
+}
+
+func (s *Storage) ListSelected(category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	return s.ListSelectedContext(context.Background(), category, selector)
+}
+
+func (s *Storage) Reset() error {
+	return s.ResetContext(context.Background())
+}
+
+func (s *Storage) Search(selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	return s.SearchContext(context.Background(), selector)
+}
+
+// dr.ContextStorage
+
+func (s *Storage) AddContext(ctx context.Context, resource dr.Dr) error {
+
+	resource, err := s.seal(resource)
+	if err != nil {
+		return err
+	}
+
+	return s.store.AddContext(ctx, resource)
+}
+
+func (s *Storage) AddBatchContext(ctx context.Context, resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	sealed := make([]dr.Dr, len(resources))
+
+	for i, resource := range resources {
+		var err error
+		if sealed[i], err = s.seal(resource); err != nil {
+			return []dr.BatchResult{}, err
+		}
+	}
+
+	return s.store.AddBatchContext(ctx, sealed, mode)
+}
+
+// AddGeneratedContext gives the resource its ID here, in the category's
+// IDScheme, rather than leaving it to the underlying storage, because the
+// ID must be known to encrypt the Resource. An ID that is already in use is
+// replaced, but IDs are random enough that that doesn't happen.
+func (s *Storage) AddGeneratedContext(ctx context.Context, resource dr.Dr) (dr.Dr, error) {
+
+	if resource.ID != "" {
+		return dr.Dr{}, dr.ErrIllegalID
+	}
+
+	scheme := ""
+	if policies, ok := s.original.(dr.PolicyStorage); ok {
+		if policy, err := policies.GetPolicy(resource.Category); err == nil {
+			scheme = policy.IDScheme
+			if resource.TTL <= 0 {
+				resource.TTL = policy.DefaultTTL //as the underlying storage will
+			}
+		}
+	}
+
+	id, err := idgen.New(scheme)
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	resource.ID = id
+
+	sealed, err := s.seal(resource)
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	if err := s.store.AddContext(ctx, sealed); err != nil {
+		return dr.Dr{}, err
+	}
+
+	return resource, nil
+}
+
+func (s *Storage) CategoriesContext(ctx context.Context) (map[string]int, error) {
+	return s.store.CategoriesContext(ctx)
+}
+
+func (s *Storage) CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error) {
+	return s.store.CategoriesMatchingContext(ctx, pattern)
+}
+
+func (s *Storage) CategoriesSelectedContext(ctx context.Context, selector dr.Selector) (map[string]int, error) {
+	return s.store.CategoriesSelectedContext(ctx, selector)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+
+	resource, err := s.store.DeleteContext(ctx, category, id)
+	if err != nil {
+		return resource, err
+	}
+
+	return s.open(resource)
+}
+
+func (s *Storage) DeleteBatchContext(ctx context.Context, category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return s.store.DeleteBatchContext(ctx, category, ids, mode)
+}
+
+// ImportContext adds resources from an export, passing on those that are
+// encrypted already as they are, if they decrypt, and encrypting the rest
+func (s *Storage) ImportContext(ctx context.Context, resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	sealed := make([]dr.Dr, len(resources))
+
+	for i, resource := range resources {
+
+		if strings.HasPrefix(resource.Resource, prefix) {
+			if _, err := s.open(resource); err == nil {
+				sealed[i] = resource
+				continue
+			}
+		}
+
+		var err error
+		if sealed[i], err = s.seal(resource); err != nil {
+			return []dr.BatchResult{}, err
+		}
+	}
+
+	return s.store.AddBatchContext(ctx, sealed, mode)
+}
+
+// ExportContext passes on resources still encrypted
+func (s *Storage) ExportContext(ctx context.Context, each func(dr.Dr) error) error {
+	return s.store.ExportContext(ctx, each)
+}
+
+func (s *Storage) GetContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+
+	resource, err := s.store.GetContext(ctx, category, id)
+	if err != nil {
+		return resource, err
+	}
+
+	return s.open(resource)
+}
+
+func (s *Storage) HealthCheckContext(ctx context.Context) error {
+
+	if _, _, err := s.keys.Current(); err != nil {
+		return err
+	}
+
+	return s.store.HealthCheckContext(ctx)
+}
+
+func (s *Storage) ListContext(ctx context.Context, category string) (map[string]dr.Dr, error) {
+	return s.store.ListContext(ctx, category)
+}
+
+func (s *Storage) ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]dr.Dr, error) {
+	return s.store.ListMatchingContext(ctx, pattern)
+}
+
+func (s *Storage) ListPageContext(ctx context.Context, category string, options dr.ListOptions) (dr.Page, error) {
+	return s.store.ListPageContext(ctx, category, options)
+}
+
+func (s *Storage) ListSelectedContext(ctx context.Context, category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	return s.store.ListSelectedContext(ctx, category, selector)
+}
+
+func (s *Storage) ResetContext(ctx context.Context) error {
+	return s.store.ResetContext(ctx)
+}
+
+func (s *Storage) SearchContext(ctx context.Context, selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	return s.store.SearchContext(ctx, selector)
+}
+
+// optional interfaces, passed on to the underlying storage if it has them
+
+func (s *Storage) Notify(category string) <-chan struct{} {
+	return wait.Notify(s.original, category)
+}
+
+// AddTemplate does not encrypt the template's Resource, because it is
+// configuration for the generator rather than a secret handed out
+func (s *Storage) AddTemplate(template dr.Dr, generator dr.Generator) error {
+	if templates, ok := s.original.(dr.TemplateStorage); ok {
+		return templates.AddTemplate(template, generator)
+	}
+	return dr.ErrNotSupported
+}
+
+func (s *Storage) GracePeriod() (int64, error) {
+	if trash, ok := s.original.(dr.TrashStorage); ok {
+		return trash.GracePeriod()
+	}
+	return 0, dr.ErrNotSupported
+}
+
+func (s *Storage) Restore(category string, id string) (dr.Dr, error) {
+	if trash, ok := s.original.(dr.TrashStorage); ok {
+		resource, err := trash.Restore(category, id)
+		if err != nil {
+			return resource, err
+		}
+		return s.open(resource)
+	}
+	return dr.Dr{}, dr.ErrNotSupported
+}
+
+func (s *Storage) SetGracePeriod(seconds int64) error {
+	if trash, ok := s.original.(dr.TrashStorage); ok {
+		return trash.SetGracePeriod(seconds)
+	}
+	return dr.ErrNotSupported
+}
+
+// Trash decrypts what is in the trash, so it can be checked before it is
+// restored
+func (s *Storage) Trash() (map[string]map[string]dr.Dr, error) {
+
+	trash, ok := s.original.(dr.TrashStorage)
+	if !ok {
+		return map[string]map[string]dr.Dr{}, dr.ErrNotSupported
+	}
+
+	lists, err := trash.Trash()
+	if err != nil {
+		return lists, err
+	}
+
+	// nothing to decrypt, as the listing leaves the Resource out, but make
+	// sure of it, whatever the underlying storage does
+	for _, list := range lists {
+		for id, resource := range list {
+			resource.Resource = ""
+			list[id] = resource
+		}
+	}
+
+	return lists, nil
+}
+
+// Tenant encrypts the tenant's resources with the same keys
+func (s *Storage) Tenant(name string) (dr.Storage, error) {
+	if tenants, ok := s.original.(dr.TenantStorage); ok {
+		tenant, err := tenants.Tenant(name)
+		if err != nil {
+			return nil, err
+		}
+		return New(tenant, s.keys), nil
+	}
+	return nil, dr.ErrNotSupported
+}
+
+func (s *Storage) Tenants() ([]string, error) {
+	if tenants, ok := s.original.(dr.TenantStorage); ok {
+		return tenants.Tenants()
+	}
+	return []string{}, dr.ErrNotSupported
+}
+
+func (s *Storage) DeletePolicy(category string) error {
+	if policies, ok := s.original.(dr.PolicyStorage); ok {
+		return policies.DeletePolicy(category)
+	}
+	return dr.ErrNotSupported
+}
+
+func (s *Storage) GetPolicy(category string) (dr.Policy, error) {
+	if policies, ok := s.original.(dr.PolicyStorage); ok {
+		return policies.GetPolicy(category)
+	}
+	return dr.Policy{}, dr.ErrNotSupported
+}
+
+func (s *Storage) Policies() (map[string]dr.Policy, error) {
+	if policies, ok := s.original.(dr.PolicyStorage); ok {
+		return policies.Policies()
+	}
+	return map[string]dr.Policy{}, dr.ErrNotSupported
+}
+
+func (s *Storage) SetPolicy(category string, policy dr.Policy) error {
+	if policies, ok := s.original.(dr.PolicyStorage); ok {
+		return policies.SetPolicy(category, policy)
+	}
+	return dr.ErrNotSupported
+}
+
+func (s *Storage) DeleteSchema(category string) error {
+	if schemas, ok := s.original.(dr.SchemaStorage); ok {
+		return schemas.DeleteSchema(category)
+	}
+	return dr.ErrNotSupported
+}
+
+func (s *Storage) GetSchema(category string) (string, error) {
+	if schemas, ok := s.original.(dr.SchemaStorage); ok {
+		return schemas.GetSchema(category)
+	}
+	return "", dr.ErrNotSupported
+}
+
+func (s *Storage) Schemas() (map[string]string, error) {
+	if schemas, ok := s.original.(dr.SchemaStorage); ok {
+		return schemas.Schemas()
+	}
+	return map[string]string{}, dr.ErrNotSupported
+}
+
+func (s *Storage) SetSchema(category string, schema string) error {
+	if schemas, ok := s.original.(dr.SchemaStorage); ok {
+		return schemas.SetSchema(category, schema)
+	}
+	return dr.ErrNotSupported
+}
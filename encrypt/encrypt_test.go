@@ -0,0 +1,213 @@
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/generator"
+	"github.com/timdrysdale/dr/ndjson"
+	"github.com/timdrysdale/dr/ram"
+	"github.com/timdrysdale/dr/test"
+)
+
+func newKeyring(t *testing.T, ids ...string) *Keyring {
+	keys := NewKeyring()
+	for _, id := range ids {
+		if err := keys.Add(id, bytes.Repeat([]byte(id[:1]), 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+// run the generic tests that don't look at the underlying storage
+func TestInterface(t *testing.T) {
+	keys := newKeyring(t, "a")
+	tester := test.Tester{
+		New:          func() dr.Storage { return New(ram.New(), keys) },
+		NewWithClock: func(clock clockwork.Clock) dr.Storage { return New(ram.NewWithClock(clock), keys) },
+	}
+	test.TestInterface(t, tester)
+	test.TestBatch(t, tester)
+	test.TestHierarchy(t, tester)
+	test.TestLabels(t, tester)
+	test.TestAddGenerated(t, tester)
+	test.TestPolicy(t, tester)
+	test.TestTenants(t, tester)
+	test.TestTrash(t, tester)
+	test.TestConcurrency(t, tester)
+	test.TestModel(t, tester)
+}
+
+func TestNoReadableSecrets(t *testing.T) {
+
+	underlying := ram.New()
+	store := New(underlying, newKeyring(t, "a"))
+
+	store.Add(dr.Dr{Category: "c", ID: "a", Resource: "topsecret", Reusable: true})
+	store.AddBatch([]dr.Dr{{Category: "c", ID: "b", Resource: "topsecret"}}, dr.AllOrNothing)
+	added, _ := store.AddGenerated(dr.Dr{Category: "c", Resource: "topsecret"})
+
+	if added.Resource != "topsecret" {
+		t.Errorf("AddGenerated should give back the plaintext, got %s", added.Resource)
+	}
+
+	var dump bytes.Buffer
+	count, err := ndjson.Write(context.Background(), &dump, store)
+
+	if err != nil || count != 3 || strings.Contains(dump.String(), "topsecret") {
+		t.Errorf("export has readable secrets %d %v\n%s", count, err, dump.String())
+	}
+
+	raw, _ := underlying.Get("c", "a")
+	if !strings.HasPrefix(raw.Resource, prefix) {
+		t.Errorf("underlying storage has readable secret %s", raw.Resource)
+	}
+
+	resource, err := store.Get("c", "a")
+	if err != nil || resource.Resource != "topsecret" {
+		t.Errorf("Get should decrypt, got %v %v", resource, err)
+	}
+
+	// an export can be imported into another store with the same keys
+	other := New(ram.New(), newKeyring(t, "a"))
+	added2, failed, err := ndjson.Read(context.Background(), &dump, other, dr.AllOrNothing)
+
+	if err != nil || added2 != 3 || len(failed) != 0 {
+		t.Fatalf("import failed %d %v %v", added2, failed, err)
+	}
+
+	resource, err = other.Get("c", "b")
+	if err != nil || resource.Resource != "topsecret" {
+		t.Errorf("imported resource should decrypt once, got %v %v", resource, err)
+	}
+}
+
+func TestBoundToCategory(t *testing.T) {
+
+	underlying := ram.New()
+	store := New(underlying, newKeyring(t, "a"))
+
+	store.Add(dr.Dr{Category: "c", ID: "a", Resource: "topsecret"})
+
+	raw, _ := underlying.Get("c", "a")
+	raw.Category = "d"
+	underlying.Add(raw)
+
+	if _, err := store.Get("d", "a"); err == nil {
+		t.Errorf("secret moved to another category should not decrypt")
+	}
+}
+
+func TestBoundToID(t *testing.T) {
+
+	underlying := ram.New()
+	store := New(underlying, newKeyring(t, "a"))
+
+	store.Add(dr.Dr{Category: "c", ID: "a", Resource: "topsecret"})
+
+	raw, _ := underlying.Get("c", "a")
+
+	raw.ID = "b"
+	underlying.Add(raw)
+
+	if _, err := store.Get("c", "b"); err == nil {
+		t.Errorf("secret moved to another ID should not decrypt")
+	}
+
+	// nor can a ciphertext be added under an ID of its own choosing, and
+	// read back as plaintext
+	raw.ID = "c"
+	store.Add(raw)
+
+	if resource, err := store.Get("c", "c"); err != nil || resource.Resource != raw.Resource {
+		t.Errorf("added ciphertext should only decrypt to itself, got %v %v", resource, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+
+	keys := newKeyring(t, "old", "new")
+	store := New(ram.New(), keys)
+
+	store.Add(dr.Dr{Category: "c", ID: "a", Resource: "first"})
+	keys.Use("new")
+	store.Add(dr.Dr{Category: "c", ID: "b", Resource: "second"})
+
+	usage, err := store.KeyUsage(context.Background())
+	if err != nil || usage["old"] != 1 || usage["new"] != 1 {
+		t.Errorf("unexpected usage %v %v", usage, err)
+	}
+
+	if resource, err := store.Get("c", "a"); err != nil || resource.Resource != "first" {
+		t.Errorf("old key should still decrypt, got %v %v", resource, err)
+	}
+
+	keys.Remove("old")
+	store.Add(dr.Dr{Category: "c", ID: "c", Resource: "third"})
+	keys.Remove("new")
+
+	if _, err := store.Get("c", "c"); err != ErrKeyNotFound {
+		t.Errorf("removed key should not decrypt, got %v", err)
+	}
+
+	if err := store.Add(dr.Dr{Category: "c", ID: "d", Resource: "fourth"}); err != ErrNoCurrentKey {
+		t.Errorf("should not add without a key, got %v", err)
+	}
+}
+
+func TestTemplatesPassThrough(t *testing.T) {
+
+	store := New(ram.New(), newKeyring(t, "a"))
+
+	if err := store.AddTemplate(dr.Dr{Category: "c", ID: "t"}, generator.Counter(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if resource, err := store.Get("c", "t"); err != nil || resource.Resource != "1" {
+		t.Errorf("minted resource should pass through, got %v %v", resource, err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+
+	keys := NewKeyring()
+
+	if _, _, err := keys.Current(); err != ErrNoCurrentKey {
+		t.Errorf("expected no current key, got %v", err)
+	}
+
+	if err := keys.Add("a", []byte("short")); err != ErrIllegalKey {
+		t.Errorf("expected illegal key, got %v", err)
+	}
+
+	if err := keys.Use("a"); err != ErrKeyNotFound {
+		t.Errorf("expected key not found, got %v", err)
+	}
+}
+
+func TestTenantsEncrypted(t *testing.T) {
+
+	underlying := ram.New()
+	store := New(underlying, newKeyring(t, "a"))
+
+	tenant, err := store.Tenant("course")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant.Add(dr.Dr{Category: "c", ID: "a", Resource: "topsecret", Reusable: true})
+
+	raw, _ := underlying.(dr.TenantStorage).Tenant("course")
+	if resource, _ := raw.Get("c", "a"); !strings.HasPrefix(resource.Resource, prefix) {
+		t.Errorf("tenant's underlying storage has readable secret %s", resource.Resource)
+	}
+
+	if resource, err := tenant.Get("c", "a"); err != nil || resource.Resource != "topsecret" {
+		t.Errorf("tenant should decrypt, got %v %v", resource, err)
+	}
+}
@@ -0,0 +1,108 @@
+package encrypt
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrKeyNotFound = errors.New("Key not found")
+var ErrIllegalKey = errors.New("Illegal key")
+var ErrNoCurrentKey = errors.New("No current key")
+
+// KeyProvider supplies the keys that wrap the key each Resource is encrypted
+// with, so they can be kept elsewhere, e.g. in a key management service
+type KeyProvider interface {
+	Current() (string, []byte, error) // ID and key to encrypt with from now on
+	Key(id string) ([]byte, error)    // any key still needed for decryption
+}
+
+// Keyring is a KeyProvider that holds its keys in memory. It is safe for
+// concurrent use.
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+	sync.RWMutex
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add adds an AES-128, 192 or 256 key, which becomes current if it is the first
+func (k *Keyring) Add(id string, key []byte) error {
+
+	if id == "" || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		return ErrIllegalKey
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.keys[id] = append([]byte{}, key...)
+
+	if k.current == "" {
+		k.current = id
+	}
+
+	return nil
+}
+
+// Use encrypts with the key from now on. Resources already encrypted with
+// other keys are left as they are, so keep those keys until they expire or
+// are used up, i.e. until Storage.KeyUsage no longer counts any under them.
+func (k *Keyring) Use(id string) error {
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+
+	k.current = id
+
+	return nil
+}
+
+// Remove forgets a key, so that anything still encrypted with it is lost
+func (k *Keyring) Remove(id string) error {
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(k.keys, id)
+
+	if k.current == id {
+		k.current = ""
+	}
+
+	return nil
+}
+
+func (k *Keyring) Current() (string, []byte, error) {
+
+	k.RLock()
+	defer k.RUnlock()
+
+	if k.current == "" {
+		return "", nil, ErrNoCurrentKey
+	}
+
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *Keyring) Key(id string) ([]byte, error) {
+
+	k.RLock()
+	defer k.RUnlock()
+
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,134 @@
+// package generator provides ready-made dr.Generators for templates, which
+// mint a fresh single-use resource each time the template is got
+package generator
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/timdrysdale/dr"
+)
+
+var ErrBadSignature = errors.New("Bad signature")
+var ErrMalformed = errors.New("Malformed token")
+
+// Random mints secrets of size random bytes, base64url encoded, prefixed by
+// the template's Resource, if it has one
+func Random(size int) dr.Generator {
+	return dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+		secret, err := random(size)
+		if err != nil {
+			return "", err
+		}
+		return template.Resource + secret, nil
+	})
+}
+
+// Counter mints the numbers start, start+1, ... prefixed by the template's
+// Resource, if it has one. It is safe to share between templates, which then
+// count together.
+func Counter(start uint64) dr.Generator {
+	next := start - 1
+	return dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+		return template.Resource + strconv.FormatUint(atomic.AddUint64(&next, 1), 10), nil
+	})
+}
+
+// Payload is what HMAC signs. Data is the template's Resource, so a template
+// can carry e.g. what the holder is entitled to.
+type Payload struct {
+	Category string
+	ID       string
+	Data     string `json:",omitempty"`
+	Nonce    string
+	Issued   int64 // unix seconds
+	Expires  int64 `json:",omitempty"` // unix seconds, when the template expires
+}
+
+// HMAC mints tokens of the form <payload>.<signature>, both base64url
+// encoded, where the payload is the JSON of a Payload, and the signature is
+// its HMAC-SHA256 under key. Check them with Verify.
+func HMAC(key []byte) dr.Generator {
+	return dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+
+		nonce, err := random(16)
+		if err != nil {
+			return "", err
+		}
+
+		payload := Payload{
+			Category: template.Category,
+			ID:       template.ID,
+			Data:     template.Resource,
+			Nonce:    nonce,
+			Issued:   time.Now().Unix(),
+		}
+
+		if template.TTL > 0 {
+			payload.Expires = payload.Issued + template.TTL
+		}
+
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return "", err
+		}
+
+		encoded := base64.RawURLEncoding.EncodeToString(b)
+
+		return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(key, encoded)), nil
+	})
+}
+
+// Verify checks a token minted by HMAC with the same key, and returns its
+// payload. Checking whether it has expired is left to the caller.
+func Verify(key []byte, token string) (Payload, error) {
+
+	var payload Payload
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return payload, ErrMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return payload, ErrMalformed
+	}
+
+	if !hmac.Equal(signature, sign(key, parts[0])) {
+		return payload, ErrBadSignature
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return payload, ErrMalformed
+	}
+
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return payload, ErrMalformed
+	}
+
+	return payload, nil
+}
+
+func sign(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func random(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,77 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+func TestRandom(t *testing.T) {
+
+	g := Random(32)
+	template := dr.Dr{Category: "a", ID: "a", Resource: "sk_"}
+
+	first, err := g.Generate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := g.Generate(template)
+
+	if !strings.HasPrefix(first, "sk_") || len(first) != 3+43 {
+		t.Errorf("badly formed secret %s", first)
+	}
+	if first == second {
+		t.Errorf("secret repeated")
+	}
+}
+
+func TestCounter(t *testing.T) {
+
+	g := Counter(7)
+
+	for _, expected := range []string{"n7", "n8", "n9"} {
+		if got, _ := g.Generate(dr.Dr{Resource: "n"}); got != expected {
+			t.Errorf("got %s, expected %s", got, expected)
+		}
+	}
+}
+
+func TestHMAC(t *testing.T) {
+
+	key := []byte("somesecret")
+	template := dr.Dr{Category: "a", ID: "b", Resource: "pendulum-1", TTL: 60}
+
+	token, err := HMAC(key).Generate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := Verify(key, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Category != "a" || payload.ID != "b" || payload.Data != "pendulum-1" ||
+		payload.Nonce == "" || payload.Expires != payload.Issued+60 {
+		t.Errorf("wrong payload %+v", payload)
+	}
+
+	if _, err := Verify([]byte("othersecret"), token); err != ErrBadSignature {
+		t.Errorf("wrong key should give bad signature, got %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if _, err := Verify(key, parts[0]+"x."+parts[1]); err != ErrBadSignature {
+		t.Errorf("altered payload should give bad signature, got %v", err)
+	}
+
+	if _, err := Verify(key, "nodots"); err != ErrMalformed {
+		t.Errorf("expected malformed, got %v", err)
+	}
+
+	again, _ := HMAC(key).Generate(template)
+	if again == token {
+		t.Errorf("token repeated")
+	}
+}
@@ -0,0 +1,42 @@
+// package idgen makes IDs for resources added without one. They are unique
+// without any coordination between suppliers, and sort roughly in the order
+// they were made.
+package idgen
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+	"github.com/timdrysdale/dr"
+)
+
+// New makes an ID using the scheme, which defaults to dr.IDSchemeUUIDv7
+func New(scheme string) (string, error) {
+
+	switch scheme {
+
+	case "", dr.IDSchemeUUIDv7:
+		id, err := uuid.NewV7()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+
+	case dr.IDSchemeULID:
+		id, err := ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+
+	default:
+		return "", dr.ErrIllegalIDScheme
+	}
+}
+
+// Legal reports whether New understands the scheme
+func Legal(scheme string) bool {
+	return scheme == "" || scheme == dr.IDSchemeUUIDv7 || scheme == dr.IDSchemeULID
+}
@@ -0,0 +1,36 @@
+package idgen
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+func TestNew(t *testing.T) {
+
+	for scheme, format := range map[string]*regexp.Regexp{
+		"":                regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		dr.IDSchemeUUIDv7: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		dr.IDSchemeULID:   regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`),
+	} {
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			id, err := New(scheme)
+			if err != nil {
+				t.Fatalf("New(%q): %v", scheme, err)
+			}
+			if !format.MatchString(id) {
+				t.Errorf("New(%q) gave badly formed %s", scheme, id)
+			}
+			if seen[id] {
+				t.Errorf("New(%q) repeated %s", scheme, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	if _, err := New("serial"); err != dr.ErrIllegalIDScheme {
+		t.Errorf("unknown scheme should be illegal, got %v", err)
+	}
+}
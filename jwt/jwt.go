@@ -0,0 +1,384 @@
+// package jwt mints signed JSON Web Tokens as the Resource revealed by Get,
+// so that hardware can check a token offline instead of asking dr about it.
+// Use Generator with a template (see dr.TemplateStorage), and publish the
+// public keys with restapi so the hardware can fetch them.
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timdrysdale/dr"
+)
+
+const (
+	HS256 = "HS256"
+	ES256 = "ES256"
+)
+
+var ErrNoSigningKey = errors.New("No signing key")
+var ErrKeyNotFound = errors.New("Key not found")
+var ErrKeyExists = errors.New("Key already exists")
+var ErrKeyInUse = errors.New("Key is in use for signing")
+var ErrIllegalKey = errors.New("Illegal key")
+var ErrMalformed = errors.New("Malformed token")
+var ErrBadSignature = errors.New("Bad signature")
+var ErrExpired = errors.New("Token expired")
+
+// Claims are what a minted token says about the resource and who got it
+type Claims struct {
+	Issuer      string `json:"iss,omitempty"`
+	Subject     string `json:"sub,omitempty"` // the consumer, if known
+	Audience    string `json:"aud,omitempty"` // the category
+	ID          string `json:"jti"`
+	IssuedAt    int64  `json:"iat"`
+	Expires     int64  `json:"exp,omitempty"` // from the remaining TTL, or DefaultLifetime
+	Category    string `json:"category"`
+	ResourceID  string `json:"rid"`
+	Description string `json:"description,omitempty"`
+}
+
+type key struct {
+	algorithm string
+	secret    []byte            // HS256
+	private   *ecdsa.PrivateKey // ES256
+}
+
+// KeySet holds the keys tokens are signed with. One of them signs new
+// tokens, while the others are kept so that tokens they have already signed
+// can still be verified, until they are retired. It is safe for concurrent use.
+type KeySet struct {
+	keys    map[string]key
+	signing string
+	sync.RWMutex
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]key)}
+}
+
+// AddHS256 adds a shared secret. Tokens it signs can only be checked by
+// those who have the secret, so it is not published in the JWKS.
+func (k *KeySet) AddHS256(kid string, secret []byte) error {
+
+	if kid == "" || len(secret) < 32 {
+		return ErrIllegalKey
+	}
+
+	return k.add(kid, key{algorithm: HS256, secret: secret})
+}
+
+// AddES256 adds a P-256 private key, whose public half is published in the JWKS
+func (k *KeySet) AddES256(kid string, private *ecdsa.PrivateKey) error {
+
+	if kid == "" || private == nil || private.Curve != elliptic.P256() {
+		return ErrIllegalKey
+	}
+
+	return k.add(kid, key{algorithm: ES256, private: private})
+}
+
+// add refuses a kid that is taken, so that a key can't be quietly swapped
+// for another. Retire the old key first to replace it.
+func (k *KeySet) add(kid string, newKey key) error {
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[kid]; ok {
+		return ErrKeyExists
+	}
+
+	k.keys[kid] = newKey
+
+	if k.signing == "" {
+		k.signing = kid
+	}
+
+	return nil
+}
+
+// Rotate makes a new ES256 key and signs with it from now on. The previous
+// key is kept for verification until it is retired.
+func (k *KeySet) Rotate(kid string) error {
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if err := k.AddES256(kid, private); err != nil {
+		return err
+	}
+
+	return k.Use(kid)
+}
+
+// Use signs new tokens with the key
+func (k *KeySet) Use(kid string) error {
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[kid]; !ok {
+		return ErrKeyNotFound
+	}
+
+	k.signing = kid
+
+	return nil
+}
+
+// Retire removes a key, so tokens it signed no longer verify
+func (k *KeySet) Retire(kid string) error {
+
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[kid]; !ok {
+		return ErrKeyNotFound
+	}
+
+	if kid == k.signing {
+		return ErrKeyInUse
+	}
+
+	delete(k.keys, kid)
+
+	return nil
+}
+
+// Sign makes a token with the claims, using the current signing key
+func (k *KeySet) Sign(claims Claims) (string, error) {
+
+	k.RLock()
+	kid := k.signing
+	signingKey, ok := k.keys[kid]
+	k.RUnlock()
+
+	if !ok {
+		return "", ErrNoSigningKey
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": signingKey.algorithm, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encode(header) + "." + encode(payload)
+
+	signature, err := signingKey.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + encode(signature), nil
+}
+
+// Verify checks the token was signed by one of the keys, and has not
+// expired, and returns its claims
+func (k *KeySet) Verify(token string) (Claims, error) {
+
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decode(parts[0], &header); err != nil {
+		return claims, ErrMalformed
+	}
+
+	k.RLock()
+	verifyingKey, ok := k.keys[header.Kid]
+	k.RUnlock()
+
+	if !ok {
+		return claims, ErrKeyNotFound
+	}
+
+	if header.Alg != verifyingKey.algorithm { //don't let the token choose
+		return claims, ErrBadSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrMalformed
+	}
+
+	if !verifyingKey.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return claims, ErrBadSignature
+	}
+
+	if err := decode(parts[1], &claims); err != nil {
+		return claims, ErrMalformed
+	}
+
+	if claims.Expires > 0 && time.Now().Unix() >= claims.Expires {
+		return claims, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// JWK is the public half of an ES256 key, as published in a JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// JWKS lists the public keys, for verifying tokens offline
+func (k *KeySet) JWKS() map[string][]JWK {
+
+	jwks := []JWK{}
+
+	k.RLock()
+	defer k.RUnlock()
+
+	for kid, publicKey := range k.keys {
+
+		if publicKey.algorithm != ES256 {
+			continue
+		}
+
+		jwks = append(jwks, JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   encode(pad(publicKey.private.X)),
+			Y:   encode(pad(publicKey.private.Y)),
+			Kid: kid,
+			Use: "sig",
+			Alg: ES256,
+		})
+	}
+
+	return map[string][]JWK{"keys": jwks}
+}
+
+// DefaultLifetime is how long tokens minted from a template that never
+// expires are good for, as a bearer token should not be good forever
+var DefaultLifetime = time.Hour
+
+// Generator mints a token for each Get of a template, with claims taken from
+// the template, the consumer recorded by dr.WithConsumer, and the remaining
+// TTL (or DefaultLifetime). The template's Resource is not used.
+func Generator(keys *KeySet, issuer string) dr.Generator {
+	return generator{keys: keys, issuer: issuer}
+}
+
+type generator struct {
+	keys   *KeySet
+	issuer string
+}
+
+func (g generator) Generate(template dr.Dr) (string, error) {
+	return g.GenerateContext(context.Background(), template)
+}
+
+func (g generator) GenerateContext(ctx context.Context, template dr.Dr) (string, error) {
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	claims := Claims{
+		Issuer:      g.issuer,
+		Subject:     dr.Consumer(ctx),
+		Audience:    template.Category,
+		ID:          encode(nonce),
+		IssuedAt:    time.Now().Unix(),
+		Category:    template.Category,
+		ResourceID:  template.ID,
+		Description: template.Description,
+	}
+
+	claims.Expires = claims.IssuedAt + int64(DefaultLifetime/time.Second)
+
+	if template.TTL > 0 {
+		claims.Expires = claims.IssuedAt + template.TTL
+	}
+
+	return g.keys.Sign(claims)
+}
+
+func (k key) sign(message []byte) ([]byte, error) {
+
+	if k.algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(message)
+		return mac.Sum(nil), nil
+	}
+
+	digest := sha256.Sum256(message)
+
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(pad(r), pad(s)...), nil // JWS wants r||s, not ASN.1
+}
+
+func (k key) verify(message []byte, signature []byte) bool {
+
+	if k.algorithm == HS256 {
+		expected, _ := k.sign(message)
+		return hmac.Equal(signature, expected)
+	}
+
+	if len(signature) != 64 {
+		return false
+	}
+
+	digest := sha256.Sum256(message)
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+
+	return ecdsa.Verify(&k.private.PublicKey, digest[:], r, s)
+}
+
+// pad gives the 32 byte big-endian form of a P-256 integer
+func pad(n *big.Int) []byte {
+	b := make([]byte, 32)
+	return n.FillBytes(b)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
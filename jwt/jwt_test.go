@@ -0,0 +1,201 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/dr"
+)
+
+func TestSignVerifyES256(t *testing.T) {
+
+	keys := NewKeySet()
+
+	if _, err := keys.Sign(Claims{}); err != ErrNoSigningKey {
+		t.Errorf("expected no signing key, got %v", err)
+	}
+
+	if err := keys.Rotate("one"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := keys.Sign(Claims{Category: "a", ResourceID: "b", ID: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := keys.Verify(token)
+	if err != nil || claims.Category != "a" || claims.ResourceID != "b" {
+		t.Errorf("unexpected %v %v", claims, err)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"category":"z"}`)) + "." + parts[2]
+	if _, err := keys.Verify(tampered); err != ErrBadSignature {
+		t.Errorf("tampered token should not verify, got %v", err)
+	}
+
+	if _, err := keys.Verify("a.b"); err != ErrMalformed {
+		t.Errorf("expected malformed, got %v", err)
+	}
+}
+
+func TestHS256(t *testing.T) {
+
+	keys := NewKeySet()
+
+	if err := keys.AddHS256("short", []byte("tooshort")); err != ErrIllegalKey {
+		t.Errorf("short secret should be illegal, got %v", err)
+	}
+
+	if err := keys.AddHS256("hs", []byte(strings.Repeat("s", 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := keys.Sign(Claims{Category: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims, err := keys.Verify(token); err != nil || claims.Category != "a" {
+		t.Errorf("unexpected %v %v", claims, err)
+	}
+
+	if len(keys.JWKS()["keys"]) != 0 {
+		t.Errorf("shared secrets must not be published")
+	}
+}
+
+func TestRotation(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Rotate("old")
+
+	oldToken, _ := keys.Sign(Claims{Category: "a"})
+
+	keys.Rotate("new")
+
+	newToken, _ := keys.Sign(Claims{Category: "a"})
+
+	if !strings.Contains(header(t, newToken), `"kid":"new"`) {
+		t.Errorf("not signing with new key: %s", header(t, newToken))
+	}
+
+	if _, err := keys.Verify(oldToken); err != nil {
+		t.Errorf("old token should verify until its key is retired, got %v", err)
+	}
+
+	if err := keys.Rotate("old"); err != ErrKeyExists {
+		t.Errorf("should not replace an existing key, got %v", err)
+	}
+
+	if err := keys.Retire("new"); err != ErrKeyInUse {
+		t.Errorf("should not retire signing key, got %v", err)
+	}
+
+	if err := keys.Retire("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.Verify(oldToken); err != ErrKeyNotFound {
+		t.Errorf("old token should not verify once retired, got %v", err)
+	}
+
+	if len(keys.JWKS()["keys"]) != 1 {
+		t.Errorf("retired key still published")
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Rotate("ec")
+
+	token, _ := keys.Sign(Claims{Category: "a"})
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"ec"}`)) + "." + parts[1] + "." + parts[2]
+
+	if _, err := keys.Verify(forged); err != ErrBadSignature {
+		t.Errorf("token must not choose its algorithm, got %v", err)
+	}
+}
+
+func TestVerifyOfflineWithJWKS(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Rotate("k1")
+
+	token, _ := keys.Sign(Claims{Category: "a"})
+
+	jwk := keys.JWKS()["keys"][0]
+
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	public := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	parts := strings.Split(token, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+
+	if jwk.Kid != "k1" || !ecdsa.Verify(&public, digest[:], r, s) {
+		t.Errorf("token does not verify against published key %+v", jwk)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Rotate("k1")
+
+	g := Generator(keys, "dr").(dr.ContextGenerator)
+
+	ctx := dr.WithConsumer(context.Background(), "alice")
+	template := dr.Dr{Category: "pendulum", ID: "p1", Description: "Item-p1", TTL: 60}
+
+	token, err := g.GenerateContext(ctx, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := keys.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Issuer != "dr" || claims.Subject != "alice" || claims.Audience != "pendulum" ||
+		claims.ResourceID != "p1" || claims.Description != "Item-p1" ||
+		claims.Expires != claims.IssuedAt+60 || claims.ID == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	again, _ := g.GenerateContext(ctx, template)
+	if again == token {
+		t.Errorf("token repeated")
+	}
+
+	// a template that never expires still mints tokens that do
+	template.TTL = 0
+	token, _ = g.GenerateContext(ctx, template)
+
+	if claims, err := keys.Verify(token); err != nil || claims.Expires != claims.IssuedAt+int64(DefaultLifetime/time.Second) {
+		t.Errorf("wanted DefaultLifetime, got %+v %v", claims, err)
+	}
+}
+
+func header(t *testing.T, token string) string {
+	b, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,291 @@
+// package limit stops any one consumer from draining a category, with quotas
+// on how many single-use resources they take in a period, and token-bucket
+// limits on how fast they make requests. It is enforced by restapi.
+package limit
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/timdrysdale/dr"
+)
+
+var ErrIllegalRule = errors.New("Illegal rule")
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+var ErrRateLimited = errors.New("Rate limited")
+
+// Rule limits each consumer separately, across all the categories it applies
+// to, so that a consumer can't get round it by spreading requests over
+// categories (use a rule for each category to limit them separately). A
+// rule with a Quota lets a consumer take up to Quota single-use resources
+// per Period, and a rule with a Rate lets them make Rate requests a second
+// on average, in bursts of up to Burst. Where several rules apply, all of
+// them must be satisfied.
+type Rule struct {
+	Category string        // category or pattern, e.g. labs/**; "" for all
+	Consumer string        // "" for every consumer
+	Quota    int           // single-use resources per Period
+	Period   time.Duration // e.g. time.Hour
+	Rate     float64       // requests per second
+	Burst    int           // defaults to 1
+}
+
+func (r Rule) legal() bool {
+
+	if r.Category != "" {
+		for _, level := range strings.Split(r.Category, dr.PathSeparator) {
+			if level == "" {
+				return false
+			}
+		}
+	}
+
+	if r.Quota < 0 || r.Rate < 0 || r.Burst < 0 {
+		return false
+	}
+
+	if r.Quota > 0 && r.Period <= 0 {
+		return false
+	}
+
+	return r.Quota > 0 || r.Rate > 0
+}
+
+func (r Rule) applies(consumer string, category string) bool {
+	return (r.Consumer == "" || r.Consumer == consumer) &&
+		(r.Category == "" || dr.MatchCategory(r.Category, category))
+}
+
+// Status reports on the tightest of the rules that applied to a request.
+// Limit is zero if no rule applied.
+type Status struct {
+	Limit     int
+	Remaining int
+	Reset     time.Duration // until Remaining goes back up
+}
+
+type key struct {
+	rule     int
+	consumer string
+}
+
+// pruneInterval is how often windows and buckets that have ended or
+// refilled are forgotten, so that memory isn't held for every consumer
+// that has ever made a request
+const pruneInterval = time.Minute
+
+type window struct {
+	start time.Time
+	taken int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps track of each consumer against the rules. It is safe for
+// concurrent use.
+type Limiter struct {
+	rules   []Rule
+	clock   clockwork.Clock
+	windows map[key]*window
+	buckets map[key]*bucket
+	pruned  time.Time
+	sync.Mutex
+}
+
+func New(rules ...Rule) (*Limiter, error) {
+	return NewWithClock(clockwork.NewRealClock(), rules...)
+}
+
+// NewWithClock is New with a clock that can be faked in tests
+func NewWithClock(clock clockwork.Clock, rules ...Rule) (*Limiter, error) {
+
+	for _, rule := range rules {
+		if !rule.legal() {
+			return nil, ErrIllegalRule
+		}
+	}
+
+	return &Limiter{
+		rules:   append([]Rule{}, rules...),
+		clock:   clock,
+		windows: make(map[key]*window),
+		buckets: make(map[key]*bucket),
+		pruned:  clock.Now(),
+	}, nil
+}
+
+// Allow uses up one request from every rate limit that applies, unless any
+// of them has none left, in which case it returns ErrRateLimited and uses
+// up nothing
+func (l *Limiter) Allow(consumer string, category string) (Status, error) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.clock.Now()
+	l.prune(now)
+
+	var status Status
+	var limited []*bucket
+
+	for i, rule := range l.rules {
+
+		if rule.Rate <= 0 || !rule.applies(consumer, category) {
+			continue
+		}
+
+		burst := float64(rule.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+
+		k := key{i, consumer}
+		b, ok := l.buckets[k]
+		if !ok {
+			b = &bucket{tokens: burst, last: now}
+			l.buckets[k] = b
+		}
+
+		b.tokens += now.Sub(b.last).Seconds() * rule.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+
+		remaining := int(b.tokens) - 1
+		reset := time.Duration((1 - (b.tokens - float64(int(b.tokens)))) / rule.Rate * float64(time.Second))
+
+		status = tightest(status, Status{int(burst), remaining, reset})
+		limited = append(limited, b)
+	}
+
+	if status.Limit > 0 && status.Remaining < 0 {
+		status.Remaining = 0
+		return status, ErrRateLimited
+	}
+
+	for _, b := range limited {
+		b.tokens--
+	}
+
+	return status, nil
+}
+
+// Take uses up one single-use resource from every quota that applies, unless
+// any of them has none left, in which case it returns ErrQuotaExceeded and
+// uses up nothing. Call Take before revealing a resource, so that consumers
+// racing each other can't exceed their quota, and Refund if it turns out no
+// single-use resource was revealed after all.
+func (l *Limiter) Take(consumer string, category string) (Status, error) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune(l.clock.Now())
+
+	var status Status
+	var quotas []*window
+
+	for i, rule := range l.rules {
+
+		if rule.Quota <= 0 || !rule.applies(consumer, category) {
+			continue
+		}
+
+		w := l.window(key{i, consumer}, rule.Period)
+		reset := w.start.Add(rule.Period).Sub(l.clock.Now())
+
+		status = tightest(status, Status{rule.Quota, rule.Quota - w.taken - 1, reset})
+		quotas = append(quotas, w)
+	}
+
+	if status.Limit > 0 && status.Remaining < 0 {
+		status.Remaining = 0
+		return status, ErrQuotaExceeded
+	}
+
+	for _, w := range quotas {
+		w.taken++
+	}
+
+	return status, nil
+}
+
+// Refund gives back what Take used up
+func (l *Limiter) Refund(consumer string, category string) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	for i, rule := range l.rules {
+
+		if rule.Quota <= 0 || !rule.applies(consumer, category) {
+			continue
+		}
+
+		if w := l.window(key{i, consumer}, rule.Period); w.taken > 0 {
+			w.taken--
+		}
+	}
+}
+
+// window returns the current quota period for k, starting a new one if the
+// last has ended. Must be called with the lock held.
+func (l *Limiter) window(k key, period time.Duration) *window {
+
+	now := l.clock.Now()
+
+	w, ok := l.windows[k]
+	if !ok || !now.Before(w.start.Add(period)) {
+		w = &window{start: now}
+		l.windows[k] = w
+	}
+
+	return w
+}
+
+// prune forgets windows that have ended, and buckets that have refilled,
+// as they would start afresh anyway, at most once every pruneInterval.
+// Must be called with the lock held.
+func (l *Limiter) prune(now time.Time) {
+
+	if now.Sub(l.pruned) < pruneInterval {
+		return
+	}
+
+	l.pruned = now
+
+	for k, w := range l.windows {
+		if !now.Before(w.start.Add(l.rules[k.rule].Period)) {
+			delete(l.windows, k)
+		}
+	}
+
+	for k, b := range l.buckets {
+
+		rule := l.rules[k.rule]
+
+		burst := float64(rule.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+
+		if b.tokens+now.Sub(b.last).Seconds()*rule.Rate >= burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// tightest returns whichever of a and b has fewer remaining
+func tightest(a Status, b Status) Status {
+	if a.Limit == 0 || b.Remaining < a.Remaining {
+		return b
+	}
+	return a
+}
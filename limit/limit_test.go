@@ -0,0 +1,148 @@
+package limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestQuota(t *testing.T) {
+
+	clock := clockwork.NewFakeClock()
+	limits, err := NewWithClock(clock, Rule{Category: "labs/**", Quota: 2, Period: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i >= 0; i-- {
+		status, err := limits.Take("alice", "labs/ed")
+		if err != nil || status.Limit != 2 || status.Remaining != i || status.Reset != time.Hour {
+			t.Errorf("unexpected %v %v", status, err)
+		}
+	}
+
+	if status, err := limits.Take("alice", "labs/ed"); err != ErrQuotaExceeded || status.Remaining != 0 {
+		t.Errorf("expected quota exceeded, got %v %v", status, err)
+	}
+
+	// other consumers have their own quota, but other categories the rule
+	// applies to share it
+	if _, err := limits.Take("bob", "labs/ed"); err != nil {
+		t.Errorf("bob should have his own quota, got %v", err)
+	}
+
+	if _, err := limits.Take("alice", "labs/gl"); err != ErrQuotaExceeded {
+		t.Errorf("labs/gl should share the quota, got %v", err)
+	}
+
+	if status, err := limits.Take("alice", "other"); err != nil || status.Limit != 0 {
+		t.Errorf("other should not be limited, got %v %v", status, err)
+	}
+
+	limits.Refund("alice", "labs/ed")
+
+	if _, err := limits.Take("alice", "labs/ed"); err != nil {
+		t.Errorf("refund should give back quota, got %v", err)
+	}
+
+	clock.Advance(time.Hour)
+
+	if status, err := limits.Take("alice", "labs/ed"); err != nil || status.Remaining != 1 {
+		t.Errorf("quota should reset after period, got %v %v", status, err)
+	}
+}
+
+func TestRate(t *testing.T) {
+
+	clock := clockwork.NewFakeClock()
+	limits, err := NewWithClock(clock, Rule{Rate: 2, Burst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 2; i >= 0; i-- {
+		status, err := limits.Allow("alice", "c")
+		if err != nil || status.Limit != 3 || status.Remaining != i {
+			t.Errorf("unexpected %v %v", status, err)
+		}
+	}
+
+	status, err := limits.Allow("alice", "c")
+	if err != ErrRateLimited || status.Reset != 500*time.Millisecond {
+		t.Errorf("expected rate limited, got %v %v", status, err)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+
+	if _, err := limits.Allow("alice", "c"); err != nil {
+		t.Errorf("bucket should have refilled, got %v", err)
+	}
+
+	if _, err := limits.Allow("bob", "c"); err != nil {
+		t.Errorf("bob should have his own bucket, got %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+
+	limits, err := New(
+		Rule{Quota: 5, Period: time.Hour},
+		Rule{Consumer: "alice", Quota: 1, Period: time.Minute},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tightest rule is reported, and all must be satisfied
+	if status, err := limits.Take("alice", "c"); err != nil || status.Limit != 1 || status.Remaining != 0 {
+		t.Errorf("unexpected %v %v", status, err)
+	}
+
+	if _, err := limits.Take("alice", "c"); err != ErrQuotaExceeded {
+		t.Errorf("expected quota exceeded, got %v", err)
+	}
+
+	if status, err := limits.Take("bob", "c"); err != nil || status.Limit != 5 {
+		t.Errorf("unexpected %v %v", status, err)
+	}
+
+	for _, rule := range []Rule{
+		{},
+		{Quota: 1},
+		{Rate: -1},
+		{Category: "labs//ed", Rate: 1},
+	} {
+		if _, err := New(rule); err != ErrIllegalRule {
+			t.Errorf("%v should be illegal, got %v", rule, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+
+	clock := clockwork.NewFakeClock()
+	limits, err := NewWithClock(clock,
+		Rule{Quota: 1, Period: time.Second},
+		Rule{Rate: 1, Burst: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, consumer := range []string{"alice", "bob", "carol"} {
+		limits.Take(consumer, "c")
+		limits.Allow(consumer, "c")
+	}
+
+	if len(limits.windows) != 3 || len(limits.buckets) != 3 {
+		t.Errorf("unexpected %d windows, %d buckets", len(limits.windows), len(limits.buckets))
+	}
+
+	clock.Advance(pruneInterval)
+	limits.Allow("alice", "c")
+
+	if len(limits.windows) != 0 || len(limits.buckets) != 1 {
+		t.Errorf("ended windows and refilled buckets should be forgotten, still have %d windows, %d buckets", len(limits.windows), len(limits.buckets))
+	}
+}
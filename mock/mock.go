@@ -2,26 +2,60 @@
 package mock
 
 import (
+	"context"
+	"sync"
+
 	"github.com/timdrysdale/dr"
 )
 
 type In struct {
-	Category string
-	ID       string
-	Resource dr.Dr
+	BatchMode   dr.BatchMode
+	Category    string
+	Generator   dr.Generator
+	GracePeriod int64
+	ID          string
+	IDs         []string
+	ListOptions dr.ListOptions
+	Pattern     string
+	Policy      dr.Policy
+	Resource    dr.Dr
+	Resources   []dr.Dr
+	Schema      string
+	Selector    dr.Selector
+	Tenant      string
 }
 
 type Out struct {
-	Error      error
-	Categories map[string]int
-	Resource   dr.Dr
-	List       map[string]dr.Dr
+	Error       error
+	Categories  map[string]int
+	Export      []dr.Dr
+	GracePeriod int64
+	Resource    dr.Dr
+	List        map[string]dr.Dr
+	Lists       map[string]map[string]dr.Dr
+	Page        dr.Page
+	Policies    map[string]dr.Policy
+	Policy      dr.Policy
+	Results     []dr.BatchResult
+	Schema      string
+	Schemas     map[string]string
+	Tenants     []string
 }
 
+// MockStorage is safe for concurrent use, so it can back handlers that are
+// tested in parallel. Args are best read with the Get methods for the same
+// reason, and the call counts can only be read with GetMethod.
 type MockStorage struct {
 	Args    In
 	Returns Out
-	Method  map[string]int
+
+	method       map[string]int // calls, by method
+	calls        []Call
+	expectations []*Expectation
+	queues       map[string][][]interface{}
+	callbacks    map[string]func(args []interface{}) []interface{}
+	unexpected   []Call
+	sync.Mutex
 }
 
 // instantiation
@@ -33,93 +67,741 @@ func New() *MockStorage {
 // mock methods for setting return values
 
 func (m *MockStorage) SetCategories(c map[string]int) {
+	m.Lock()
+	defer m.Unlock()
+
 	m.Returns.Categories = c
 }
 
+func (m *MockStorage) SetExport(e []dr.Dr) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Export = e
+}
+
 func (m *MockStorage) SetList(l map[string]dr.Dr) {
+	m.Lock()
+	defer m.Unlock()
+
 	m.Returns.List = l
 }
 
+// SetGracePeriodReturn sets what GracePeriod returns (SetGracePeriod is the interface method)
+func (m *MockStorage) SetGracePeriodReturn(seconds int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.GracePeriod = seconds
+}
+
+func (m *MockStorage) SetLists(l map[string]map[string]dr.Dr) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Lists = l
+}
+
+func (m *MockStorage) SetPage(p dr.Page) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Page = p
+}
+
+// SetResults sets the per-item results of a batch; if left unset, every item
+// in a batch gets whatever error is set with SetError
+func (m *MockStorage) SetResults(r []dr.BatchResult) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Results = r
+}
+
+func (m *MockStorage) SetPolicies(p map[string]dr.Policy) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Policies = p
+}
+
+// SetPolicyReturn sets what GetPolicy returns (SetPolicy is the interface method)
+func (m *MockStorage) SetPolicyReturn(p dr.Policy) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Policy = p
+}
+
+// SetSchemaReturn sets what GetSchema returns (SetSchema is the interface method)
+func (m *MockStorage) SetSchemaReturn(s string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Schema = s
+}
+
+func (m *MockStorage) SetSchemas(s map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Schemas = s
+}
+
+func (m *MockStorage) SetTenants(t []string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Returns.Tenants = t
+}
+
 func (m *MockStorage) SetError(err error) {
+	m.Lock()
+	defer m.Unlock()
+
 	m.Returns.Error = err
 }
 
 func (m *MockStorage) SetResource(r dr.Dr) {
+	m.Lock()
+	defer m.Unlock()
+
 	m.Returns.Resource = r
 }
 
 // mock methods for getting arguments supplied
 func (m *MockStorage) GetAdd() dr.Dr {
+	m.Lock()
+	defer m.Unlock()
+
 	return m.Args.Resource
 }
 
+func (m *MockStorage) GetBatchMode() dr.BatchMode {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.BatchMode
+}
+
 func (m *MockStorage) GetCategory() string {
+	m.Lock()
+	defer m.Unlock()
+
 	return m.Args.Category
 }
 
+func (m *MockStorage) GetGenerator() dr.Generator {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Generator
+}
+
+func (m *MockStorage) GetGracePeriodArg() int64 {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.GracePeriod
+}
+
 func (m *MockStorage) GetID() string {
+	m.Lock()
+	defer m.Unlock()
+
 	return m.Args.ID
 }
 
+func (m *MockStorage) GetIDs() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.IDs
+}
+
+func (m *MockStorage) GetListOptions() dr.ListOptions {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.ListOptions
+}
+
+func (m *MockStorage) GetSchemaArg() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Schema
+}
+
+func (m *MockStorage) GetPattern() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Pattern
+}
+
+func (m *MockStorage) GetSelector() dr.Selector {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Selector
+}
+
+func (m *MockStorage) GetTenant() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Tenant
+}
+
+// GetMethod returns a copy of the call counts, which is safe to read while
+// the mock is still in use
 func (m *MockStorage) GetMethod() map[string]int {
-	return m.Method
+	m.Lock()
+	defer m.Unlock()
+
+	method := make(map[string]int)
+	for k, v := range m.method {
+		method[k] = v
+	}
+	return method
+}
+
+func (m *MockStorage) GetPolicyArg() dr.Policy {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Policy
 }
 
 func (m *MockStorage) GetResource() dr.Dr {
+	m.Lock()
+	defer m.Unlock()
+
 	return m.Args.Resource
 }
 
-// method for updating call record
+func (m *MockStorage) GetResources() []dr.Dr {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.Args.Resources
+}
+
+// method for updating call record, which must be called with the lock held
 
 func (m *MockStorage) logMethod(method string) {
-	if m.Method == nil {
-		m.Method = make(map[string]int)
+	if m.method == nil {
+		m.method = make(map[string]int)
 	}
-	if _, ok := m.Method[method]; ok {
-		m.Method[method] += 1
+	if _, ok := m.method[method]; ok {
+		m.method[method] += 1
 	} else {
-		m.Method[method] = 1
+		m.method[method] = 1
 	}
 }
 
-// interface methods
+// interface methods, which return what is programmed with Expect, Queue or
+// On, or else what is set with the Set methods above
+
 func (m *MockStorage) Add(resource dr.Dr) error {
-	m.logMethod("Add")
-	m.Args.Resource = resource
-	return m.Returns.Error
+	r := m.call("Add", []interface{}{resource}, func() []interface{} {
+		m.Args.Resource = resource
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("Add", r, &err)
+	return err
+}
+
+func (m *MockStorage) AddBatch(resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	r := m.call("AddBatch", []interface{}{resources, mode}, func() []interface{} {
+		m.Args.Resources = resources
+		m.Args.BatchMode = mode
+		results := m.Returns.Results
+		if results == nil {
+			for _, resource := range resources {
+				results = append(results, dr.BatchResult{Category: resource.Category, ID: resource.ID, Err: m.Returns.Error})
+			}
+		}
+		return []interface{}{results, m.Returns.Error}
+	})
+	var results []dr.BatchResult
+	var err error
+	m.unpack("AddBatch", r, &results, &err)
+	return results, err
+}
+
+func (m *MockStorage) AddGenerated(resource dr.Dr) (dr.Dr, error) {
+	r := m.call("AddGenerated", []interface{}{resource}, func() []interface{} {
+		m.Args.Resource = resource
+		return []interface{}{m.Returns.Resource, m.Returns.Error}
+	})
+	var added dr.Dr
+	var err error
+	m.unpack("AddGenerated", r, &added, &err)
+	return added, err
 }
 
 func (m *MockStorage) Categories() (map[string]int, error) {
-	m.logMethod("Categories")
-	return m.Returns.Categories, m.Returns.Error
+	r := m.call("Categories", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Categories, m.Returns.Error}
+	})
+	var categories map[string]int
+	var err error
+	m.unpack("Categories", r, &categories, &err)
+	return categories, err
+}
+
+func (m *MockStorage) CategoriesMatching(pattern string) (map[string]int, error) {
+	r := m.call("CategoriesMatching", []interface{}{pattern}, func() []interface{} {
+		m.Args.Pattern = pattern
+		return []interface{}{m.Returns.Categories, m.Returns.Error}
+	})
+	var categories map[string]int
+	var err error
+	m.unpack("CategoriesMatching", r, &categories, &err)
+	return categories, err
+}
+
+func (m *MockStorage) CategoriesSelected(selector dr.Selector) (map[string]int, error) {
+	r := m.call("CategoriesSelected", []interface{}{selector}, func() []interface{} {
+		m.Args.Selector = selector
+		return []interface{}{m.Returns.Categories, m.Returns.Error}
+	})
+	var categories map[string]int
+	var err error
+	m.unpack("CategoriesSelected", r, &categories, &err)
+	return categories, err
 }
 
 func (m *MockStorage) Delete(category string, id string) (dr.Dr, error) {
-	m.logMethod("Delete")
-	m.Args.Category = category
-	m.Args.ID = id
-	return m.Returns.Resource, m.Returns.Error
+	r := m.call("Delete", []interface{}{category, id}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.ID = id
+		return []interface{}{m.Returns.Resource, m.Returns.Error}
+	})
+	var resource dr.Dr
+	var err error
+	m.unpack("Delete", r, &resource, &err)
+	return resource, err
+}
+
+func (m *MockStorage) DeleteBatch(category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	r := m.call("DeleteBatch", []interface{}{category, ids, mode}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.IDs = ids
+		m.Args.BatchMode = mode
+		results := m.Returns.Results
+		if results == nil {
+			for _, id := range ids {
+				results = append(results, dr.BatchResult{Category: category, ID: id, Err: m.Returns.Error})
+			}
+		}
+		return []interface{}{results, m.Returns.Error}
+	})
+	var results []dr.BatchResult
+	var err error
+	m.unpack("DeleteBatch", r, &results, &err)
+	return results, err
+}
+
+// Export calls each with the resources set by SetExport, unless it fails
+func (m *MockStorage) Export(each func(dr.Dr) error) error {
+	var export []dr.Dr
+	r := m.call("Export", []interface{}{}, func() []interface{} {
+		export = m.Returns.Export
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("Export", r, &err)
+	if err != nil {
+		return err
+	}
+	for _, resource := range export {
+		if err := each(resource); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *MockStorage) Get(category string, id string) (dr.Dr, error) {
-	m.logMethod("Get")
-	m.Args.Category = category
-	m.Args.ID = id
-	return m.Returns.Resource, m.Returns.Error
+	r := m.call("Get", []interface{}{category, id}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.ID = id
+		return []interface{}{m.Returns.Resource, m.Returns.Error}
+	})
+	var resource dr.Dr
+	var err error
+	m.unpack("Get", r, &resource, &err)
+	return resource, err
 }
 
 func (m *MockStorage) HealthCheck() error {
-	m.logMethod("HealthCheck")
-	return m.Returns.Error
+	r := m.call("HealthCheck", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("HealthCheck", r, &err)
+	return err
 }
 
 func (m *MockStorage) List(category string) (map[string]dr.Dr, error) {
-	m.logMethod("List")
-	m.Args.Category = category
-	return m.Returns.List, m.Returns.Error
+	r := m.call("List", []interface{}{category}, func() []interface{} {
+		m.Args.Category = category
+		return []interface{}{m.Returns.List, m.Returns.Error}
+	})
+	var list map[string]dr.Dr
+	var err error
+	m.unpack("List", r, &list, &err)
+	return list, err
+}
+
+func (m *MockStorage) ListMatching(pattern string) (map[string]map[string]dr.Dr, error) {
+	r := m.call("ListMatching", []interface{}{pattern}, func() []interface{} {
+		m.Args.Pattern = pattern
+		return []interface{}{m.Returns.Lists, m.Returns.Error}
+	})
+	var lists map[string]map[string]dr.Dr
+	var err error
+	m.unpack("ListMatching", r, &lists, &err)
+	return lists, err
+}
+
+func (m *MockStorage) ListPage(category string, options dr.ListOptions) (dr.Page, error) {
+	r := m.call("ListPage", []interface{}{category, options}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.ListOptions = options
+		return []interface{}{m.Returns.Page, m.Returns.Error}
+	})
+	var page dr.Page
+	var err error
+	m.unpack("ListPage", r, &page, &err)
+	return page, err
+}
+
+func (m *MockStorage) ListSelected(category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	r := m.call("ListSelected", []interface{}{category, selector}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.Selector = selector
+		return []interface{}{m.Returns.List, m.Returns.Error}
+	})
+	var list map[string]dr.Dr
+	var err error
+	m.unpack("ListSelected", r, &list, &err)
+	return list, err
 }
 
 func (m *MockStorage) Reset() error {
-	m.logMethod("Reset")
-	return m.Returns.Error
+	r := m.call("Reset", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("Reset", r, &err)
+	return err
+}
+
+func (m *MockStorage) Search(selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	r := m.call("Search", []interface{}{selector}, func() []interface{} {
+		m.Args.Selector = selector
+		return []interface{}{m.Returns.Lists, m.Returns.Error}
+	})
+	var lists map[string]map[string]dr.Dr
+	var err error
+	m.unpack("Search", r, &lists, &err)
+	return lists, err
+}
+
+// policy methods
+
+func (m *MockStorage) DeletePolicy(category string) error {
+	r := m.call("DeletePolicy", []interface{}{category}, func() []interface{} {
+		m.Args.Category = category
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("DeletePolicy", r, &err)
+	return err
+}
+
+func (m *MockStorage) GetPolicy(category string) (dr.Policy, error) {
+	r := m.call("GetPolicy", []interface{}{category}, func() []interface{} {
+		m.Args.Category = category
+		return []interface{}{m.Returns.Policy, m.Returns.Error}
+	})
+	var policy dr.Policy
+	var err error
+	m.unpack("GetPolicy", r, &policy, &err)
+	return policy, err
+}
+
+func (m *MockStorage) Policies() (map[string]dr.Policy, error) {
+	r := m.call("Policies", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Policies, m.Returns.Error}
+	})
+	var policies map[string]dr.Policy
+	var err error
+	m.unpack("Policies", r, &policies, &err)
+	return policies, err
+}
+
+func (m *MockStorage) SetPolicy(category string, policy dr.Policy) error {
+	r := m.call("SetPolicy", []interface{}{category, policy}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.Policy = policy
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("SetPolicy", r, &err)
+	return err
+}
+
+// template methods
+
+func (m *MockStorage) AddTemplate(template dr.Dr, generator dr.Generator) error {
+	r := m.call("AddTemplate", []interface{}{template, generator}, func() []interface{} {
+		m.Args.Resource = template
+		m.Args.Generator = generator
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("AddTemplate", r, &err)
+	return err
+}
+
+// schema methods
+
+func (m *MockStorage) DeleteSchema(category string) error {
+	r := m.call("DeleteSchema", []interface{}{category}, func() []interface{} {
+		m.Args.Category = category
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("DeleteSchema", r, &err)
+	return err
+}
+
+func (m *MockStorage) GetSchema(category string) (string, error) {
+	r := m.call("GetSchema", []interface{}{category}, func() []interface{} {
+		m.Args.Category = category
+		return []interface{}{m.Returns.Schema, m.Returns.Error}
+	})
+	var schema string
+	var err error
+	m.unpack("GetSchema", r, &schema, &err)
+	return schema, err
+}
+
+func (m *MockStorage) Schemas() (map[string]string, error) {
+	r := m.call("Schemas", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Schemas, m.Returns.Error}
+	})
+	var schemas map[string]string
+	var err error
+	m.unpack("Schemas", r, &schemas, &err)
+	return schemas, err
+}
+
+func (m *MockStorage) SetSchema(category string, schema string) error {
+	r := m.call("SetSchema", []interface{}{category, schema}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.Schema = schema
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("SetSchema", r, &err)
+	return err
+}
+
+// trash methods
+
+func (m *MockStorage) GracePeriod() (int64, error) {
+	r := m.call("GracePeriod", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.GracePeriod, m.Returns.Error}
+	})
+	var seconds int64
+	var err error
+	m.unpack("GracePeriod", r, &seconds, &err)
+	return seconds, err
+}
+
+// Restore returns whatever is set with SetResource
+func (m *MockStorage) Restore(category string, id string) (dr.Dr, error) {
+	r := m.call("Restore", []interface{}{category, id}, func() []interface{} {
+		m.Args.Category = category
+		m.Args.ID = id
+		return []interface{}{m.Returns.Resource, m.Returns.Error}
+	})
+	var resource dr.Dr
+	var err error
+	m.unpack("Restore", r, &resource, &err)
+	return resource, err
+}
+
+func (m *MockStorage) SetGracePeriod(seconds int64) error {
+	r := m.call("SetGracePeriod", []interface{}{seconds}, func() []interface{} {
+		m.Args.GracePeriod = seconds
+		return []interface{}{m.Returns.Error}
+	})
+	var err error
+	m.unpack("SetGracePeriod", r, &err)
+	return err
+}
+
+// Trash returns whatever is set with SetLists
+func (m *MockStorage) Trash() (map[string]map[string]dr.Dr, error) {
+	r := m.call("Trash", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Lists, m.Returns.Error}
+	})
+	var lists map[string]map[string]dr.Dr
+	var err error
+	m.unpack("Trash", r, &lists, &err)
+	return lists, err
+}
+
+// tenant methods
+
+// Tenant returns the mock itself, so calls on a tenant are recorded too
+func (m *MockStorage) Tenant(name string) (dr.Storage, error) {
+	r := m.call("Tenant", []interface{}{name}, func() []interface{} {
+		m.Args.Tenant = name
+		return []interface{}{m, m.Returns.Error}
+	})
+	var tenant dr.Storage
+	var err error
+	m.unpack("Tenant", r, &tenant, &err)
+	return tenant, err
+}
+
+func (m *MockStorage) Tenants() ([]string, error) {
+	r := m.call("Tenants", []interface{}{}, func() []interface{} {
+		return []interface{}{m.Returns.Tenants, m.Returns.Error}
+	})
+	var tenants []string
+	var err error
+	m.unpack("Tenants", r, &tenants, &err)
+	return tenants, err
+}
+
+// context-aware interface methods refuse to call through once ctx is done,
+// otherwise they behave (and are logged) as the methods above
+
+func (m *MockStorage) AddContext(ctx context.Context, resource dr.Dr) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Add(resource)
+}
+
+func (m *MockStorage) AddBatchContext(ctx context.Context, resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return []dr.BatchResult{}, err
+	}
+	return m.AddBatch(resources, mode)
+}
+
+func (m *MockStorage) AddGeneratedContext(ctx context.Context, resource dr.Dr) (dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return dr.Dr{}, err
+	}
+	return m.AddGenerated(resource)
+}
+
+func (m *MockStorage) CategoriesContext(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return m.Categories()
+}
+
+func (m *MockStorage) CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return m.CategoriesMatching(pattern)
+}
+
+func (m *MockStorage) CategoriesSelectedContext(ctx context.Context, selector dr.Selector) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]int{}, err
+	}
+	return m.CategoriesSelected(selector)
+}
+
+func (m *MockStorage) DeleteContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return dr.Dr{}, err
+	}
+	return m.Delete(category, id)
+}
+
+func (m *MockStorage) DeleteBatchContext(ctx context.Context, category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return []dr.BatchResult{}, err
+	}
+	return m.DeleteBatch(category, ids, mode)
+}
+
+func (m *MockStorage) ExportContext(ctx context.Context, each func(dr.Dr) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Export(each)
+}
+
+func (m *MockStorage) GetContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return dr.Dr{}, err
+	}
+	return m.Get(category, id)
+}
+
+func (m *MockStorage) HealthCheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.HealthCheck()
+}
+
+func (m *MockStorage) ListContext(ctx context.Context, category string) (map[string]dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]dr.Dr{}, err
+	}
+	return m.List(category)
+}
+
+func (m *MockStorage) ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]map[string]dr.Dr{}, err
+	}
+	return m.ListMatching(pattern)
+}
+
+func (m *MockStorage) ListPageContext(ctx context.Context, category string, options dr.ListOptions) (dr.Page, error) {
+	if err := ctx.Err(); err != nil {
+		return dr.Page{Resources: []dr.Dr{}}, err
+	}
+	return m.ListPage(category, options)
+}
+
+func (m *MockStorage) ListSelectedContext(ctx context.Context, category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]dr.Dr{}, err
+	}
+	return m.ListSelected(category, selector)
+}
+
+func (m *MockStorage) ResetContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Reset()
+}
+
+func (m *MockStorage) SearchContext(ctx context.Context, selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	if err := ctx.Err(); err != nil {
+		return map[string]map[string]dr.Dr{}, err
+	}
+	return m.Search(selector)
 }
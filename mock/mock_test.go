@@ -0,0 +1,176 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+var errTest = errors.New("test")
+
+func TestSetDefaults(t *testing.T) {
+
+	m := New()
+	expected := dr.Dr{Category: "a", ID: "b"}
+	m.SetResource(expected)
+
+	resource, err := m.Get("a", "b")
+
+	if err != nil || !reflect.DeepEqual(resource, expected) {
+		t.Errorf("got %v %v", resource, err)
+	}
+	if m.GetCategory() != "a" || m.GetID() != "b" || m.GetMethod()["Get"] != 1 {
+		t.Errorf("arguments or method not recorded")
+	}
+}
+
+func TestQueue(t *testing.T) {
+
+	m := New()
+	m.SetError(errTest)
+	m.Queue("Get", dr.Dr{ID: "first"}, nil)
+	m.Queue("Get", dr.Dr{ID: "second"}, nil)
+
+	for _, id := range []string{"first", "second"} {
+		if resource, err := m.Get("a", "b"); err != nil || resource.ID != id {
+			t.Errorf("wanted %s, got %v %v", id, resource, err)
+		}
+	}
+
+	// queue is used up, so back to the default
+	if _, err := m.Get("a", "b"); err != errTest {
+		t.Errorf("wanted default error, got %v", err)
+	}
+
+	// too few results are filled in from the defaults
+	m.Queue("Delete", dr.Dr{ID: "short"})
+	if resource, err := m.Delete("a", "b"); err != errTest || resource.ID != "short" {
+		t.Errorf("got %v %v", resource, err)
+	}
+}
+
+func TestOn(t *testing.T) {
+
+	m := New()
+
+	m.On("Get", func(args []interface{}) []interface{} {
+		// callbacks can call the mock
+		if err := m.HealthCheck(); err != nil {
+			return []interface{}{dr.Dr{}, err}
+		}
+		return []interface{}{dr.Dr{Category: args[0].(string), ID: args[1].(string)}, nil}
+	})
+
+	resource, err := m.Get("a", "b")
+
+	if err != nil || resource.Category != "a" || resource.ID != "b" {
+		t.Errorf("got %v %v", resource, err)
+	}
+}
+
+func TestExpect(t *testing.T) {
+
+	m := New()
+	m.ExpectGet("a", "b").Return(dr.Dr{ID: "b"}, nil)
+	m.ExpectDelete("a", Any).Return(dr.Dr{}, errTest).Times(2)
+
+	if resource, err := m.Get("a", "b"); err != nil || resource.ID != "b" {
+		t.Errorf("got %v %v", resource, err)
+	}
+	if _, err := m.Delete("a", "x"); err != errTest {
+		t.Errorf("wanted test error, got %v", err)
+	}
+	if _, err := m.Delete("a", "y"); err != errTest {
+		t.Errorf("wanted test error, got %v", err)
+	}
+
+	r := &recorder{}
+	if !m.AssertExpectations(r) || len(r.errors) != 0 {
+		t.Errorf("expectations should be met, got %v", r.errors)
+	}
+
+	// one too many, and one missing
+	m.Delete("a", "z")
+	m.ExpectList("a")
+
+	r = &recorder{}
+	if m.AssertExpectations(r) || len(r.errors) != 2 {
+		t.Errorf("wanted two failures, got %v", r.errors)
+	}
+}
+
+func TestReturnWrongType(t *testing.T) {
+
+	m := New()
+	m.ExpectGet("a", "b").Return(&dr.Dr{ID: "b"}, nil)
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "Get returns dr.Dr") {
+			t.Errorf("wanted panic naming the method and type, got %v", r)
+		}
+	}()
+
+	m.Get("a", "b")
+}
+
+func TestCalls(t *testing.T) {
+
+	m := New()
+	m.SetError(errTest)
+	m.Add(dr.Dr{ID: "a"})
+	m.HealthCheck()
+
+	calls := m.Calls()
+
+	expected := []Call{
+		{Method: "Add", Args: []interface{}{dr.Dr{ID: "a"}}, Results: []interface{}{errTest}},
+		{Method: "HealthCheck", Args: []interface{}{}, Results: []interface{}{errTest}},
+	}
+
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("got %v", calls)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+
+	m := New()
+	m.ExpectGet(Any, Any).Times(0)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.SetResource(dr.Dr{ID: fmt.Sprint(i)})
+				m.Get("a", fmt.Sprint(j))
+				m.Add(dr.Dr{})
+				m.GetID()
+				m.GetMethod()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(m.Calls()) != 2000 || m.GetMethod()["Get"] != 1000 {
+		t.Errorf("wanted 2000 calls, got %d", len(m.Calls()))
+	}
+}
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Helper() {}
@@ -0,0 +1,283 @@
+package mock
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Any matches any argument in an expectation
+var Any = anything{}
+
+type anything struct{}
+
+func (anything) String() string { return "Any" }
+
+// Call is one call made to the mock, with what it returned
+type Call struct {
+	Method  string
+	Args    []interface{}
+	Results []interface{}
+}
+
+func (c Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = fmt.Sprintf("%v", arg)
+	}
+	return c.Method + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Expectation is a call the mock expects, and what to return for it. Unless
+// Times says otherwise, it is expected exactly once.
+type Expectation struct {
+	m       *MockStorage
+	method  string
+	args    []interface{}
+	results []interface{}
+	times   int
+	calls   int
+}
+
+// Return sets what the expected call returns, in the same order as the
+// method it is expected on, e.g. ExpectGet("a", "b").Return(resource, nil).
+// Without it, the call returns whatever is set with the Set methods.
+func (e *Expectation) Return(results ...interface{}) *Expectation {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.results = results
+	return e
+}
+
+// Times sets how many times the call is expected; zero for any number
+func (e *Expectation) Times(n int) *Expectation {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.times = n
+	return e
+}
+
+func (e *Expectation) matches(method string, args []interface{}) bool {
+
+	if e.method != method || len(e.args) != len(args) {
+		return false
+	}
+
+	if e.times > 0 && e.calls >= e.times {
+		return false
+	}
+
+	for i, arg := range e.args {
+		if arg != Any && !reflect.DeepEqual(arg, args[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *Expectation) String() string {
+	return Call{Method: e.method, Args: e.args}.String()
+}
+
+// Expect expects a call to method with args, which are compared with
+// reflect.DeepEqual, or else match anything if they are Any
+func (m *MockStorage) Expect(method string, args ...interface{}) *Expectation {
+	m.Lock()
+	defer m.Unlock()
+
+	e := &Expectation{m: m, method: method, args: args, times: 1}
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+func (m *MockStorage) ExpectAdd(resource interface{}) *Expectation {
+	return m.Expect("Add", resource)
+}
+
+func (m *MockStorage) ExpectCategories() *Expectation {
+	return m.Expect("Categories")
+}
+
+func (m *MockStorage) ExpectDelete(category interface{}, id interface{}) *Expectation {
+	return m.Expect("Delete", category, id)
+}
+
+func (m *MockStorage) ExpectGet(category interface{}, id interface{}) *Expectation {
+	return m.Expect("Get", category, id)
+}
+
+func (m *MockStorage) ExpectHealthCheck() *Expectation {
+	return m.Expect("HealthCheck")
+}
+
+func (m *MockStorage) ExpectList(category interface{}) *Expectation {
+	return m.Expect("List", category)
+}
+
+func (m *MockStorage) ExpectReset() *Expectation {
+	return m.Expect("Reset")
+}
+
+// Queue adds a response to method's queue, which are returned one per call,
+// in order, before falling back to callbacks and the Set methods
+func (m *MockStorage) Queue(method string, results ...interface{}) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.queues == nil {
+		m.queues = make(map[string][][]interface{})
+	}
+	m.queues[method] = append(m.queues[method], results)
+}
+
+// On answers every call to method with f, given the call's arguments, once
+// there are no expectations or queued responses for it. f is called without
+// the mock locked, so it can call the mock itself.
+func (m *MockStorage) On(method string, f func(args []interface{}) []interface{}) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.callbacks == nil {
+		m.callbacks = make(map[string]func(args []interface{}) []interface{})
+	}
+	m.callbacks[method] = f
+}
+
+// Calls returns every call made so far, in order
+func (m *MockStorage) Calls() []Call {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]Call{}, m.calls...)
+}
+
+// TestingT is the part of *testing.T that AssertExpectations needs
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+	Helper()
+}
+
+// AssertExpectations fails t for each expected call that was not made often
+// enough, and each call made to a method with expectations that none matched
+func (m *MockStorage) AssertExpectations(t TestingT) bool {
+	t.Helper()
+
+	m.Lock()
+	defer m.Unlock()
+
+	ok := true
+
+	for _, e := range m.expectations {
+		if e.times > 0 && e.calls < e.times {
+			t.Errorf("mock: expected %v %d time(s), got %d", e, e.times, e.calls)
+			ok = false
+		}
+	}
+
+	for _, c := range m.unexpected {
+		t.Errorf("mock: unexpected call %v", c)
+		ok = false
+	}
+
+	return ok
+}
+
+// call logs a call to method, and returns what it was programmed to return,
+// or else what defaults returns. defaults is called with the lock held, so
+// it can record the arguments in Args, and read Returns.
+func (m *MockStorage) call(method string, args []interface{}, defaults func() []interface{}) []interface{} {
+
+	m.Lock()
+
+	m.logMethod(method)
+	results := defaults()
+
+	expected := false
+	var match *Expectation
+
+	for _, e := range m.expectations {
+		if e.method != method {
+			continue
+		}
+		expected = true
+		if e.matches(method, args) {
+			match = e
+			break
+		}
+	}
+
+	var callback func(args []interface{}) []interface{}
+
+	switch {
+	case match != nil:
+		match.calls++
+		if match.results != nil {
+			results = fill(match.results, results)
+		}
+	case len(m.queues[method]) > 0:
+		results = fill(m.queues[method][0], results)
+		m.queues[method] = m.queues[method][1:]
+	default:
+		if expected {
+			m.unexpected = append(m.unexpected, Call{Method: method, Args: args})
+		}
+		callback = m.callbacks[method]
+	}
+
+	// log the call in the order it was made, even if a callback is slow
+	n := len(m.calls)
+	m.calls = append(m.calls, Call{Method: method, Args: args, Results: results})
+
+	m.Unlock()
+
+	if callback == nil {
+		return results
+	}
+
+	results = fill(callback(args), results)
+
+	m.Lock()
+	m.calls[n].Results = results
+	m.Unlock()
+
+	return results
+}
+
+// fill returns results, padded out with defaults if there are too few
+func fill(results []interface{}, defaults []interface{}) []interface{} {
+
+	filled := append([]interface{}{}, defaults...)
+
+	for i := range filled {
+		if i < len(results) {
+			filled[i] = results[i]
+		}
+	}
+
+	return filled
+}
+
+// unpack stores the results of a call in the variables pointed to, in
+// order, panicking if one that is programmed has the wrong type, rather
+// than returning the zero value as if the call had succeeded
+func (m *MockStorage) unpack(method string, results []interface{}, into ...interface{}) {
+
+	for i, pointer := range into {
+
+		if i >= len(results) || results[i] == nil {
+			continue
+		}
+
+		value := reflect.ValueOf(results[i])
+		target := reflect.ValueOf(pointer).Elem()
+
+		if !value.Type().AssignableTo(target.Type()) {
+			panic(fmt.Sprintf("mock: %s returns %s as result %d, not %T", method, target.Type(), i, results[i]))
+		}
+
+		target.Set(value)
+	}
+}
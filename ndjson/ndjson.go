@@ -0,0 +1,103 @@
+// package ndjson dumps and loads a whole store as newline-delimited JSON,
+// one dr.Dr per line, for migrating between backends or pre-seeding a server
+package ndjson
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/timdrysdale/dr"
+)
+
+// BatchSize is how many resources are added at a time by a best-effort Read
+var BatchSize = 1000
+
+// Write streams every resource in store to w, including secrets and
+// remaining TTL, and returns how many were written
+func Write(ctx context.Context, w io.Writer, store dr.ContextStorage) (int, error) {
+
+	count := 0
+	encoder := json.NewEncoder(w) // Encode adds the newline
+
+	err := store.ExportContext(ctx, func(resource dr.Dr) error {
+		if err := encoder.Encode(resource); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// Read adds the resources in a document written by Write to store (with
+// ImportContext, if it is a dr.Importer), and returns how many were added,
+// along with the results for any that failed. In dr.AllOrNothing mode the
+// whole document is read before any of it is added. In dr.BestEffort mode
+// it is added BatchSize resources at a time, so arbitrarily large documents
+// can be loaded.
+func Read(ctx context.Context, r io.Reader, store dr.ContextStorage, mode dr.BatchMode) (int, []dr.BatchResult, error) {
+
+	added := 0
+	failed := []dr.BatchResult{}
+	batch := []dr.Dr{}
+
+	add := store.AddBatchContext
+	if importer, ok := store.(dr.Importer); ok {
+		add = importer.ImportContext
+	}
+
+	flush := func() error {
+		results, err := add(ctx, batch, mode)
+		if err != nil && err != dr.ErrBatchFailed {
+			return err
+		}
+		for _, result := range results {
+			if result.Err == nil {
+				added++
+			} else {
+				failed = append(failed, result)
+			}
+		}
+		batch = []dr.Dr{}
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) //allow for large resources
+
+	for scanner.Scan() {
+
+		if len(scanner.Bytes()) == 0 {
+			continue //tolerate blank lines, e.g. at the end
+		}
+
+		var resource dr.Dr
+
+		if err := json.Unmarshal(scanner.Bytes(), &resource); err != nil {
+			return added, failed, err
+		}
+
+		batch = append(batch, resource)
+
+		if mode == dr.BestEffort && len(batch) >= BatchSize {
+			if err := flush(); err != nil && err != dr.ErrBatchFailed {
+				return added, failed, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return added, failed, err
+	}
+
+	err := flush()
+
+	if err == nil && len(failed) > 0 {
+		err = dr.ErrBatchFailed
+	}
+
+	return added, failed, err
+}
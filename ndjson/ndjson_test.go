@@ -0,0 +1,92 @@
+package ndjson
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/ram"
+)
+
+func TestRoundTrip(t *testing.T) {
+
+	ctx := context.Background()
+	from := dr.WithContext(ram.New())
+	to := dr.WithContext(ram.New())
+
+	resources := []dr.Dr{
+		dr.Dr{Category: "a", ID: "a", Description: "Item-a.a", Resource: "Resource-a.a", Reusable: true},
+		dr.Dr{Category: "a", ID: "b", Description: "Item-a.b", Resource: "Resource-a.b", TTL: 100},
+		dr.Dr{Category: "x", ID: "y", Description: "Item-x.y", Resource: "Resource-x.y"},
+	}
+
+	if _, err := from.AddBatchContext(ctx, resources, dr.AllOrNothing); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc bytes.Buffer
+
+	count, err := Write(ctx, &doc, from)
+	if err != nil || count != 3 {
+		t.Errorf("Unexpected write result %d %v", count, err)
+	}
+
+	if lines := strings.Count(doc.String(), "\n"); lines != 3 {
+		t.Errorf("Expected 3 lines, got %d:\n%s", lines, doc.String())
+	}
+
+	added, failed, err := Read(ctx, &doc, to, dr.AllOrNothing)
+	if err != nil || added != 3 || len(failed) != 0 {
+		t.Errorf("Unexpected read result %d %v %v", added, failed, err)
+	}
+
+	for _, resource := range resources {
+		got, err := to.GetContext(ctx, resource.Category, resource.ID)
+		if resource.TTL > 0 {
+			// remaining TTL may have ticked over
+			if got.TTL > resource.TTL || got.TTL < resource.TTL-1 {
+				t.Errorf("Unexpected TTL %d", got.TTL)
+			}
+			got.TTL = resource.TTL
+		}
+		if err != nil || !reflect.DeepEqual(got, resource) {
+			t.Errorf("Unexpected resource after import\ngot:%v\nexp:%v\n", got, resource)
+		}
+	}
+}
+
+func TestReadModes(t *testing.T) {
+
+	ctx := context.Background()
+
+	doc := `{"Category":"a","ID":"a"}
+{"Category":"a","ID":"b.c"}
+
+{"Category":"a","ID":"c"}
+`
+	store := dr.WithContext(ram.New())
+
+	added, failed, err := Read(ctx, strings.NewReader(doc), store, dr.AllOrNothing)
+	if err != dr.ErrBatchFailed || added != 0 || len(failed) != 3 {
+		t.Errorf("Unexpected all-or-nothing result %d %v %v", added, failed, err)
+	}
+
+	if _, err := store.CategoriesContext(ctx); err != dr.ErrEmptyStorage {
+		t.Errorf("All-or-nothing import was not")
+	}
+
+	BatchSize = 1
+
+	added, failed, err = Read(ctx, strings.NewReader(doc), store, dr.BestEffort)
+	if err != dr.ErrBatchFailed || added != 2 || len(failed) != 1 || failed[0].Err != dr.ErrIllegalID {
+		t.Errorf("Unexpected best-effort result %d %v %v", added, failed, err)
+	}
+
+	_, _, err = Read(ctx, strings.NewReader("{not json"), store, dr.BestEffort)
+	if err == nil {
+		t.Errorf("Accepted malformed document")
+	}
+}
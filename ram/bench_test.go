@@ -0,0 +1,12 @@
+package ram
+
+import (
+	"testing"
+
+	"github.com/timdrysdale/dr/bench"
+)
+
+// run generic benchmarks on this particular implementation
+func BenchmarkStorage(b *testing.B) {
+	bench.BenchmarkAll(b, bench.Bencher{New: New})
+}
@@ -3,6 +3,7 @@ package ram
 import (
 	"testing"
 
+	"github.com/timdrysdale/dr"
 	"github.com/timdrysdale/dr/test"
 )
 
@@ -11,3 +12,70 @@ func TestInterface(t *testing.T) {
 	t.Log("Testing ./ram ...")
 	test.TestInterface(t, test.Tester{New: New})
 }
+
+func TestListPage(t *testing.T) {
+	test.TestListPage(t, test.Tester{New: New})
+}
+
+func TestContext(t *testing.T) {
+	test.TestContext(t, test.Tester{New: New})
+}
+
+func TestBatch(t *testing.T) {
+	test.TestBatch(t, test.Tester{New: New, NewWithClock: NewWithClock})
+}
+
+func TestExport(t *testing.T) {
+	test.TestExport(t, test.Tester{New: New})
+}
+
+func TestPolicy(t *testing.T) {
+	test.TestPolicy(t, test.Tester{New: New})
+}
+
+func TestSchema(t *testing.T) {
+	test.TestSchema(t, test.Tester{New: New})
+}
+
+func TestHierarchy(t *testing.T) {
+	test.TestHierarchy(t, test.Tester{New: New})
+}
+
+func TestLabels(t *testing.T) {
+	test.TestLabels(t, test.Tester{New: New})
+}
+
+func TestAddGenerated(t *testing.T) {
+	test.TestAddGenerated(t, test.Tester{New: New})
+}
+
+func TestTemplate(t *testing.T) {
+	test.TestTemplate(t, test.Tester{New: New, NewWithClock: NewWithClock})
+}
+
+func TestTenants(t *testing.T) {
+	test.TestTenants(t, test.Tester{New: New})
+}
+
+// a tenant must behave as storage in its own right
+func TestTenantInterface(t *testing.T) {
+	tenant := func() dr.Storage {
+		storage, _ := New().(dr.TenantStorage).Tenant("a")
+		return storage
+	}
+	test.TestInterface(t, test.Tester{New: tenant})
+	test.TestPolicy(t, test.Tester{New: tenant})
+	test.TestTemplate(t, test.Tester{New: tenant})
+}
+
+func TestTrash(t *testing.T) {
+	test.TestTrash(t, test.Tester{New: New})
+}
+
+func TestConcurrency(t *testing.T) {
+	test.TestConcurrency(t, test.Tester{New: New})
+}
+
+func TestModel(t *testing.T) {
+	test.TestModel(t, test.Tester{NewWithClock: NewWithClock})
+}
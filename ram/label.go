@@ -0,0 +1,229 @@
+package ram
+
+import (
+	"context"
+	"strings"
+
+	"github.com/timdrysdale/dr"
+)
+
+// labelIndex finds resources by label, as key -> value -> <category>.<ID>,
+// so that selectors don't have to look at every resource in the store
+type labelIndex map[string]map[string]map[string]bool
+
+func indexKey(category string, id string) string {
+	return category + dr.Separator + id //neither may contain the separator
+}
+
+func (l *labelIndex) add(category string, id string, labels map[string]string) {
+
+	if len(labels) == 0 {
+		return
+	}
+
+	if *l == nil {
+		*l = make(labelIndex)
+	}
+
+	for key, value := range labels {
+		if _, ok := (*l)[key]; !ok {
+			(*l)[key] = make(map[string]map[string]bool)
+		}
+		if _, ok := (*l)[key][value]; !ok {
+			(*l)[key][value] = make(map[string]bool)
+		}
+		(*l)[key][value][indexKey(category, id)] = true
+	}
+}
+
+func (l *labelIndex) remove(category string, id string, labels map[string]string) {
+
+	for key, value := range labels {
+		delete((*l)[key][value], indexKey(category, id))
+		if len((*l)[key][value]) == 0 {
+			delete((*l)[key], value)
+		}
+		if len((*l)[key]) == 0 {
+			delete(*l, key)
+		}
+	}
+}
+
+// candidates returns the smallest set of resources that could meet the
+// selector, or false if it has no requirement that the index can narrow
+// down (i.e. it only says what labels must not be)
+func (l labelIndex) candidates(selector dr.Selector) (map[string]bool, bool) {
+
+	var smallest map[string]bool
+	found := false
+
+	for _, requirement := range selector {
+
+		var set map[string]bool
+
+		switch requirement.Operator {
+		case dr.Equals:
+			set = l[requirement.Key][requirement.Value]
+		case dr.Exists:
+			set = make(map[string]bool)
+			for _, resources := range l[requirement.Key] {
+				for resource := range resources {
+					set[resource] = true
+				}
+			}
+		default:
+			continue
+		}
+
+		if !found || len(set) < len(smallest) {
+			smallest = set
+			found = true
+		}
+	}
+
+	return smallest, found
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+
+	if labels == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(labels))
+
+	for key, value := range labels {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+func (r *RamStorage) CategoriesSelected(selector dr.Selector) (map[string]int, error) {
+	return r.CategoriesSelectedContext(context.Background(), selector)
+}
+
+func (r *RamStorage) CategoriesSelectedContext(ctx context.Context, selector dr.Selector) (map[string]int, error) {
+
+	categoryMap := make(map[string]int)
+
+	lists, err := r.SearchContext(ctx, selector)
+
+	for category, list := range lists {
+		categoryMap[category] = len(list)
+	}
+
+	return categoryMap, err
+}
+
+func (r *RamStorage) ListSelected(category string, selector dr.Selector) (map[string]dr.Dr, error) {
+	return r.ListSelectedContext(context.Background(), category, selector)
+}
+
+func (r *RamStorage) ListSelectedContext(ctx context.Context, category string, selector dr.Selector) (map[string]dr.Dr, error) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return map[string]dr.Dr{}, err
+	}
+
+	lists := r.selected(selector, func(c string) bool {
+		return c == category
+	})
+
+	if len(lists[category]) == 0 {
+		return map[string]dr.Dr{}, dr.ErrResourceNotFound
+	}
+
+	return lists[category], nil
+}
+
+func (r *RamStorage) Search(selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+	return r.SearchContext(context.Background(), selector)
+}
+
+// SearchContext lists the resources in every category that meet the selector
+func (r *RamStorage) SearchContext(ctx context.Context, selector dr.Selector) (map[string]map[string]dr.Dr, error) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return map[string]map[string]dr.Dr{}, err
+	}
+
+	lists := r.selected(selector, func(c string) bool {
+		return true
+	})
+
+	if len(lists) == 0 {
+		return lists, dr.ErrResourceNotFound
+	}
+
+	return lists, nil
+}
+
+// selected lists the unexpired resources in the wanted categories that meet
+// the selector, using the index where it can. Caller must hold the lock.
+func (r *RamStorage) selected(selector dr.Selector, wanted func(string) bool) map[string]map[string]dr.Dr {
+
+	lists := make(map[string]map[string]dr.Dr)
+
+	candidates, indexed := r.labels.candidates(selector)
+
+	if !indexed {
+		candidates = make(map[string]bool)
+		for category, resources := range r.resources {
+			if !wanted(category) {
+				continue
+			}
+			for id := range resources {
+				candidates[indexKey(category, id)] = true
+			}
+		}
+	}
+
+	for candidate := range candidates {
+
+		parts := strings.SplitN(candidate, dr.Separator, 2)
+		category, id := parts[0], parts[1]
+
+		if !wanted(category) {
+			continue
+		}
+
+		expiringResource, ok := r.fresh(category, id)
+
+		if !ok || !selector.Matches(expiringResource.resource.Labels) {
+			continue
+		}
+
+		if _, ok := lists[category]; !ok {
+			lists[category] = make(map[string]dr.Dr)
+		}
+
+		publicResource := expiringResource.resource
+		publicResource.Resource = ""
+		lists[category][id] = publicResource
+	}
+
+	return lists
+}
+
+// fresh gets a resource with its TTL brought up to date, unless it has
+// expired, leaving it for clean to remove. Caller must hold the lock.
+func (r *RamStorage) fresh(category string, id string) (expiringResource, bool) {
+
+	expiringResource, ok := r.resources[category][id]
+	now := r.Now()
+
+	if !ok || expired(expiringResource, now) {
+		return expiringResource, false
+	}
+
+	expiringResource.resource = remaining(expiringResource, now)
+
+	return expiringResource, true
+}
@@ -0,0 +1,311 @@
+package ram
+
+import (
+	"errors"
+	"math"
+
+	"github.com/timdrysdale/dr"
+)
+
+var ErrIllegalLimits = errors.New("Illegal limits")
+
+// Eviction is what happens to an add that would take the storage over its
+// limits
+type Eviction int
+
+const (
+	Reject                 Eviction = iota // the add fails with dr.ErrStorageFull
+	EvictSoonestExpiring                   // those that never expire go last
+	EvictOldest                            // by when they were added
+	EvictLeastRecentlyUsed                 // by when they were added, or last got
+)
+
+// Limits bound how much the storage holds, so that a misbehaving supplier
+// can't exhaust memory. Zero means no limit. Resources in the trash count
+// towards Resources and Bytes, but not CategoryResources. Expired resources
+// are always cleaned out first, then the trash, if the eviction policy
+// allows, and a resource being replaced makes way for itself. Each tenant is
+// held to limits of its own, the same as the default tenant's, so Tenants
+// bounds the total too.
+type Limits struct {
+	Resources         int   // in the tenant
+	CategoryResources int   // in each category
+	Bytes             int64 // of Category, ID, Resource, Description and labels, in the tenant
+	Tenants           int   // other than the default; only stops more being created
+	Eviction          Eviction
+}
+
+func (l Limits) legal() bool {
+	return l.Resources >= 0 && l.CategoryResources >= 0 && l.Bytes >= 0 && l.Tenants >= 0 &&
+		l.Eviction >= Reject && l.Eviction <= EvictLeastRecentlyUsed
+}
+
+func (l Limits) bounded() bool {
+	return l.Resources > 0 || l.CategoryResources > 0 || l.Bytes > 0
+}
+
+// Stats reports how full the storage is, and how often it has had to make
+// room
+type Stats struct {
+	Resources    int
+	Bytes        int64
+	Trashed      int    // resources in the trash, besides those held
+	TrashedBytes int64  // their size
+	Evictions    uint64 // resources removed to make room, from the trash too
+	Rejections   uint64 // adds refused for want of room
+}
+
+func (r *RamStorage) Limits() Limits {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.limits
+}
+
+// SetLimits applies to adds from now on, except that with an eviction
+// policy, it also evicts whatever is over the new limits straight away. It
+// applies to every tenant, including those created already, unless called
+// on a tenant's own storage, which only applies to that tenant.
+func (r *RamStorage) SetLimits(limits Limits) error {
+
+	if !limits.legal() {
+		return ErrIllegalLimits
+	}
+
+	r.setLimits(limits)
+
+	// not under our lock, which Tenant takes while holding tenantsLock
+	r.tenantsLock.Lock()
+	defer r.tenantsLock.Unlock()
+
+	for _, tenant := range r.tenants {
+		tenant.setLimits(limits)
+	}
+
+	return nil
+}
+
+func (r *RamStorage) setLimits(limits Limits) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.limits = limits
+
+	if limits.Eviction != Reject {
+		r.makeRoom(nil)
+	}
+}
+
+func (r *RamStorage) Stats() Stats {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return Stats{
+		Resources:    r.count,
+		Bytes:        r.bytes,
+		Trashed:      r.trashedCount,
+		TrashedBytes: r.trashedBytes,
+		Evictions:    r.evictions,
+		Rejections:   r.rejections,
+	}
+}
+
+// size is what a resource counts towards the Bytes limit
+func size(resource dr.Dr) int64 {
+
+	n := len(resource.Category) + len(resource.ID) + len(resource.Resource) + len(resource.Description)
+
+	for key, value := range resource.Labels {
+		n += len(key) + len(value)
+	}
+
+	return int64(n)
+}
+
+// makeRoom makes sure the resources can be added without going over the
+// limits, evicting others if the policy allows, or else returns
+// dr.ErrStorageFull having evicted nothing. Caller must hold the write lock.
+func (r *RamStorage) makeRoom(resources []dr.Dr) error {
+
+	if !r.limits.bounded() {
+		return nil
+	}
+
+	adding := make(map[string]map[string]dr.Dr)
+
+	for _, resource := range resources {
+		if _, ok := adding[resource.Category]; !ok {
+			adding[resource.Category] = make(map[string]dr.Dr)
+		}
+		adding[resource.Category][resource.ID] = resource
+	}
+
+	if r.over(adding) == nil {
+		return nil
+	}
+
+	for category := range r.resources {
+		r.clean(category) //expired resources go first, at no cost to anyone
+	}
+	r.purge()
+
+	if r.over(adding) == nil {
+		return nil
+	}
+
+	if r.limits.Eviction == Reject || !r.fits(adding) {
+		r.rejections++
+		return dr.ErrStorageFull
+	}
+
+	for wanted := r.over(adding); wanted != nil; wanted = r.over(adding) {
+
+		// the trash goes before anything still in use
+		if r.overTotal(adding) && r.dropTrash() {
+			r.evictions++
+			continue
+		}
+
+		category, id, ok := r.victim(wanted, adding)
+		if !ok {
+			r.rejections++
+			return dr.ErrStorageFull //can't happen, since it fits
+		}
+
+		r.remove(category, id)
+		r.evictions++
+	}
+
+	return nil
+}
+
+// over returns which categories resources must be evicted from to make room
+// for those being added, or nil if there is room already
+func (r *RamStorage) over(adding map[string]map[string]dr.Dr) func(string) bool {
+
+	if r.limits.CategoryResources > 0 {
+
+		for category, resources := range adding {
+
+			existing := len(r.resources[category])
+
+			for id := range resources {
+				if _, ok := r.resources[category][id]; !ok {
+					existing++
+				}
+			}
+
+			if existing > r.limits.CategoryResources {
+				full := category
+				return func(c string) bool { return c == full }
+			}
+		}
+
+		// with nothing being added, e.g. on SetLimits, check what is held already
+		if len(adding) == 0 {
+			for category, resources := range r.resources {
+				if len(resources) > r.limits.CategoryResources {
+					full := category
+					return func(c string) bool { return c == full }
+				}
+			}
+		}
+	}
+
+	if r.overTotal(adding) {
+		return everyCategory
+	}
+
+	return nil
+}
+
+// overTotal reports whether adding the resources would take what is held,
+// and in the trash, over the Resources or Bytes limits
+func (r *RamStorage) overTotal(adding map[string]map[string]dr.Dr) bool {
+
+	count, bytes := r.count+r.trashedCount, r.bytes+r.trashedBytes
+
+	for category, resources := range adding {
+		for id, resource := range resources {
+			if old, ok := r.resources[category][id]; ok {
+				bytes -= size(old.resource)
+			} else {
+				count++
+			}
+			bytes += size(resource)
+		}
+	}
+
+	return (r.limits.Resources > 0 && count > r.limits.Resources) ||
+		(r.limits.Bytes > 0 && bytes > r.limits.Bytes)
+}
+
+// fits reports whether the resources being added would be within the
+// limits if nothing else were held, so that there's no evicting everything
+// only to find they still don't fit
+func (r *RamStorage) fits(adding map[string]map[string]dr.Dr) bool {
+
+	count, bytes := 0, int64(0)
+
+	for _, resources := range adding {
+
+		if r.limits.CategoryResources > 0 && len(resources) > r.limits.CategoryResources {
+			return false
+		}
+
+		for _, resource := range resources {
+			count++
+			bytes += size(resource)
+		}
+	}
+
+	return (r.limits.Resources == 0 || count <= r.limits.Resources) &&
+		(r.limits.Bytes == 0 || bytes <= r.limits.Bytes)
+}
+
+// victim picks the resource to evict from the wanted categories, by policy,
+// sparing those being added or replaced. It looks at every resource, which
+// is only a cost when the storage is full.
+func (r *RamStorage) victim(wanted func(string) bool, adding map[string]map[string]dr.Dr) (string, string, bool) {
+
+	var category, id string
+	found := false
+	best := int64(math.MaxInt64)
+	bestAdded := uint64(math.MaxUint64)
+
+	for c, resources := range r.resources {
+
+		if !wanted(c) {
+			continue
+		}
+
+		for i, e := range resources {
+
+			if _, ok := adding[c][i]; ok {
+				continue
+			}
+
+			var key int64
+
+			switch r.limits.Eviction {
+			case EvictSoonestExpiring:
+				key = sortKeys[dr.SortByExpiry](e)
+			case EvictOldest:
+				key = int64(e.added)
+			case EvictLeastRecentlyUsed:
+				key = int64(e.used.Load())
+			}
+
+			// ties go to the oldest
+			if !found || key < best || (key == best && e.added < bestAdded) {
+				category, id, found = c, i, true
+				best, bestAdded = key, e.added
+			}
+		}
+	}
+
+	return category, id, found
+}
@@ -0,0 +1,270 @@
+package ram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/timdrysdale/dr"
+)
+
+func newLimited(t *testing.T, limits Limits) (*RamStorage, clockwork.FakeClock) {
+	clock := clockwork.NewFakeClock()
+	r := NewWithClock(clock).(*RamStorage)
+	if err := r.SetLimits(limits); err != nil {
+		t.Fatal(err)
+	}
+	return r, clock
+}
+
+// held lists which of the IDs are still in the category
+func held(r *RamStorage, category string, ids ...string) []string {
+	list, _ := r.List(category)
+	found := []string{}
+	for _, id := range ids {
+		if _, ok := list[id]; ok {
+			found = append(found, id)
+		}
+	}
+	return found
+}
+
+func TestIllegalLimits(t *testing.T) {
+
+	r := New().(*RamStorage)
+
+	for _, limits := range []Limits{{Resources: -1}, {Bytes: -1}, {CategoryResources: -1}, {Tenants: -1}, {Eviction: 99}} {
+		if err := r.SetLimits(limits); err != ErrIllegalLimits {
+			t.Errorf("%+v: wanted ErrIllegalLimits, got %v", limits, err)
+		}
+	}
+}
+
+func TestLimitsReject(t *testing.T) {
+
+	r, clock := newLimited(t, Limits{Resources: 2})
+
+	r.Add(dr.Dr{Category: "a", ID: "x", Reusable: true})
+	r.Add(dr.Dr{Category: "a", ID: "y", TTL: 1})
+
+	if err := r.Add(dr.Dr{Category: "a", ID: "z"}); err != dr.ErrStorageFull {
+		t.Errorf("wanted ErrStorageFull, got %v", err)
+	}
+
+	if err := r.Add(dr.Dr{Category: "a", ID: "x", Resource: "replaced"}); err != nil {
+		t.Errorf("replacing should not need room, got %v", err)
+	}
+
+	results, err := r.AddBatch([]dr.Dr{{Category: "b", ID: "x"}}, dr.AllOrNothing)
+	if err != dr.ErrBatchFailed || results[0].Err != dr.ErrStorageFull {
+		t.Errorf("wanted batch to fail for want of room, got %v %v", results, err)
+	}
+
+	clock.Advance(2 * time.Second)
+
+	if err := r.Add(dr.Dr{Category: "a", ID: "z"}); err != nil {
+		t.Errorf("expired resource should make room, got %v", err)
+	}
+
+	stats := r.Stats()
+	if stats.Resources != 2 || stats.Rejections != 2 || stats.Evictions != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestEvictOldestInCategory(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{CategoryResources: 2, Eviction: EvictOldest})
+
+	for _, id := range []string{"x", "y", "z"} {
+		if err := r.Add(dr.Dr{Category: "a", ID: id, Reusable: true}); err != nil {
+			t.Error(err)
+		}
+	}
+	r.Add(dr.Dr{Category: "b", ID: "x", Reusable: true})
+
+	if got := held(r, "a", "x", "y", "z"); len(got) != 2 || got[0] != "y" {
+		t.Errorf("wanted oldest evicted, still have %v", got)
+	}
+
+	if got := held(r, "b", "x"); len(got) != 1 {
+		t.Errorf("other categories should be left alone")
+	}
+
+	if stats := r.Stats(); stats.Evictions != 1 || stats.Resources != 3 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestEvictSoonestExpiring(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{Resources: 3, Eviction: EvictSoonestExpiring})
+
+	r.Add(dr.Dr{Category: "a", ID: "never", Reusable: true})
+	r.Add(dr.Dr{Category: "a", ID: "later", TTL: 100})
+	r.Add(dr.Dr{Category: "a", ID: "soon", TTL: 10})
+	r.Add(dr.Dr{Category: "b", ID: "new", TTL: 50})
+
+	if got := held(r, "a", "never", "later", "soon"); len(got) != 2 || got[1] != "later" {
+		t.Errorf("wanted soonest expiring evicted, still have %v", got)
+	}
+}
+
+func TestEvictLeastRecentlyUsed(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{Resources: 3, Eviction: EvictLeastRecentlyUsed})
+
+	for _, id := range []string{"x", "y", "z"} {
+		r.Add(dr.Dr{Category: "a", ID: id, Reusable: true})
+	}
+
+	r.Get("a", "x")
+	r.Add(dr.Dr{Category: "a", ID: "w", Reusable: true})
+
+	if got := held(r, "a", "x", "y", "z", "w"); len(got) != 3 || got[0] != "x" || got[1] != "z" {
+		t.Errorf("wanted least recently used evicted, still have %v", got)
+	}
+}
+
+func TestLimitsBytes(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{Bytes: 20, Eviction: EvictOldest})
+
+	r.Add(dr.Dr{Category: "a", ID: "x", Resource: "12345678"}) // 10 bytes
+	r.Add(dr.Dr{Category: "a", ID: "y", Resource: "12345678"})
+
+	if err := r.Add(dr.Dr{Category: "a", ID: "z", Resource: "123456789012345678901"}); err != dr.ErrStorageFull {
+		t.Errorf("wanted resource too big for storage refused, got %v", err)
+	}
+
+	if stats := r.Stats(); stats.Evictions != 0 || stats.Bytes != 20 {
+		t.Errorf("nothing should be evicted for a resource that can't fit, got %+v", stats)
+	}
+
+	r.Add(dr.Dr{Category: "a", ID: "z", Resource: "1234"})
+
+	if stats := r.Stats(); stats.Evictions != 1 || stats.Bytes != 16 || stats.Resources != 2 {
+		t.Errorf("got %+v", stats)
+	}
+
+	r.Delete("a", "y")
+	r.Reset()
+
+	if stats := r.Stats(); stats.Bytes != 0 || stats.Resources != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestSetLimitsEvicts(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{})
+
+	for _, id := range []string{"x", "y", "z"} {
+		r.Add(dr.Dr{Category: "a", ID: id, Reusable: true})
+	}
+
+	r.SetLimits(Limits{Resources: 1, Eviction: EvictOldest})
+
+	if got := held(r, "a", "x", "y", "z"); len(got) != 1 || got[0] != "z" {
+		t.Errorf("wanted only newest kept, still have %v", got)
+	}
+
+	r.SetLimits(Limits{})
+
+	for _, id := range []string{"x", "y", "z"} {
+		r.Add(dr.Dr{Category: "b", ID: id, Reusable: true})
+	}
+
+	r.SetLimits(Limits{CategoryResources: 1, Eviction: EvictOldest})
+
+	if got := held(r, "b", "x", "y", "z"); len(got) != 1 || got[0] != "z" {
+		t.Errorf("wanted only newest in category kept, still have %v", got)
+	}
+
+	tenant, _ := r.Tenant("t")
+	if limits := tenant.(*RamStorage).Limits(); limits.CategoryResources != 1 {
+		t.Errorf("new tenants should start with the same limits, got %+v", limits)
+	}
+
+	for _, id := range []string{"x", "y"} {
+		tenant.Add(dr.Dr{Category: "c", ID: id, Reusable: true})
+	}
+
+	r.SetLimits(Limits{Resources: 1, Eviction: EvictOldest})
+
+	if limits := tenant.(*RamStorage).Limits(); limits.Resources != 1 {
+		t.Errorf("existing tenants should get the new limits, got %+v", limits)
+	}
+
+	if got := held(tenant.(*RamStorage), "c", "x", "y"); len(got) != 1 || got[0] != "y" {
+		t.Errorf("wanted existing tenant evicted down to its limits, still have %v", got)
+	}
+}
+
+func TestLimitsCountTrash(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{Resources: 2})
+	r.SetGracePeriod(60)
+
+	r.Add(dr.Dr{Category: "a", ID: "x", Resource: "1234"})
+	r.Add(dr.Dr{Category: "a", ID: "y", Resource: "1234"})
+	r.Delete("a", "x")
+
+	// deleting and adding again can't get round the limits
+	if err := r.Add(dr.Dr{Category: "a", ID: "z"}); err != dr.ErrStorageFull {
+		t.Errorf("wanted trash to count towards limits, got %v", err)
+	}
+
+	if stats := r.Stats(); stats.Resources != 1 || stats.Trashed != 1 || stats.TrashedBytes != 6 {
+		t.Errorf("got %+v", stats)
+	}
+
+	if _, err := r.Restore("a", "x"); err != nil {
+		t.Errorf("restoring should not need room of its own, got %v", err)
+	}
+
+	r.Delete("a", "x")
+	r.SetLimits(Limits{Resources: 2, Eviction: EvictOldest})
+
+	// but with an eviction policy, the trash makes room first
+	if err := r.Add(dr.Dr{Category: "a", ID: "z"}); err != nil {
+		t.Error(err)
+	}
+
+	if got := held(r, "a", "x", "y", "z"); len(got) != 2 {
+		t.Errorf("wanted trash evicted rather than y, still have %v", got)
+	}
+
+	if stats := r.Stats(); stats.Trashed != 0 || stats.Evictions != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestLimitsTenants(t *testing.T) {
+
+	r, _ := newLimited(t, Limits{Resources: 1, Tenants: 1})
+
+	tenant, err := r.Tenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Tenant("b"); err != dr.ErrStorageFull {
+		t.Errorf("wanted ErrStorageFull for one tenant too many, got %v", err)
+	}
+
+	if _, err := r.Tenant("a"); err != nil {
+		t.Errorf("existing tenant should still be there, got %v", err)
+	}
+
+	// each tenant has limits of its own
+	if err := r.Add(dr.Dr{Category: "c", ID: "x"}); err != nil {
+		t.Error(err)
+	}
+	if err := tenant.Add(dr.Dr{Category: "c", ID: "x"}); err != nil {
+		t.Error(err)
+	}
+	if err := tenant.Add(dr.Dr{Category: "c", ID: "y"}); err != dr.ErrStorageFull {
+		t.Errorf("wanted ErrStorageFull, got %v", err)
+	}
+}
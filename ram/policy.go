@@ -0,0 +1,153 @@
+package ram
+
+import (
+	"encoding/json"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/idgen"
+)
+
+// Policies survive Reset, because they are configuration rather than resources
+
+func (r *RamStorage) DeletePolicy(category string) error {
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.policies[category]; !ok {
+		return dr.ErrPolicyNotFound
+	}
+
+	delete(r.policies, category)
+
+	return nil
+}
+
+func (r *RamStorage) GetPolicy(category string) (dr.Policy, error) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if policy, ok := r.policies[category]; ok {
+		return policy, nil
+	}
+
+	return dr.Policy{}, dr.ErrPolicyNotFound
+}
+
+func (r *RamStorage) Policies() (map[string]dr.Policy, error) {
+
+	policies := make(map[string]dr.Policy)
+
+	r.RLock()
+	defer r.RUnlock()
+
+	for category, policy := range r.policies {
+		policies[category] = policy
+	}
+
+	return policies, nil
+}
+
+// SetPolicy applies to resources added from now on; those already in the
+// category are left alone
+func (r *RamStorage) SetPolicy(category string, policy dr.Policy) error {
+
+	if category == "" {
+		return dr.ErrUndefinedCategory
+	}
+
+	if policy.DefaultTTL < 0 || policy.MaxTTL < 0 || policy.MaxResources < 0 ||
+		policy.MaxDescriptionSize < 0 || policy.MaxResourceSize < 0 {
+		return dr.ErrIllegalPolicy
+	}
+
+	if policy.MaxTTL > 0 && policy.DefaultTTL > policy.MaxTTL {
+		return dr.ErrIllegalPolicy
+	}
+
+	if !idgen.Legal(policy.IDScheme) {
+		return dr.ErrIllegalPolicy
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.policies == nil {
+		r.policies = make(map[string]dr.Policy)
+	}
+
+	r.policies[category] = policy
+
+	return nil
+}
+
+// admit checks a resource against its category's schema and policy, and
+// returns it with any default TTL applied. IDs in pending are about to be added
+// by the same batch, and count towards the category's size. Caller must hold
+// the write lock.
+func (r *RamStorage) admit(resource dr.Dr, pending map[string]bool) (dr.Dr, error) {
+
+	if s, ok := r.schemas[resource.Category]; ok {
+		if err := s.compiled.Validate(resource.Description); err != nil {
+			return resource, err
+		}
+	}
+
+	policy, ok := r.policies[resource.Category]
+	if !ok {
+		return resource, nil
+	}
+
+	if resource.TTL <= 0 {
+		resource.TTL = policy.DefaultTTL
+	}
+
+	if policy.MaxTTL > 0 && (resource.TTL <= 0 || resource.TTL > policy.MaxTTL) {
+		return resource, dr.ErrTTLTooLong
+	}
+
+	if policy.ForbidReusable && resource.Reusable {
+		return resource, dr.ErrReusableNotAllowed
+	}
+
+	if policy.MaxDescriptionSize > 0 && len(resource.Description) > policy.MaxDescriptionSize {
+		return resource, dr.ErrDescriptionTooLarge
+	}
+
+	if policy.MaxResourceSize > 0 && len(resource.Resource) > policy.MaxResourceSize {
+		return resource, dr.ErrResourceTooLarge
+	}
+
+	if len(policy.RequiredDescriptionKeys) > 0 {
+		var description map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(resource.Description), &description); err != nil {
+			return resource, dr.ErrDescriptionKeys
+		}
+		for _, key := range policy.RequiredDescriptionKeys {
+			if _, ok := description[key]; !ok {
+				return resource, dr.ErrDescriptionKeys
+			}
+		}
+	}
+
+	if policy.MaxResources > 0 {
+
+		r.clean(resource.Category) //expired resources don't count
+
+		_, replacing := r.resources[resource.Category][resource.ID]
+		count := len(r.resources[resource.Category])
+
+		for id, _ := range pending {
+			if _, ok := r.resources[resource.Category][id]; !ok {
+				count++
+			}
+		}
+
+		if !replacing && !pending[resource.ID] && count >= policy.MaxResources {
+			return resource, dr.ErrCategoryFull
+		}
+	}
+
+	return resource, nil
+}
@@ -1,30 +1,248 @@
 package ram
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/idgen"
 )
 
 type expiringResource struct {
 	resource   dr.Dr
 	validUntil int64
+	added      uint64         // insertion order, for paging
+	generator  dr.Generator   // only for templates
+	used       *atomic.Uint64 // when last added or got, for eviction
 }
 
 type RamStorage struct {
 	resources map[string]map[string]expiringResource
+	added     uint64
+	arrivals  map[string]chan struct{}
+	labels    labelIndex
+	policies  map[string]dr.Policy
+	schemas   map[string]categorySchema
 	clock     clockwork.Clock
 	sync.RWMutex
+
+	// other tenants are each a RamStorage of their own, with their own maps
+	// and lock, so they don't hold each other up, or get reset together
+	tenants     map[string]*RamStorage
+	tenantsLock sync.Mutex
+
+	grace        int64 // seconds that deleted resources are kept in the trash
+	trash        map[string]map[string]trashedResource
+	trashedCount int   // resources in the trash
+	trashedBytes int64 // size of resources in the trash
+
+	limits     Limits
+	count      int   // resources held
+	bytes      int64 // size of resources held
+	evictions  uint64
+	rejections uint64
+	uses       atomic.Uint64 // orders adds and gets, for eviction
+}
+
+// cursor records the position of the last resource on a page, so that
+// the next page starts after it even if resources are taken meanwhile
+type cursor struct {
+	Sort       string
+	Descending bool
+	Key        int64
+	ID         string
 }
 
 func (r *RamStorage) Now() int64 {
+	if r.clock != nil {
+		return r.clock.Now().Unix()
+	}
 	return time.Now().Unix()
 }
 
 func (r *RamStorage) Add(resource dr.Dr) error {
+	return r.AddContext(context.Background(), resource)
+}
+
+func (r *RamStorage) AddContext(ctx context.Context, resource dr.Dr) error {
+
+	if err := validate(resource); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	resource, err := r.admit(resource, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := r.makeRoom([]dr.Dr{resource}); err != nil {
+		return err
+	}
+
+	r.put(resource)
+
+	return nil
+}
+
+func (r *RamStorage) AddBatch(resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return r.AddBatchContext(context.Background(), resources, mode)
+}
+
+// AddBatchContext adds all the resources under a single lock, so that no
+// one sees a partial batch
+func (r *RamStorage) AddBatchContext(ctx context.Context, resources []dr.Dr, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	results := make([]dr.BatchResult, len(resources))
+	failed := false
+
+	for i, resource := range resources {
+		results[i] = dr.BatchResult{Category: resource.Category, ID: resource.ID, Err: validate(resource)}
+		if results[i].Err != nil {
+			failed = true
+		}
+	}
+
+	if failed && mode == dr.AllOrNothing {
+		return abort(results), dr.ErrBatchFailed
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+
+	// check the category policies, counting what the batch adds so far
+	admitted := make([]dr.Dr, len(resources))
+	pending := make(map[string]map[string]bool)
+
+	for i, resource := range resources {
+		if results[i].Err == nil {
+			admitted[i], results[i].Err = r.admit(resource, pending[resource.Category])
+		}
+		if results[i].Err != nil {
+			failed = true
+			continue
+		}
+		if _, ok := pending[resource.Category]; !ok {
+			pending[resource.Category] = make(map[string]bool)
+		}
+		pending[resource.Category][resource.ID] = true
+	}
+
+	if failed && mode == dr.AllOrNothing {
+		return abort(results), dr.ErrBatchFailed
+	}
+
+	// all or nothing batches need room for everything before adding anything
+	if mode == dr.AllOrNothing {
+		if err := r.makeRoom(admitted); err != nil {
+			for i := range results {
+				results[i].Err = err
+			}
+			return results, dr.ErrBatchFailed
+		}
+	}
+
+	for i, resource := range admitted {
+		if results[i].Err == nil && mode != dr.AllOrNothing {
+			results[i].Err = r.makeRoom([]dr.Dr{resource})
+			failed = failed || results[i].Err != nil
+		}
+		if results[i].Err == nil {
+			r.put(resource)
+		}
+	}
+
+	if failed {
+		return results, dr.ErrBatchFailed
+	}
+
+	return results, nil
+}
+
+func (r *RamStorage) AddGenerated(resource dr.Dr) (dr.Dr, error) {
+	return r.AddGeneratedContext(context.Background(), resource)
+}
+
+// AddGeneratedContext gives the resource an ID in its category's IDScheme,
+// trying again in the unlikely event that it is already taken, or in the
+// trash, where restoring it would overwrite the resource
+func (r *RamStorage) AddGeneratedContext(ctx context.Context, resource dr.Dr) (dr.Dr, error) {
+
+	if resource.ID != "" {
+		return dr.Dr{}, dr.ErrIllegalID
+	}
+
+	resource.ID = "pending" //so validate checks everything else
+
+	if err := validate(resource); err != nil {
+		return dr.Dr{}, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return dr.Dr{}, err
+	}
+
+	for {
+		id, err := idgen.New(r.policies[resource.Category].IDScheme)
+		if err != nil {
+			return dr.Dr{}, err
+		}
+		if !r.taken(resource.Category, id) {
+			resource.ID = id
+			break
+		}
+	}
+
+	resource, err := r.admit(resource, nil)
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	if err := r.makeRoom([]dr.Dr{resource}); err != nil {
+		return dr.Dr{}, err
+	}
+
+	r.put(resource)
+
+	return resource, nil
+}
+
+// taken reports whether the ID is held, or in the trash. Caller must hold
+// the lock.
+func (r *RamStorage) taken(category string, id string) bool {
+
+	if _, ok := r.resources[category][id]; ok {
+		return true
+	}
+
+	_, ok := r.trash[category][id]
+
+	return ok
+}
+
+// validate checks a resource can be added
+func validate(resource dr.Dr) error {
 
 	if resource.Category == "" {
 		return dr.ErrUndefinedCategory
@@ -34,18 +252,27 @@ func (r *RamStorage) Add(resource dr.Dr) error {
 		return dr.ErrUndefinedID
 	}
 
-	if strings.Contains(resource.ID, dr.Separator) {
+	if strings.Contains(resource.ID, dr.Separator) ||
+		strings.Contains(resource.ID, dr.PathSeparator) ||
+		strings.Contains(resource.ID, dr.Wildcard) {
 		return dr.ErrIllegalID
 	}
 
-	if strings.Contains(resource.Category, dr.Separator) {
+	if !dr.LegalCategory(resource.Category) {
 		return dr.ErrIllegalCategory
 	}
 
-	// create category if does not already exist
+	if !dr.LegalLabels(resource.Labels) {
+		return dr.ErrIllegalLabel
+	}
 
-	r.Lock()
-	defer r.Unlock()
+	return nil
+}
+
+// put stores a valid resource. Caller must hold the write lock.
+func (r *RamStorage) put(resource dr.Dr) {
+
+	// create category if does not already exist
 
 	if _, ok := r.resources[resource.Category]; !ok {
 		r.resources[resource.Category] = make(map[string]expiringResource)
@@ -57,58 +284,126 @@ func (r *RamStorage) Add(resource dr.Dr) error {
 		validUntil = r.Now() + resource.TTL
 	}
 
-	r.resources[resource.Category][resource.ID] = expiringResource{resource: resource, validUntil: validUntil}
+	r.added++
 
-	return nil
+	if old, ok := r.resources[resource.Category][resource.ID]; ok {
+		r.labels.remove(resource.Category, resource.ID, old.resource.Labels)
+		r.count--
+		r.bytes -= size(old.resource)
+	}
+
+	resource.Labels = copyLabels(resource.Labels) //so the caller can't change them under us
+
+	used := &atomic.Uint64{}
+	used.Store(r.uses.Add(1))
+
+	r.resources[resource.Category][resource.ID] = expiringResource{resource: resource, validUntil: validUntil, added: r.added, used: used}
+
+	r.count++
+	r.bytes += size(resource)
+
+	r.labels.add(resource.Category, resource.ID, resource.Labels)
+
+	// wake anyone waiting for this category
+	if arrival, ok := r.arrivals[resource.Category]; ok {
+		close(arrival)
+		delete(r.arrivals, resource.Category)
+	}
 }
 
-func (r *RamStorage) Categories() (map[string]int, error) {
+// remove deletes a resource, and its category if that is now empty.
+// Caller must hold the write lock.
+func (r *RamStorage) remove(category string, id string) {
 
-	categoryMap := make(map[string]int)
-	categoryList := []string{}
+	if expiringResource, ok := r.resources[category][id]; ok {
+		r.labels.remove(category, id, expiringResource.resource.Labels)
+		r.count--
+		r.bytes -= size(expiringResource.resource)
+	}
 
-	r.RLock()
-	numCategories := len(r.resources)
-	r.RUnlock()
+	delete(r.resources[category], id)
 
-	if numCategories == 0 {
-		return categoryMap, dr.ErrEmptyStorage
+	if len(r.resources[category]) == 0 {
+		delete(r.resources, category)
 	}
+}
 
-	r.RLock()
-	for category, _ := range r.resources {
-		categoryList = append(categoryList, category)
+// abort marks the items that were fine as not having been applied
+func abort(results []dr.BatchResult) []dr.BatchResult {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i].Err = dr.ErrBatchAborted
+		}
 	}
-	r.RUnlock()
+	return results
+}
+
+func (r *RamStorage) Categories() (map[string]int, error) {
+	return r.CategoriesContext(context.Background())
+}
+
+func (r *RamStorage) CategoriesContext(ctx context.Context) (map[string]int, error) {
 
-	for _, category := range categoryList {
-		_, _ = r.List(category) //use list to do stale cleaning
+	categoryMap := make(map[string]int)
+
+	if err := ctx.Err(); err != nil {
+		return categoryMap, err
 	}
 
-	r.RLock()
-	numCategories = len(r.resources)
-	r.RUnlock()
+	unlock := r.readLock(everyCategory)
+	defer unlock()
 
-	if numCategories == 0 {
-		return categoryMap, dr.ErrEmptyStorage
+	now := r.Now()
+
+	for category, resources := range r.resources {
+		for _, expiringResource := range resources {
+			if !expired(expiringResource, now) {
+				categoryMap[category]++
+			}
+		}
 	}
 
-	r.RLock()
-	for category, resourceMap := range r.resources {
-		categoryMap[category] = len(resourceMap)
+	if len(categoryMap) == 0 {
+		return categoryMap, dr.ErrEmptyStorage
 	}
-	r.RUnlock()
 
 	return categoryMap, nil
 }
 
+func (r *RamStorage) CategoriesMatching(pattern string) (map[string]int, error) {
+	return r.CategoriesMatchingContext(context.Background(), pattern)
+}
+
+func (r *RamStorage) CategoriesMatchingContext(ctx context.Context, pattern string) (map[string]int, error) {
+
+	categoryMap := make(map[string]int)
+
+	lists, err := r.ListMatchingContext(ctx, pattern)
+
+	for category, list := range lists {
+		categoryMap[category] = len(list)
+	}
+
+	return categoryMap, err
+}
+
 func (r *RamStorage) Delete(category string, id string) (dr.Dr, error) {
+	return r.DeleteContext(context.Background(), category, id)
+}
+
+func (r *RamStorage) DeleteContext(ctx context.Context, category string, id string) (dr.Dr, error) {
 
 	emptyResource := dr.Dr{}
 
 	r.Lock()
 	defer r.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return emptyResource, err
+	}
+
+	r.purge()
+
 	// category existence check
 	if _, ok := r.resources[category]; !ok {
 		return emptyResource, dr.ErrResourceNotFound
@@ -116,11 +411,13 @@ func (r *RamStorage) Delete(category string, id string) (dr.Dr, error) {
 
 	// ID existence check & deletion
 	if expiringResource, ok := r.resources[category][id]; ok {
-		delete(r.resources[category], id)
-		if len(r.resources[category]) == 0 {
-			delete(r.resources, category)
+		now := r.Now()
+		if expired(expiringResource, now) {
+			r.remove(category, id) //no use to anyone, so not worth trashing
+			return emptyResource, dr.ErrResourceNotFound
 		}
-		return expiringResource.resource, nil
+		r.discard(category, id)
+		return remaining(expiringResource, now), nil
 	} else {
 		// not found
 		return emptyResource, dr.ErrResourceNotFound
@@ -128,76 +425,182 @@ func (r *RamStorage) Delete(category string, id string) (dr.Dr, error) {
 
 }
 
-func (r *RamStorage) Get(category string, id string) (dr.Dr, error) {
+func (r *RamStorage) DeleteBatch(category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+	return r.DeleteBatchContext(context.Background(), category, ids, mode)
+}
 
-	emptyResource := dr.Dr{}
+// DeleteBatchContext deletes the resources under a single lock, checking
+// they all exist before deleting any when in AllOrNothing mode
+func (r *RamStorage) DeleteBatchContext(ctx context.Context, category string, ids []string, mode dr.BatchMode) ([]dr.BatchResult, error) {
+
+	results := make([]dr.BatchResult, len(ids))
+	failed := false
 
 	r.Lock()
 	defer r.Unlock()
 
-	// category existence check
-	if _, ok := r.resources[category]; !ok {
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
 
-		return emptyResource, dr.ErrResourceNotFound
+	found := make(map[string]bool)
+	now := r.Now()
 
+	for i, id := range ids {
+		results[i] = dr.BatchResult{Category: category, ID: id}
+		if e, ok := r.resources[category][id]; !ok || found[id] || expired(e, now) {
+			results[i].Err = dr.ErrResourceNotFound // including second time in batch
+			failed = true
+		}
+		found[id] = true
 	}
 
-	// ID existence check
-	if expiringResource, ok := r.resources[category][id]; ok {
-
-		//clean stale entry if found
+	r.clean(category) //expired resources are no use to anyone, so not worth trashing
 
-		expired := false
+	if failed && mode == dr.AllOrNothing {
+		return abort(results), dr.ErrBatchFailed
+	}
 
-		if expiringResource.validUntil > 0 {
-			// expirable
-			newTTL := expiringResource.validUntil - r.Now()
-			if newTTL < 0 {
-				expired = true
-				delete(r.resources[category], id)
-				if len(r.resources[category]) == 0 {
-					delete(r.resources, category)
-				}
-			} else {
-				// update TTL
-				temp := r.resources[category][id]
-				temp.resource.TTL = newTTL
-				r.resources[category][id] = temp
-				expiringResource.resource.TTL = newTTL
-			}
+	r.purge()
 
+	for _, result := range results {
+		if result.Err == nil {
+			r.discard(category, result.ID)
 		}
+	}
 
-		if expired {
+	if failed {
+		return results, dr.ErrBatchFailed
+	}
 
-			// expired since last clean, don't return it
+	return results, nil
+}
 
-			return emptyResource, dr.ErrResourceNotFound
+func (r *RamStorage) Export(each func(dr.Dr) error) error {
+	return r.ExportContext(context.Background(), each)
+}
 
-		} else {
+// ExportContext takes a snapshot under the lock, so that slow consumers
+// don't hold up everyone else
+func (r *RamStorage) ExportContext(ctx context.Context, each func(dr.Dr) error) error {
 
-			// delete if single use
-			if !expiringResource.resource.Reusable {
-				delete(r.resources[category], id)
-				if len(r.resources[category]) == 0 {
-					delete(r.resources, category)
-				}
+	snapshot := []dr.Dr{}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
+	unlock := r.readLock(everyCategory)
+
+	now := r.Now()
+
+	for _, resources := range r.resources {
+		for _, expiringResource := range resources {
+			if expiringResource.generator != nil {
+				continue //can't export code
+			}
+			if expiringResource.validUntil == 0 || expiringResource.validUntil > now {
+				snapshot = append(snapshot, remaining(expiringResource, now))
 			}
+		}
+	}
 
-			// return resource (with up-to-date TTL)
-			return expiringResource.resource, nil
+	unlock()
 
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Category != snapshot[j].Category {
+			return snapshot[i].Category < snapshot[j].Category
 		}
+		return snapshot[i].ID < snapshot[j].ID
+	})
 
-	} else {
-		//not found
-		return emptyResource, dr.ErrResourceNotFound
+	for _, resource := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := each(resource); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RamStorage) Get(category string, id string) (dr.Dr, error) {
+	return r.GetContext(context.Background(), category, id)
+}
+
+// GetContext only needs the write lock to remove what it gets, so reusable
+// resources and templates are got alongside other readers
+func (r *RamStorage) GetContext(ctx context.Context, category string, id string) (dr.Dr, error) {
+
+	if err := ctx.Err(); err != nil {
+		return dr.Dr{}, err
+	}
+
+	r.RLock()
+
+	now := r.Now()
+
+	if expiringResource, ok := r.resources[category][id]; ok && !expired(expiringResource, now) &&
+		(expiringResource.resource.Reusable || expiringResource.generator != nil) {
+		defer r.RUnlock()
+		return r.got(ctx, expiringResource, now)
+	}
+
+	r.RUnlock()
+
+	r.Lock()
+	defer r.Unlock()
+
+	// look again, in case it changed while unlocked
+	expiringResource, ok := r.resources[category][id]
+
+	if !ok {
+		return dr.Dr{}, dr.ErrResourceNotFound
+	}
+
+	now = r.Now()
+
+	if expired(expiringResource, now) {
+		// expired since last clean, so remove it rather than return it
+		r.remove(category, id)
+		return dr.Dr{}, dr.ErrResourceNotFound
+	}
+
+	// delete if single use
+	if !expiringResource.resource.Reusable && expiringResource.generator == nil {
+		r.remove(category, id)
+	}
+
+	return r.got(ctx, expiringResource, now)
+}
+
+// got returns a resource with its TTL up to date, or a new one minted from
+// it if it is a template. Caller must hold the lock.
+func (r *RamStorage) got(ctx context.Context, expiringResource expiringResource, now int64) (dr.Dr, error) {
+
+	expiringResource.used.Store(r.uses.Add(1))
+
+	expiringResource.resource = remaining(expiringResource, now)
+
+	// templates mint a new resource instead of being used up
+	if expiringResource.generator != nil {
+		return r.mint(ctx, expiringResource)
 	}
 
+	return expiringResource.resource, nil
 }
 
 func (r *RamStorage) HealthCheck() error {
+	return r.HealthCheckContext(context.Background())
+}
+
+func (r *RamStorage) HealthCheckContext(ctx context.Context) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	r.RLock()
 	defer r.RUnlock()
@@ -210,11 +613,19 @@ func (r *RamStorage) HealthCheck() error {
 }
 
 func (r *RamStorage) List(category string) (map[string]dr.Dr, error) {
+	return r.ListContext(context.Background(), category)
+}
+
+func (r *RamStorage) ListContext(ctx context.Context, category string) (map[string]dr.Dr, error) {
 
 	publicList := make(map[string]dr.Dr)
 
-	r.Lock() //need a write lock because we might clean stale entries
-	defer r.Unlock()
+	if err := ctx.Err(); err != nil {
+		return publicList, err
+	}
+
+	unlock := r.readLock(func(c string) bool { return c == category })
+	defer unlock()
 
 	// existence check
 	if _, ok := r.resources[category]; !ok {
@@ -226,41 +637,246 @@ func (r *RamStorage) List(category string) (map[string]dr.Dr, error) {
 		return publicList, dr.ErrEmptyList
 	}
 
+	now := r.Now()
+
 	// return list omitting details of the resource
 
 	for id, expiringResource := range r.resources[category] {
+		if expired(expiringResource, now) {
+			continue //since readLock looked, to be cleaned next time
+		}
+		publicResource := remaining(expiringResource, now)
+		publicResource.Resource = ""
+		publicList[id] = publicResource
+	}
+
+	return publicList, nil
+}
+
+func (r *RamStorage) ListMatching(pattern string) (map[string]map[string]dr.Dr, error) {
+	return r.ListMatchingContext(context.Background(), pattern)
+}
+
+// ListMatchingContext lists every category matching the pattern, omitting
+// categories that have emptied since they were last cleaned
+func (r *RamStorage) ListMatchingContext(ctx context.Context, pattern string) (map[string]map[string]dr.Dr, error) {
+
+	lists := make(map[string]map[string]dr.Dr)
+
+	if err := ctx.Err(); err != nil {
+		return lists, err
+	}
+
+	unlock := r.readLock(func(c string) bool { return dr.MatchCategory(pattern, c) })
+	defer unlock()
+
+	now := r.Now()
+
+	for category, resources := range r.resources {
+
+		if !dr.MatchCategory(pattern, category) {
+			continue
+		}
+
+		for id, expiringResource := range resources {
+			if expired(expiringResource, now) {
+				continue
+			}
+			if _, ok := lists[category]; !ok {
+				lists[category] = make(map[string]dr.Dr)
+			}
+			publicResource := remaining(expiringResource, now)
+			publicResource.Resource = ""
+			lists[category][id] = publicResource
+		}
+	}
+
+	if len(lists) == 0 {
+		return lists, dr.ErrResourceNotFound
+	}
+
+	return lists, nil
+}
+
+func (r *RamStorage) ListPage(category string, options dr.ListOptions) (dr.Page, error) {
+	return r.ListPageContext(context.Background(), category, options)
+}
 
-		//clean stale entries
+func (r *RamStorage) ListPageContext(ctx context.Context, category string, options dr.ListOptions) (dr.Page, error) {
 
-		expired := false
+	page := dr.Page{Resources: []dr.Dr{}}
 
-		if expiringResource.validUntil > 0 {
-			// expirable
-			newTTL := expiringResource.validUntil - r.Now()
-			if newTTL < 0 {
-				expired = true
-				delete(r.resources[category], id)
-				if len(r.resources[category]) == 0 {
-					delete(r.resources, category)
+	if options.Sort == "" {
+		options.Sort = dr.SortByID
+	}
+
+	if _, ok := sortKeys[options.Sort]; !ok {
+		return page, dr.ErrIllegalSort
+	}
+
+	var after *cursor
+
+	if options.Cursor != "" {
+		c, err := decodeCursor(options.Cursor)
+		if err != nil || c.Sort != options.Sort || c.Descending != options.Descending {
+			return page, dr.ErrIllegalCursor
+		}
+		after = &c
+	}
+
+	if err := ctx.Err(); err != nil {
+		return page, err
+	}
+
+	unlock := r.readLock(func(c string) bool { return c == category })
+	defer unlock()
+
+	// existence check
+	if _, ok := r.resources[category]; !ok {
+		return page, dr.ErrResourceNotFound
+	}
+
+	now := r.Now()
+	positions := []cursor{}
+
+	for _, expiringResource := range r.resources[category] {
+		if expired(expiringResource, now) {
+			continue
+		}
+		c := position(expiringResource, options)
+		if after == nil || after.before(c) {
+			positions = append(positions, c)
+		}
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].before(positions[j])
+	})
+
+	if options.Limit > 0 && len(positions) > options.Limit {
+		positions = positions[:options.Limit]
+		page.Next = encodeCursor(positions[len(positions)-1])
+	}
+
+	for _, c := range positions {
+		publicResource := remaining(r.resources[category][c.ID], now)
+		publicResource.Resource = ""
+		page.Resources = append(page.Resources, publicResource)
+	}
+
+	return page, nil
+}
+
+// clean removes stale entries from a category. The rest keep their TTL as
+// an expiry time, which remaining turns back into a TTL when they are read.
+// Caller must hold the write lock.
+func (r *RamStorage) clean(category string) {
+
+	now := r.Now()
+
+	for id, expiringResource := range r.resources[category] {
+		if expired(expiringResource, now) {
+			r.remove(category, id)
+		}
+	}
+}
+
+// expired reports whether a resource has run out of TTL
+func expired(e expiringResource, now int64) bool {
+	return e.validUntil > 0 && e.validUntil < now
+}
+
+func everyCategory(string) bool {
+	return true
+}
+
+// readLock takes the read lock, unless any of the wanted categories has
+// stale entries, in which case it takes the write lock and cleans them, so
+// that readers only hold each other up when there is cleaning to do. It
+// returns the matching unlock. Readers must still skip entries that expire
+// while they hold the read lock.
+func (r *RamStorage) readLock(wanted func(string) bool) func() {
+
+	r.RLock()
+
+	now := r.Now()
+
+	for category, resources := range r.resources {
+
+		if !wanted(category) {
+			continue
+		}
+
+		for _, expiringResource := range resources {
+
+			if !expired(expiringResource, now) {
+				continue
+			}
+
+			r.RUnlock()
+			r.Lock()
+
+			for category := range r.resources {
+				if wanted(category) {
+					r.clean(category)
 				}
-			} else {
-				// update TTL
-				temp := r.resources[category][id]
-				temp.resource.TTL = newTTL
-				r.resources[category][id] = temp
 			}
 
+			return r.Unlock
 		}
+	}
 
-		if !expired {
-			publicResource := r.resources[category][id].resource
-			publicResource.Resource = ""
-			publicList[id] = publicResource
+	return r.RUnlock
+}
+
+var sortKeys = map[string]func(expiringResource) int64{
+	dr.SortByID: func(e expiringResource) int64 {
+		return 0
+	},
+	dr.SortByExpiry: func(e expiringResource) int64 {
+		if e.validUntil == 0 {
+			return math.MaxInt64 //never expires
 		}
+		return e.validUntil
+	},
+	dr.SortByAdded: func(e expiringResource) int64 {
+		return int64(e.added)
+	},
+}
 
+func position(e expiringResource, options dr.ListOptions) cursor {
+	return cursor{
+		Sort:       options.Sort,
+		Descending: options.Descending,
+		Key:        sortKeys[options.Sort](e),
+		ID:         e.resource.ID,
 	}
+}
 
-	return publicList, nil
+// before reports whether c comes before d in the requested order
+func (c cursor) before(d cursor) bool {
+	if c.Descending {
+		c, d = d, c
+	}
+	if c.Key != d.Key {
+		return c.Key < d.Key
+	}
+	return c.ID < d.ID
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
 }
 
 func New() dr.Storage {
@@ -268,10 +884,55 @@ func New() dr.Storage {
 	return &r
 }
 
+// NewWithClock is New with a clock that can be faked in tests, so that
+// resources expire without waiting for them
+func NewWithClock(clock clockwork.Clock) dr.Storage {
+	r := RamStorage{resources: make(map[string]map[string]expiringResource), clock: clock}
+	return &r
+}
+
+func (r *RamStorage) Notify(category string) <-chan struct{} {
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.arrivals == nil {
+		r.arrivals = make(map[string]chan struct{})
+	}
+
+	if _, ok := r.arrivals[category]; !ok {
+		r.arrivals[category] = make(chan struct{})
+	}
+
+	return r.arrivals[category]
+}
+
 func (r *RamStorage) Reset() error {
+	return r.ResetContext(context.Background())
+}
+
+func (r *RamStorage) ResetContext(ctx context.Context) error {
 
 	r.Lock()
+	if err := ctx.Err(); err != nil {
+		r.Unlock()
+		return err
+	}
+	if r.grace > 0 {
+		r.purge()
+		for category, resources := range r.resources {
+			for id := range resources {
+				r.discard(category, id)
+			}
+		}
+	}
 	r.resources = make(map[string]map[string]expiringResource)
+	r.count, r.bytes = 0, 0
+	r.labels = nil
+	for _, arrival := range r.arrivals {
+		close(arrival) // let waiters see the reset
+	}
+	r.arrivals = make(map[string]chan struct{})
 	r.Unlock()
 
 	return r.HealthCheck()
@@ -0,0 +1,78 @@
+package ram
+
+import (
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/schema"
+)
+
+// Schemas survive Reset, like policies
+
+type categorySchema struct {
+	text     string
+	compiled *schema.Schema
+}
+
+func (r *RamStorage) DeleteSchema(category string) error {
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.schemas[category]; !ok {
+		return dr.ErrSchemaNotFound
+	}
+
+	delete(r.schemas, category)
+
+	return nil
+}
+
+func (r *RamStorage) GetSchema(category string) (string, error) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if s, ok := r.schemas[category]; ok {
+		return s.text, nil
+	}
+
+	return "", dr.ErrSchemaNotFound
+}
+
+func (r *RamStorage) Schemas() (map[string]string, error) {
+
+	schemas := make(map[string]string)
+
+	r.RLock()
+	defer r.RUnlock()
+
+	for category, s := range r.schemas {
+		schemas[category] = s.text
+	}
+
+	return schemas, nil
+}
+
+// SetSchema applies to resources added from now on; those already in the
+// category are left alone
+func (r *RamStorage) SetSchema(category string, text string) error {
+
+	if category == "" {
+		return dr.ErrUndefinedCategory
+	}
+
+	compiled, err := schema.Compile(category, text)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.schemas == nil {
+		r.schemas = make(map[string]categorySchema)
+	}
+
+	r.schemas[category] = categorySchema{text: text, compiled: compiled}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package ram
+
+import (
+	"context"
+
+	"github.com/timdrysdale/dr"
+)
+
+// AddTemplate adds a template that is listed like any other single-use
+// resource, but mints a new one with its generator on every Get
+func (r *RamStorage) AddTemplate(template dr.Dr, generator dr.Generator) error {
+
+	if generator == nil || template.Reusable {
+		return dr.ErrIllegalTemplate
+	}
+
+	if err := validate(template); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	template, err := r.admit(template, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := r.makeRoom([]dr.Dr{template}); err != nil {
+		return err
+	}
+
+	r.put(template)
+
+	expiringResource := r.resources[template.Category][template.ID]
+	expiringResource.generator = generator
+	r.resources[template.Category][template.ID] = expiringResource
+
+	return nil
+}
+
+// mint makes a resource from a template, with the TTL the template has left,
+// leaving the template in place. Caller must hold the lock, which may be the
+// read lock, shared with other Gets minting from the same template.
+func (r *RamStorage) mint(ctx context.Context, template expiringResource) (dr.Dr, error) {
+
+	resource := template.resource
+	resource.Labels = copyLabels(resource.Labels)
+
+	var minted string
+	var err error
+
+	if generator, ok := template.generator.(dr.ContextGenerator); ok {
+		minted, err = generator.GenerateContext(ctx, resource)
+	} else {
+		minted, err = template.generator.Generate(resource)
+	}
+
+	if err != nil {
+		return dr.Dr{}, err
+	}
+
+	resource.Resource = minted
+
+	return resource, nil
+}
@@ -0,0 +1,59 @@
+package ram
+
+import (
+	"sort"
+
+	"github.com/timdrysdale/dr"
+)
+
+// Tenant returns the storage for the named tenant, creating it on first use,
+// unless that would go over Limits.Tenants, when it returns dr.ErrStorageFull
+func (r *RamStorage) Tenant(name string) (dr.Storage, error) {
+
+	if !dr.LegalTenant(name) {
+		return nil, dr.ErrIllegalTenant
+	}
+
+	if name == "" {
+		return r, nil
+	}
+
+	r.tenantsLock.Lock()
+	defer r.tenantsLock.Unlock()
+
+	if r.tenants == nil {
+		r.tenants = make(map[string]*RamStorage)
+	}
+
+	if _, ok := r.tenants[name]; !ok {
+
+		limits := r.Limits()
+		if limits.Tenants > 0 && len(r.tenants) >= limits.Tenants {
+			return nil, dr.ErrStorageFull
+		}
+
+		tenant := New().(*RamStorage)
+		tenant.clock = r.clock
+		tenant.grace, _ = r.GracePeriod() //new tenants start off like the default
+		tenant.limits = limits
+		r.tenants[name] = tenant
+	}
+
+	return r.tenants[name], nil
+}
+
+func (r *RamStorage) Tenants() ([]string, error) {
+
+	r.tenantsLock.Lock()
+	defer r.tenantsLock.Unlock()
+
+	names := []string{}
+
+	for name := range r.tenants {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
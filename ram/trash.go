@@ -0,0 +1,202 @@
+package ram
+
+import "github.com/timdrysdale/dr"
+
+type trashedResource struct {
+	expiringResource
+	purgeAt int64
+}
+
+func (r *RamStorage) GracePeriod() (int64, error) {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.grace, nil
+}
+
+// SetGracePeriod keeps resources deleted from now on in the trash for that
+// many seconds. Shortening it purges anything already kept for longer.
+func (r *RamStorage) SetGracePeriod(seconds int64) error {
+
+	if seconds < 0 {
+		return dr.ErrIllegalGracePeriod
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.Now()
+
+	for _, trashed := range r.trash {
+		for id, t := range trashed {
+			if t.purgeAt > now+seconds {
+				t.purgeAt = now + seconds
+				trashed[id] = t
+			}
+		}
+	}
+
+	r.grace = seconds
+	r.purge()
+
+	return nil
+}
+
+// Trash lists what is in the trash, with the TTL each resource has left, and
+// without the Resource, as for List
+func (r *RamStorage) Trash() (map[string]map[string]dr.Dr, error) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.purge()
+
+	lists := make(map[string]map[string]dr.Dr)
+
+	for category, trashed := range r.trash {
+		lists[category] = make(map[string]dr.Dr)
+		for id, t := range trashed {
+			resource := remaining(t.expiringResource, r.Now())
+			resource.Resource = ""
+			lists[category][id] = resource
+		}
+	}
+
+	return lists, nil
+}
+
+// Restore puts a resource back from the trash, unless another with the same
+// ID has been added in the meantime
+func (r *RamStorage) Restore(category string, id string) (dr.Dr, error) {
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.purge()
+
+	t, ok := r.trash[category][id]
+	if !ok {
+		return dr.Dr{}, dr.ErrResourceNotFound
+	}
+
+	if _, ok := r.fresh(category, id); ok {
+		return dr.Dr{}, dr.ErrResourceExists
+	}
+
+	resource := remaining(t.expiringResource, r.Now())
+
+	// out of the trash first, so it isn't counted twice, or evicted
+	r.untrash(category, id)
+
+	if err := r.makeRoom([]dr.Dr{resource}); err != nil {
+		r.intoTrash(category, id, t)
+		return dr.Dr{}, err
+	}
+
+	r.put(resource)
+
+	restored := r.resources[category][id]
+	restored.generator = t.generator //so templates carry on minting
+	r.resources[category][id] = restored
+
+	return resource, nil
+}
+
+// discard moves a resource to the trash, if there is one, and removes it.
+// Callers purge the trash first, once for all they discard, so it doesn't
+// fill up with the long since purgeable. Caller must hold the write lock.
+func (r *RamStorage) discard(category string, id string) {
+
+	if e, ok := r.resources[category][id]; ok && r.grace > 0 {
+		r.untrash(category, id) //an older one with the same ID
+		r.intoTrash(category, id, trashedResource{e, r.Now() + r.grace})
+	}
+
+	r.remove(category, id)
+}
+
+// intoTrash puts a resource in the trash, counting it towards the limits.
+// Caller must hold the write lock.
+func (r *RamStorage) intoTrash(category string, id string, t trashedResource) {
+
+	if r.trash == nil {
+		r.trash = make(map[string]map[string]trashedResource)
+	}
+
+	if _, ok := r.trash[category]; !ok {
+		r.trash[category] = make(map[string]trashedResource)
+	}
+
+	r.trash[category][id] = t
+
+	r.trashedCount++
+	r.trashedBytes += size(t.resource)
+}
+
+// untrash takes a resource out of the trash, if it is there, and its
+// category if that is now empty. Caller must hold the write lock.
+func (r *RamStorage) untrash(category string, id string) {
+
+	if t, ok := r.trash[category][id]; ok {
+		r.trashedCount--
+		r.trashedBytes -= size(t.resource)
+	}
+
+	delete(r.trash[category], id)
+
+	if len(r.trash[category]) == 0 {
+		delete(r.trash, category)
+	}
+}
+
+// dropTrash purges whatever would be purged soonest from the trash, to make
+// room. Caller must hold the write lock.
+func (r *RamStorage) dropTrash() bool {
+
+	var category, id string
+	found := false
+	soonest := int64(0)
+
+	for c, trashed := range r.trash {
+		for i, t := range trashed {
+			if !found || t.purgeAt < soonest {
+				category, id, found, soonest = c, i, true, t.purgeAt
+			}
+		}
+	}
+
+	if found {
+		r.untrash(category, id)
+	}
+
+	return found
+}
+
+// purge empties the trash of anything past its grace period, or expired.
+// Caller must hold the write lock.
+func (r *RamStorage) purge() {
+
+	now := r.Now()
+
+	for category, trashed := range r.trash {
+		for id, t := range trashed {
+			if t.purgeAt <= now || (t.validUntil > 0 && t.validUntil <= now) {
+				r.untrash(category, id)
+			}
+		}
+	}
+}
+
+// remaining gives a resource the TTL it has left, which callers have already
+// made sure is some, by purging or cleaning
+func remaining(e expiringResource, now int64) dr.Dr {
+
+	resource := e.resource
+
+	if e.validUntil > 0 {
+		resource.TTL = e.validUntil - now
+	}
+
+	return resource
+}
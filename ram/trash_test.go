@@ -0,0 +1,27 @@
+package ram
+
+import (
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+func TestTakenIncludesTrash(t *testing.T) {
+
+	r := New().(*RamStorage)
+	r.SetGracePeriod(60)
+
+	r.Add(dr.Dr{Category: "a", ID: "x"})
+	r.Add(dr.Dr{Category: "a", ID: "y"})
+	r.Delete("a", "y")
+
+	r.RLock()
+	defer r.RUnlock()
+
+	// a generated ID in the trash would be overwritten by restoring it
+	for id, want := range map[string]bool{"x": true, "y": true, "z": false} {
+		if got := r.taken("a", id); got != want {
+			t.Errorf("%s: wanted taken %v, got %v", id, want, got)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package restapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timdrysdale/dr"
+)
+
+// Destructive sets how requests that delete everything, or a whole category,
+// are guarded against accidents
+type Destructive int
+
+const (
+	// DestructiveConfirm, the default, answers such a request with 428
+	// Precondition Required, what it would delete, and a token, which
+	// confirms it if the request is repeated with confirm=<token> before
+	// the token expires
+	DestructiveConfirm Destructive = iota
+	DestructiveAllow               // as any other request
+	DestructiveDeny                // refused with 403 Forbidden
+)
+
+// confirmTTL is how long a confirmation token is good for
+const confirmTTL = 60 * time.Second
+
+var errDestructiveDenied = errors.New("destructive operations are turned off on this server")
+var errIllegalConfirmation = errors.New("confirmation token is not for this request, has been used, or has expired, or what it would delete has changed")
+
+// Confirmation is the reply to a dry run, or to a request that needs confirming
+type Confirmation struct {
+	Confirm string              `json:",omitempty"` // to repeat the request with, as confirm=<token>
+	Expires int64               `json:",omitempty"` // seconds until the token expires
+	Deletes map[string][]string // IDs, by category, that would be deleted
+}
+
+// guard decides whether destructive requests can go ahead. Its tokens are
+// signed with a key of its own, so they can't be forged, or used on another
+// server, or tenant. Each confirms what was previewed, and can only be used
+// once, so it is remembered as spent until it expires.
+type guard struct {
+	destructive Destructive
+	key         []byte
+	now         func() time.Time
+	spent       map[string]time.Time // token, and when it expires
+	sync.Mutex
+}
+
+func newGuard(destructive Destructive) *guard {
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) //no randomness means no safe way to go on
+	}
+
+	return &guard{destructive: destructive, key: key, now: time.Now, spent: make(map[string]time.Time)}
+}
+
+// allow reports whether a destructive request can go ahead. If not, it has
+// answered the request, with what would be deleted, from preview, when the
+// request is a dry run (dry-run=true) or needs confirming.
+func (g *guard) allow(w http.ResponseWriter, r *http.Request, preview func() (map[string][]string, error)) bool {
+
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+
+	if g.destructive == DestructiveDeny {
+		http.Error(w, errDestructiveDenied.Error(), http.StatusForbidden)
+		return false
+	}
+
+	if !dryRun && g.destructive == DestructiveAllow {
+		return true
+	}
+
+	deletes, err := preview()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if token := r.URL.Query().Get("confirm"); !dryRun && token != "" {
+		if !g.valid(r, token, deletes) || !g.spend(token) {
+			http.Error(w, errIllegalConfirmation.Error(), http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+
+	confirmation := Confirmation{Deletes: deletes}
+	status := http.StatusOK
+
+	if !dryRun {
+		confirmation.Confirm = g.token(r, g.now().Add(confirmTTL), deletes)
+		confirmation.Expires = int64(confirmTTL / time.Second)
+		status = http.StatusPreconditionRequired
+	}
+
+	output, err := json.Marshal(confirmation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+
+	return false
+}
+
+// token signs the request, less any confirm or dry-run, what it would
+// delete, and its expiry
+func (g *guard) token(r *http.Request, expires time.Time, deletes map[string][]string) string {
+
+	query := r.URL.Query()
+	query.Del("confirm")
+	query.Del("dry-run")
+
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(r.Method + "\n" + r.URL.Path + "\n" + query.Encode() + "\n" + expiry))
+
+	categories := []string{}
+	for category := range deletes {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	// IDs are sorted already, and neither they nor categories have commas
+	for _, category := range categories {
+		mac.Write([]byte("\n" + category + ":" + strings.Join(deletes[category], ",")))
+	}
+
+	return expiry + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (g *guard) valid(r *http.Request, token string, deletes map[string][]string) bool {
+
+	parts := strings.SplitN(token, ".", 2)
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return false
+	}
+
+	expires := time.Unix(seconds, 0)
+
+	if !g.now().Before(expires) {
+		return false
+	}
+
+	return hmac.Equal([]byte(token), []byte(g.token(r, expires, deletes)))
+}
+
+// spend reports whether the token is yet to be used, and remembers that it
+// has been, forgetting tokens that have expired since
+func (g *guard) spend(token string) bool {
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := g.now()
+
+	for spent, expires := range g.spent {
+		if !now.Before(expires) {
+			delete(g.spent, spent)
+		}
+	}
+
+	if _, ok := g.spent[token]; ok {
+		return false
+	}
+
+	seconds, _ := strconv.ParseInt(strings.SplitN(token, ".", 2)[0], 10, 64) //valid already
+	g.spent[token] = time.Unix(seconds, 0)
+
+	return true
+}
+
+// previewIDs lists the IDs in each category, sorted, for a preview
+func previewIDs(lists map[string]map[string]dr.Dr) map[string][]string {
+
+	deletes := make(map[string][]string)
+
+	for category, list := range lists {
+		for id := range list {
+			deletes[category] = append(deletes[category], id)
+		}
+		sort.Strings(deletes[category])
+	}
+
+	return deletes
+}
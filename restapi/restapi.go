@@ -2,33 +2,725 @@
 package restapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/jwt"
+	"github.com/timdrysdale/dr/limit"
+	"github.com/timdrysdale/dr/ndjson"
+	"github.com/timdrysdale/dr/schema"
+	"github.com/timdrysdale/dr/seal"
+	"github.com/timdrysdale/dr/wait"
 )
 
 const pageNotFound = "page not found"
+const notImplemented = "not implemented by this storage"
 
-func handleResourcesDelete(w http.ResponseWriter, r *http.Request, store dr.Storage) {
-	err := store.Reset()
+// maxWait limits how long a client can hold a connection open waiting for resources
+const maxWait = 60 * time.Second
+
+func handleResourcesDelete(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, guard *guard) {
+
+	preview := func() (map[string][]string, error) {
+		lists, err := store.ListMatchingContext(r.Context(), dr.AnyDepth)
+		if err == dr.ErrResourceNotFound {
+			err = nil //nothing to delete
+		}
+		return previewIDs(lists), err
+	}
+
+	if !guard.allow(w, r, preview) {
+		return
+	}
+
+	err := store.ResetContext(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleResourcesGet counts the resources in every category, and at every
+// level of the hierarchy above it, optionally only for those matching
+// ?match=<pattern>, e.g. ?match=labs/**, and only counting resources
+// with labels that meet ?selector=<selector>, e.g. ?selector=lab=ed
+func handleResourcesGet(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+
+	selector, selecting, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pattern := r.URL.Query().Get("match")
+
+	// list everything we have, in compact form!
+	var everything map[string]int
+
+	switch {
+	case selecting:
+		everything, err = store.CategoriesSelectedContext(r.Context(), selector)
+		for category := range everything {
+			if pattern != "" && !dr.MatchCategory(pattern, category) {
+				delete(everything, category)
+			}
+		}
+	case pattern != "":
+		everything, err = store.CategoriesMatchingContext(r.Context(), pattern)
+	default:
+		everything, err = store.CategoriesContext(r.Context())
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(dr.CategoryLevels(everything))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+func handleCategoryDelete(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, guard *guard) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	if dr.IsPattern(category) {
+		http.Error(w, dr.ErrIllegalCategory.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode, err := batchMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview := func() (map[string][]string, error) {
+		categoryList, err := store.ListContext(r.Context(), category)
+		return previewIDs(map[string]map[string]dr.Dr{category: categoryList}), err
+	}
+
+	if !guard.allow(w, r, preview) {
+		return
+	}
+
+	categoryList, err := store.ListContext(r.Context(), category)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ids := []string{}
+	for id, _ := range categoryList {
+		ids = append(ids, id)
+	}
+
+	results, err := store.DeleteBatchContext(r.Context(), category, ids, mode)
+
+	writeBatchResults(w, results, err)
+}
+
+func handleCategoryGet(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, limits *limit.Limiter) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	selector, selecting, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dr.IsPattern(category) {
+		handleCategoryGetMatching(w, r, store)
+		return
+	}
+
+	_, waiting := r.URL.Query()["wait"]
+
+	if selecting && (waiting || isPageRequest(r)) {
+		http.Error(w, "selector cannot be combined with wait or paging", http.StatusBadRequest)
+		return
+	}
+
+	if waiting {
+		handleCategoryGetWait(w, r, store, limits)
+		return
+	}
+
+	if isPageRequest(r) {
+		handleCategoryGetPage(w, r, store)
+		return
+	}
+
+	var categoryList map[string]dr.Dr
+
+	if selecting {
+		categoryList, err = store.ListSelectedContext(r.Context(), category, selector)
+	} else {
+		categoryList, err = store.ListContext(r.Context(), category)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(categoryList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// handleCategoryGetMatching lists every category matching a pattern such as
+// labs/*/pendulum or labs/**, by category and then ID
+func handleCategoryGetMatching(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+	vars := mux.Vars(r)
+	pattern := vars["category"]
+
+	selector, _, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lists, err := store.ListMatchingContext(r.Context(), pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lists = selectLists(lists, selector)
+
+	if len(lists) == 0 {
+		http.Error(w, dr.ErrResourceNotFound.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(lists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// handleSearch lists resources in any category with labels that meet
+// ?selector=<selector>, optionally only in categories matching ?match=<pattern>
+func handleSearch(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+
+	selector, _, err := selectorParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lists, err := store.SearchContext(r.Context(), selector)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if pattern := r.URL.Query().Get("match"); pattern != "" {
+		for category := range lists {
+			if !dr.MatchCategory(pattern, category) {
+				delete(lists, category)
+			}
+		}
+	}
+
+	output, err := json.Marshal(lists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// selectorParam reads ?selector=, reporting whether there was one
+func selectorParam(r *http.Request) (dr.Selector, bool, error) {
+
+	if _, ok := r.URL.Query()["selector"]; !ok {
+		return dr.Selector{}, false, nil
+	}
+
+	selector, err := dr.ParseSelector(r.URL.Query().Get("selector"))
+
+	return selector, true, err
+}
+
+// selectLists keeps only the resources that meet the selector, dropping
+// categories left with none
+func selectLists(lists map[string]map[string]dr.Dr, selector dr.Selector) map[string]map[string]dr.Dr {
+
+	selected := make(map[string]map[string]dr.Dr)
+
+	for category, list := range lists {
+		for id, resource := range list {
+			if !selector.Matches(resource.Labels) {
+				continue
+			}
+			if _, ok := selected[category]; !ok {
+				selected[category] = make(map[string]dr.Dr)
+			}
+			selected[category][id] = resource
+		}
+	}
+
+	return selected
+}
+
+// handleCategoryGetPage lists a category one page at a time, e.g.
+// ?sort=expiry&order=desc&limit=100&cursor=<next from previous page>
+func handleCategoryGetPage(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	options, err := listOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := store.ListPageContext(r.Context(), category, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// handleCategoryGetWait long-polls an empty category, e.g. ?wait=30s (or ?wait=30)
+// lists the category as soon as it has something in it, and ?wait=30s&take=true
+// returns one resource from it, as if it had been got by ID
+func handleCategoryGetWait(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, limits *limit.Limiter) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	timeout, err := waitDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if r.URL.Query().Get("take") == "true" {
+
+		publicKey, err := sealTo(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !takeQuota(w, r, limits, category) {
+			return
+		}
+
+		resource, err := wait.Take(ctx, store, category)
+		refundQuota(r, limits, category, resource, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeResource(w, resource, publicKey)
+		return
+	}
+
+	categoryList, err := wait.List(ctx, store, category)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if isPageRequest(r) {
+		handleCategoryGetPage(w, r, store)
+		return
+	}
+
+	output, err := json.Marshal(categoryList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+func waitDuration(s string) (time.Duration, error) {
+
+	d, err := time.ParseDuration(s)
+
+	if err != nil {
+		seconds, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, errors.New("Illegal wait: " + s)
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+
+	if d < 0 {
+		return 0, errors.New("Illegal wait: " + s)
+	}
+
+	if d > maxWait {
+		d = maxWait
+	}
+
+	return d, nil
+}
+
+func isPageRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, key := range []string{"cursor", "limit", "order", "sort"} {
+		if _, ok := query[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func listOptions(r *http.Request) (dr.ListOptions, error) {
+	query := r.URL.Query()
+
+	options := dr.ListOptions{
+		Cursor: query.Get("cursor"),
+		Sort:   query.Get("sort"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return options, errors.New("Illegal limit: " + limit)
+		}
+		options.Limit = n
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		options.Descending = true
+	default:
+		return options, dr.ErrIllegalSort
+	}
+
+	return options, nil
+}
+
+func handleCategoryPost(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, schemas dr.SchemaStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	if r.URL.Query().Get("generate") == "true" {
+		handleCategoryPostGenerate(w, r, store, schemas)
+		return
+	}
+
+	mode, err := batchMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+
+	// see stackoverflow.com/questions/11066946/partly-json-unmarshal-into-a-map-in-go
+	var resources map[string]*json.RawMessage
+
+	err = json.Unmarshal(b, &resources)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// check the whole upload before adding any of it
+	batch := []dr.Dr{}
+
+	for id, _ := range resources {
+
+		var resource dr.Dr
+
+		err = json.Unmarshal(*resources[id], &resource)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if resource.Category != category { //avoid cross end-point permission attacks
+			http.Error(w, dr.ErrIllegalCategory.Error()+":"+resource.Category, http.StatusInternalServerError)
+			return
+		}
+		if resource.ID != id { //conflicted id
+			http.Error(w, dr.ErrUndefinedID.Error()+": did you mean "+resource.ID+" or "+id+"?", http.StatusInternalServerError)
+			return
+		}
+
+		batch = append(batch, resource)
+	}
+
+	if problems := checkDescriptions(category, batch, schemas); len(problems) > 0 {
+		writeSchemaProblems(w, problems)
+		return
+	}
+
+	results, err := store.AddBatchContext(r.Context(), batch, mode)
+
+	writeBatchResults(w, results, err)
+}
+
+// handleCategoryPostGenerate adds a single resource without an ID, e.g.
+// ?generate=true, and replies 201 Created with the ID it was given, in the
+// body and in the Location header
+func handleCategoryPostGenerate(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, schemas dr.SchemaStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	b, err := ioutil.ReadAll(r.Body)
+
+	var resource dr.Dr
+
+	err = json.Unmarshal(b, &resource)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if resource.Category != category { //avoid cross end-point permission attacks
+		http.Error(w, dr.ErrIllegalCategory.Error()+":"+resource.Category, http.StatusInternalServerError)
+		return
+	}
+	if resource.ID != "" {
+		http.Error(w, dr.ErrIllegalID.Error()+": leave ID out so one is generated", http.StatusBadRequest)
+		return
+	}
+
+	if problems := checkDescriptions(category, []dr.Dr{resource}, schemas); len(problems) > 0 {
+		writeSchemaProblems(w, problems)
+		return
+	}
+
+	resource, err = store.AddGeneratedContext(r.Context(), resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resource.Resource = "" //the supplier has it already
+
+	output, err := json.Marshal(resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("location", pathResources+"/"+resource.Category+"/"+resource.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(output)
+}
+
+// batchMode is all-or-nothing unless ?mode=best-effort
+func batchMode(r *http.Request) (dr.BatchMode, error) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "all-or-nothing":
+		return dr.AllOrNothing, nil
+	case "best-effort":
+		return dr.BestEffort, nil
+	default:
+		return dr.AllOrNothing, errors.New("Illegal mode: " + mode)
+	}
+}
+
+// writeBatchResults reports "ok" or the error for each ID in the batch, with
+// status 200 if all went well, 207 if only some did (best-effort), or 500
+func writeBatchResults(w http.ResponseWriter, results []dr.BatchResult, err error) {
+
+	if err != nil && err != dr.ErrBatchFailed {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	applied := 0
+	report := make(map[string]string)
+
+	for _, result := range results {
+		if result.Err == nil {
+			report[result.ID] = "ok"
+			applied++
+		} else {
+			report[result.ID] = result.Err.Error()
+		}
+	}
+
+	if err == dr.ErrBatchFailed {
+		status = http.StatusInternalServerError
+		if applied > 0 {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	output, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// checkDescriptions returns what is wrong with each description, by ID, if the
+// category has a schema. Storage checks again on Add, so if the schema can't
+// be had here, it is left to storage to refuse anything that doesn't match.
+func checkDescriptions(category string, resources []dr.Dr, schemas dr.SchemaStorage) map[string][]string {
+
+	problems := make(map[string][]string)
+
+	if schemas == nil {
+		return problems
+	}
+
+	text, err := schemas.GetSchema(category)
+	if err != nil || text == "" {
+		return problems
+	}
+
+	compiled, err := schema.Compile(category, text)
+	if err != nil {
+		return problems
+	}
+
+	for _, resource := range resources {
+		if err := compiled.Validate(resource.Description); err != nil {
+			if schemaErr, ok := err.(*dr.SchemaError); ok {
+				problems[resource.ID] = schemaErr.Problems
+			}
+		}
+	}
+
+	return problems
+}
+
+func writeSchemaProblems(w http.ResponseWriter, problems map[string][]string) {
+
+	output, err := json.Marshal(problems)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(output)
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+
+	w.Header().Set("content-type", "application/x-ndjson")
+
+	count, err := ndjson.Write(r.Context(), w, store)
+
+	if err != nil && count == 0 { // too late to report errors once streaming
+		w.Header().Del("content-type")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+
+	mode, err := batchMode(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	added, failed, err := ndjson.Read(r.Context(), r.Body, store, mode)
+
+	if err != nil && err != dr.ErrBatchFailed {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-}
 
-func handleResourcesGet(w http.ResponseWriter, r *http.Request, store dr.Storage) {
-	// list everything we have, in compact form!
-	everything, err := store.Categories()
+	report := struct {
+		Added  int
+		Failed map[string]string
+	}{added, make(map[string]string)}
+
+	for _, result := range failed {
+		report.Failed[result.Category+dr.Separator+result.ID] = result.Err.Error()
+	}
+
+	status := http.StatusOK
+	if err == dr.ErrBatchFailed {
+		status = http.StatusInternalServerError
+		if added > 0 {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	output, err := json.Marshal(report)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	output, err := json.Marshal(everything)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+func handlePoliciesGet(w http.ResponseWriter, r *http.Request, store dr.PolicyStorage) {
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	policies, err := store.Policies()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	output, err := json.Marshal(policies)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -38,37 +730,94 @@ func handleResourcesGet(w http.ResponseWriter, r *http.Request, store dr.Storage
 	w.Write(output)
 }
 
-func handleCategoryDelete(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handlePolicyDelete(w http.ResponseWriter, r *http.Request, store dr.PolicyStorage) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 
-	categoryList, err := store.List(category)
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	err := store.DeletePolicy(category)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
+}
 
-	for id, _ := range categoryList {
-		_, err = store.Delete(category, id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+func handlePolicyGet(w http.ResponseWriter, r *http.Request, store dr.PolicyStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	policy, err := store.GetPolicy(category)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
 
+	output, err := json.Marshal(policy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
 }
 
-func handleCategoryGet(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handlePolicyPost(w http.ResponseWriter, r *http.Request, store dr.PolicyStorage) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 
-	categoryList, err := store.List(category)
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+
+	var policy dr.Policy
+
+	err = json.Unmarshal(b, &policy)
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	output, err := json.Marshal(categoryList)
+	err = store.SetPolicy(category, policy)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+func handleSchemasGet(w http.ResponseWriter, r *http.Request, store dr.SchemaStorage) {
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	schemas, err := store.Schemas()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	// schemas are JSON already, so don't quote them as strings
+	raw := make(map[string]json.RawMessage)
+	for category, text := range schemas {
+		raw[category] = json.RawMessage(text)
+	}
+
+	output, err := json.Marshal(raw)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -78,51 +827,189 @@ func handleCategoryGet(w http.ResponseWriter, r *http.Request, store dr.Storage)
 	w.Write(output)
 }
 
-func handleCategoryPost(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handleSchemaDelete(w http.ResponseWriter, r *http.Request, store dr.SchemaStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	err := store.DeleteSchema(category)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+func handleSchemaGet(w http.ResponseWriter, r *http.Request, store dr.SchemaStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	text, err := store.GetSchema(category)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/schema+json")
+	w.Write([]byte(text))
+}
+
+// handleSchemaPost takes the JSON Schema itself as the request body
+func handleSchemaPost(w http.ResponseWriter, r *http.Request, store dr.SchemaStorage) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
 	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// see stackoverflow.com/questions/11066946/partly-json-unmarshal-into-a-map-in-go
-	var resources map[string]*json.RawMessage
-	var resource dr.Dr
+	err = store.SetSchema(category, string(b))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
 
-	err = json.Unmarshal(b, &resources)
+func handleTenantsGet(w http.ResponseWriter, r *http.Request, store dr.TenantStorage) {
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	tenants, err := store.Tenants()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
 
+	output, err := json.Marshal(tenants)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for id, _ := range resources {
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
 
-		err = json.Unmarshal(*resources[id], &resource)
+// handleTenantPost creates the tenant, if it doesn't exist already
+func handleTenantPost(w http.ResponseWriter, r *http.Request, store dr.TenantStorage) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
 
-		if resource.Category != category { //avoid cross end-point permission attacks
-			http.Error(w, dr.ErrIllegalCategory.Error()+":"+resource.Category, http.StatusInternalServerError)
-			return
-		}
-		if resource.ID != id { //conflicted id
-			http.Error(w, dr.ErrUndefinedID.Error()+": did you mean "+resource.ID+" or "+id+"?", http.StatusInternalServerError)
-			return
-		}
-		err = store.Add(resource)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	_, err := store.Tenant(tenant)
+	if err == dr.ErrIllegalTenant {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+// writeStorageError answers 501 Not Implemented if the storage turns out not
+// to have an optional feature after all, e.g. a decorator of storage that
+// doesn't, or else 500 Internal Server Error
+func writeStorageError(w http.ResponseWriter, err error) {
+
+	if errors.Is(err, dr.ErrNotSupported) {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func handleTrashGet(w http.ResponseWriter, r *http.Request, store dr.TrashStorage) {
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	trash, err := store.Trash()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	output, err := json.Marshal(trash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+func handleTrashRestore(w http.ResponseWriter, r *http.Request, store dr.TrashStorage) {
+	vars := mux.Vars(r)
+	category := vars["category"]
+	ID := vars["id"]
+
+	if store == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	resource, err := store.Restore(category, ID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	output, err := json.Marshal(resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request, keys *jwt.KeySet) {
 
+	if keys == nil {
+		http.Error(w, notImplemented, http.StatusNotImplemented)
+		return
+	}
+
+	output, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("content-type", "application/jwk-set+json")
+	w.Write(output)
 }
 
-func handleHealthcheck(w http.ResponseWriter, r *http.Request, store dr.Storage) {
-	err := store.HealthCheck()
+func handleHealthcheck(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
+	err := store.HealthCheckContext(r.Context())
 	if err == nil {
 		w.Write([]byte("{\"status\":\"ok\"}"))
 	} else {
@@ -131,12 +1018,12 @@ func handleHealthcheck(w http.ResponseWriter, r *http.Request, store dr.Storage)
 	}
 }
 
-func handleIDDelete(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handleIDDelete(w http.ResponseWriter, r *http.Request, store dr.ContextStorage) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 	ID := vars["id"]
 
-	_, err := store.Delete(category, ID)
+	_, err := store.DeleteContext(r.Context(), category, ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -144,17 +1031,124 @@ func handleIDDelete(w http.ResponseWriter, r *http.Request, store dr.Storage) {
 
 }
 
-func handleIDGet(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handleIDGet(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, limits *limit.Limiter) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 	ID := vars["id"]
 
-	resource, err := store.Get(category, ID)
+	// check the key before getting, so a bad one doesn't use up the resource
+	publicKey, err := sealTo(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !takeQuota(w, r, limits, category) {
+		return
+	}
+
+	resource, err := store.GetContext(r.Context(), category, ID)
+	refundQuota(r, limits, category, resource, err)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	writeResource(w, resource, publicKey)
+}
+
+// consumerOf names who is asking, for limits, falling back to their address
+// if they didn't say
+func consumerOf(r *http.Request) string {
+
+	if consumer := dr.Consumer(r.Context()); consumer != "" {
+		return consumer
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// takeQuota uses up one of the consumer's quota of single-use resources
+// before one is revealed, or refuses the request if there is none left
+func takeQuota(w http.ResponseWriter, r *http.Request, limits *limit.Limiter, category string) bool {
+
+	if limits == nil {
+		return true
+	}
+
+	status, err := limits.Take(consumerOf(r), category)
+	writeLimitHeaders(w, "X-Quota-", status)
+
+	if err != nil {
+		writeTooManyRequests(w, status, err)
+		return false
+	}
+
+	return true
+}
+
+// refundQuota gives back the quota taken for a request that did not reveal
+// a single-use resource after all
+func refundQuota(r *http.Request, limits *limit.Limiter, category string, resource dr.Dr, err error) {
+	if limits != nil && (err != nil || resource.Reusable) {
+		limits.Refund(consumerOf(r), category)
+	}
+}
+
+// writeLimitHeaders reports on the limits that applied, if any did
+func writeLimitHeaders(w http.ResponseWriter, prefix string, status limit.Status) {
+
+	if status.Limit == 0 {
+		return
+	}
+
+	w.Header().Set(prefix+"Limit", strconv.Itoa(status.Limit))
+	w.Header().Set(prefix+"Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set(prefix+"Reset", strconv.Itoa(seconds(status.Reset)))
+}
+
+func writeTooManyRequests(w http.ResponseWriter, status limit.Status, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(status.Reset)))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// seconds rounds up, so clients that wait that long aren't refused again
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// sealTo reads the public key the consumer sent, if any, for sealing the
+// Resource to, so that only they can read it
+func sealTo(r *http.Request) (*[32]byte, error) {
+
+	header := r.Header.Get(seal.PublicKeyHeader)
+
+	if header == "" {
+		return nil, nil
+	}
+
+	return seal.ParseKey(header)
+}
+
+// writeResource writes a resource that has been got, with its Resource
+// sealed to publicKey unless that is nil
+func writeResource(w http.ResponseWriter, resource dr.Dr, publicKey *[32]byte) {
+
+	if publicKey != nil {
+		var err error
+		resource, err = seal.Seal(resource, publicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(seal.SealedHeader, seal.Scheme)
+	}
+
 	output, err := json.Marshal(resource)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -165,7 +1159,7 @@ func handleIDGet(w http.ResponseWriter, r *http.Request, store dr.Storage) {
 	w.Write(output)
 }
 
-func handleIDPost(w http.ResponseWriter, r *http.Request, store dr.Storage) {
+func handleIDPost(w http.ResponseWriter, r *http.Request, store dr.ContextStorage, schemas dr.SchemaStorage) {
 	vars := mux.Vars(r)
 	category := vars["category"]
 	ID := vars["id"]
@@ -189,7 +1183,13 @@ func handleIDPost(w http.ResponseWriter, r *http.Request, store dr.Storage) {
 		http.Error(w, dr.ErrUndefinedID.Error()+": did you mean "+resource.ID+" or "+ID+"?", http.StatusInternalServerError)
 		return
 	}
-	err = store.Add(resource)
+
+	if problems := checkDescriptions(category, []dr.Dr{resource}, schemas); len(problems) > 0 {
+		writeSchemaProblems(w, problems)
+		return
+	}
+
+	err = store.AddContext(r.Context(), resource)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
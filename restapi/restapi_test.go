@@ -2,14 +2,22 @@ package restapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/jwt"
+	"github.com/timdrysdale/dr/limit"
 	"github.com/timdrysdale/dr/mock"
+	"github.com/timdrysdale/dr/ram"
+	"github.com/timdrysdale/dr/seal"
 )
 
 const overlyStrict = true
@@ -92,6 +100,31 @@ func TestHandleResourcesGetEmptyStorage(t *testing.T) {
 	}
 }
 
+func TestHandleResourcesGetLevels(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	c := map[string]int{"labs/ed/a": 1, "labs/ed/b": 2}
+	m.SetCategories(c)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources?match=labs/ed/*", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleResourcesGet(resp, req, m)
+
+	if m.GetMethod()["CategoriesMatching"] != 1 || m.GetPattern() != "labs/ed/*" {
+		t.Errorf(".CategoriesMatching() not called with pattern, got %s", m.GetPattern())
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"labs":3,"labs/ed":3,"labs/ed/a":1,"labs/ed/b":2}`)
+}
+
 type Dr struct {
 	Category    string
 	Description string
@@ -126,7 +159,7 @@ func TestHandleCategoryGet(t *testing.T) {
 		"category": category,
 	})
 
-	handleCategoryGet(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
 	if m.GetCategory() != category {
 		t.Errorf(".List() called with wrong category:\ngot:%s\nexp:%s\n",
@@ -144,438 +177,1839 @@ func TestHandleCategoryGet(t *testing.T) {
 
 }
 
-func TestHandleCategoryDelete(t *testing.T) {
+func TestHandleCategoryGetMatching(t *testing.T) {
 
 	// set up store
 	m := mock.New()
-
-	resource := dr.Dr{
-		Category:    "cat",
-		Description: "desc",
-		ID:          "id",
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	m.SetResource(resource)
-
-	//let's hope API doesn't notice that we've got inconsistency between
-	//list ID and resource.ID - else need to enhance mock to give
-	//multiple responses for multiple calls (#TODO but hopefully #YAGNI!)
-	ID1 := "some_id"
-	ID2 := "other_id"
-	l := map[string]dr.Dr{ID1: resource, ID2: resource}
-	m.SetList(l)
+	resource := dr.Dr{Category: "labs/ed/pendulum", ID: "a", Description: "desc"}
+	m.SetLists(map[string]map[string]dr.Dr{"labs/ed/pendulum": {"a": resource}})
 
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	category := "importantcategory99"
 	req, err := http.NewRequest("GET", "", nil)
 	if err != nil {
 		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
-		"category": category,
+		"category": "labs/*/pendulum",
 	})
 
-	handleCategoryDelete(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
-	if m.Method["List"] < 1 {
-		t.Errorf("Didn't call List once, but %d times\n", m.Method["List"])
-	}
-	if m.Method["Delete"] != 2 {
-		t.Errorf("Didn't call Delete twice, but %d times\n", m.Method["Delete"])
-	}
-
-	if m.GetCategory() != category {
-		t.Errorf(".Delete() called with wrong category:\ngot:%s\nexp:%s\n",
-			m.GetCategory(), category)
+	if m.GetPattern() != "labs/*/pendulum" {
+		t.Errorf(".ListMatching() called with wrong pattern: %s", m.GetPattern())
 	}
 
-	if (m.GetID() != ID1) && (m.GetID() != ID2) { //sometimes the operation order changes
-		t.Errorf(".Delete() called with wrong ID:\ngot:%s\nexp either:%s or %s\n",
-			m.GetID(), ID1, ID2)
+	obj, err := json.Marshal(resource)
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
 	}
-
 	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"labs/ed/pendulum":{"a":`+string(obj)+`}}`)
 }
 
-func TestHandleCategoryPost(t *testing.T) {
+func TestHandleCategoryDeletePattern(t *testing.T) {
 
 	// set up store
 	m := mock.New()
 
-	ID1 := "some_id"
-	ID2 := "other_id"
-
-	resource1 := dr.Dr{
-		Category:    "cat23",
-		Description: "desc",
-		ID:          ID1,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	resource2 := dr.Dr{
-		Category:    "cat23",
-		Description: "desc",
-		ID:          ID2,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
-	if err != nil {
-		t.Error(err)
-	}
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	category := "cat23"
-	r := bytes.NewReader(list)
-	req, err := http.NewRequest("POST", "", r)
+	req, err := http.NewRequest("DELETE", "", nil)
 	if err != nil {
-		t.Error(err)
+		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
-		"category": category,
+		"category": "labs/**",
 	})
 
-	handleCategoryPost(resp, req, m)
+	handleCategoryDelete(resp, req, m, newGuard(DestructiveAllow))
 
-	if m.Method["Add"] != 2 {
-		t.Errorf("Didn't call Add once, but %d times\n", m.Method["List"])
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
+	if len(m.GetMethod()) != 0 {
+		t.Errorf("storage should not be called for a pattern, got %v", m.GetMethod())
 	}
+}
 
-	checkStatusCodeIs(t, resp, http.StatusOK)
+func TestRouterHierarchy(t *testing.T) {
+
+	router := New(mock.New())
+
+	tests := []struct {
+		path     string
+		category string
+		id       string
+	}{
+		{"/api/resources/pendulum", "pendulum", ""},
+		{"/api/resources/pendulum/a", "pendulum", "a"},
+		{"/api/resources/labs/ed/pendulum/", "labs/ed/pendulum", ""},
+		{"/api/resources/labs/ed/pendulum/a", "labs/ed/pendulum", "a"},
+		{"/api/resources/labs/*/pendulum", "labs/*/pendulum", ""},
+		{"/api/resources/labs/**", "labs/**", ""},
+		// before categories were hierarchical this was ID "b/" in category
+		// a, the only way the route let an ID have a slash (see README)
+		{"/api/resources/a/b/", "a/b", ""},
+		{"/api/resources/a/b/c-1", "a/b", "c-1"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		var match mux.RouteMatch
+		if !router.Match(req, &match) {
+			t.Errorf("%s: no route", test.path)
+			continue
+		}
+		if match.Vars["category"] != test.category || match.Vars["id"] != test.id {
+			t.Errorf("%s: got category %q id %q, expected %q %q", test.path,
+				match.Vars["category"], match.Vars["id"], test.category, test.id)
+		}
+	}
 }
 
-func TestHandleCategoryPostCategoryError(t *testing.T) {
+func TestHandleCategoryGetSelected(t *testing.T) {
 
 	// set up store
 	m := mock.New()
+	resource := dr.Dr{Category: "cat", ID: "a", Labels: map[string]string{"lab": "ed"}}
+	m.SetList(map[string]dr.Dr{"a": resource})
 
-	ID1 := "some_id"
-	ID2 := "other_id"
-
-	resource1 := dr.Dr{
-		Category:    "secretCategory!", //Here's the cross end-point attack!
-		Description: "desc",
-		ID:          ID1,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	resource2 := dr.Dr{
-		Category:    "cat23",
-		Description: "desc",
-		ID:          ID2,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
-	if err != nil {
-		t.Error(err)
-	}
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	category := "cat23"
-	r := bytes.NewReader(list)
-	req, err := http.NewRequest("POST", "", r)
+	req, err := http.NewRequest("GET", "/api/resources/cat?selector=lab%3Ded,type!%3Dsim", nil)
 	if err != nil {
-		t.Error(err)
+		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
-		"category": category,
+		"category": "cat",
 	})
 
-	handleCategoryPost(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
-	if m.Method["Add"] == 2 {
-		t.Errorf("Didn't call Add once, but %d times\n", m.Method["List"])
+	expected := dr.Selector{{Key: "lab", Operator: dr.Equals, Value: "ed"}, {Key: "type", Operator: dr.NotEquals, Value: "sim"}}
+	if m.GetMethod()["ListSelected"] != 1 || !reflect.DeepEqual(m.GetSelector(), expected) {
+		t.Errorf(".ListSelected() not called with selector, got %v", m.GetSelector())
 	}
-	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
-	checkBodyEquals(t, resp, dr.ErrIllegalCategory.Error()+":secretCategory!\n")
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"a":{"Category":"cat","Description":"","ID":"a","Labels":{"lab":"ed"},"Resource":"","Reusable":false,"TTL":0}}`)
 }
 
-func TestHandleCategoryPostIDError(t *testing.T) {
+func TestHandleCategoryGetBadSelector(t *testing.T) {
 
-	// set up store
-	m := mock.New()
+	for _, query := range []string{"?selector=lab%3D%3D%3D", "?selector=lab&limit=2", "?selector=lab&wait=1s"} {
 
-	ID1 := "some_id"
-	ID2 := "other_id"
+		m := mock.New()
 
-	resource1 := dr.Dr{
-		Category:    "cat23",
-		Description: "desc",
-		ID:          ID1,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/api/resources/cat"+query, nil)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		req = mux.SetURLVars(req, map[string]string{
+			"category": "cat",
+		})
 
-	resource2 := dr.Dr{
-		Category:    "cat23",
-		Description: "desc",
-		ID:          ID1, //Here's the deliberate error!
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
+		handleCategoryGet(resp, req, m, nil)
 
-	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
-	if err != nil {
-		t.Error(err)
+		checkStatusCodeIs(t, resp, http.StatusBadRequest)
 	}
+}
+
+func TestHandleSearch(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	resource := dr.Dr{Category: "labs/ed", ID: "a", Labels: map[string]string{"lab": "ed"}}
+	m.SetLists(map[string]map[string]dr.Dr{
+		"labs/ed": {"a": resource},
+		"other":   {"b": dr.Dr{Category: "other", ID: "b", Labels: map[string]string{"lab": "ed"}}},
+	})
+
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	category := "cat23"
-	r := bytes.NewReader(list)
-	req, err := http.NewRequest("POST", "", r)
+	req, err := http.NewRequest("GET", "/api/search?selector=lab&match=labs/**", nil)
 	if err != nil {
-		t.Error(err)
+		t.Error(err.Error())
 	}
-	req = mux.SetURLVars(req, map[string]string{
-		"category": category,
-	})
 
-	handleCategoryPost(resp, req, m)
+	handleSearch(resp, req, m)
 
-	if m.Method["Add"] == 2 {
-		t.Errorf("Didn't call Add once, but %d times\n", m.Method["List"])
+	expected := dr.Selector{{Key: "lab", Operator: dr.Exists}}
+	if m.GetMethod()["Search"] != 1 || !reflect.DeepEqual(m.GetSelector(), expected) {
+		t.Errorf(".Search() not called with selector, got %v", m.GetSelector())
 	}
-	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
-	checkBodyEquals(t, resp, dr.ErrUndefinedID.Error()+": did you mean some_id or other_id?\n")
+
+	obj, err := json.Marshal(resource)
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"labs/ed":{"a":`+string(obj)+`}}`)
 }
 
-func TestHandleIDDelete(t *testing.T) {
+func TestHandleCategoryGetPage(t *testing.T) {
 
 	// set up store
 	m := mock.New()
-	category := "some_category"
-	ID := "some_id"
 	resource := dr.Dr{
-		Category:    category,
+		Category:    "cat",
 		Description: "desc",
-		ID:          ID,
-		Resource:    "res",
+		ID:          "id",
 		Reusable:    true,
 		TTL:         123}
-
-	m.SetResource(resource)
+	p := dr.Page{Next: "somecursor", Resources: []dr.Dr{resource}}
+	m.SetPage(p)
 
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	req, err := http.NewRequest("DELETE", "", nil)
+	category := "importantcategory99"
+	req, err := http.NewRequest("GET", "/?sort=expiry&order=desc&limit=1&cursor=abc", nil)
 	if err != nil {
 		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
 		"category": category,
-		"id":       ID,
 	})
 
-	handleIDDelete(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
-	if m.Method["Delete"] != 1 {
-		t.Errorf("Didn't call Delete once, but %d times\n", m.Method["Delete"])
+	if m.GetMethod()["ListPage"] != 1 || m.GetMethod()["List"] != 0 {
+		t.Errorf("Didn't call ListPage instead of List: %v\n", m.GetMethod())
 	}
 
 	if m.GetCategory() != category {
-		t.Errorf(".Delete() called with wrong category:\ngot:%s\nexp:%s\n",
+		t.Errorf(".ListPage() called with wrong category:\ngot:%s\nexp:%s\n",
 			m.GetCategory(), category)
 	}
 
-	if m.GetID() != ID {
-		t.Errorf(".Delete() called with wrong ID:\ngot:%s\nexp:%s\n",
-			m.GetID(), ID)
+	expectedOptions := dr.ListOptions{Cursor: "abc", Descending: true, Limit: 1, Sort: dr.SortByExpiry}
+	if m.GetListOptions() != expectedOptions {
+		t.Errorf(".ListPage() called with wrong options:\ngot:%v\nexp:%v\n",
+			m.GetListOptions(), expectedOptions)
 	}
 
+	obj, err := json.Marshal(p)
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
 	checkStatusCodeIs(t, resp, http.StatusOK)
-	checkBodyEquals(t, resp, "") //don't return the resource, could be trying to recover a resource issue by deleting a huge resource etc
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, string(obj))
+
 }
 
-func TestHandleIDGet(t *testing.T) {
+func TestHandleCategoryGetPageBadLimit(t *testing.T) {
 
 	// set up store
 	m := mock.New()
-	category := "some_category"
-	ID := "some_id"
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/?limit=lots", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleCategoryGet(resp, req, m, nil)
+
+	if m.GetMethod()["ListPage"] != 0 {
+		t.Errorf("Called ListPage despite bad limit\n")
+	}
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
+}
+
+func TestHandleCategoryGetWaitTake(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	category := "cat"
 	resource := dr.Dr{
 		Category:    category,
 		Description: "desc",
-		ID:          ID,
+		ID:          "id",
 		Resource:    "res",
-		Reusable:    true,
 		TTL:         123}
+	listed := resource
+	listed.Resource = ""
+	m.SetPage(dr.Page{Resources: []dr.Dr{listed}})
 	m.SetResource(resource)
 
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "", nil)
+	req, err := http.NewRequest("GET", "/?wait=10s&take=true", nil)
 	if err != nil {
 		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
 		"category": category,
-		"id":       ID,
 	})
 
-	handleIDGet(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
-	if m.GetCategory() != category {
-		t.Errorf(".List() called with wrong category:\ngot:%s\nexp:%s\n",
-			m.GetCategory(), category)
-	}
-
-	if m.GetID() != ID {
-		t.Errorf(".Delete() called with wrong ID:\ngot:%s\nexp:%s\n",
-			m.GetID(), ID)
+	if m.GetMethod()["Get"] != 1 {
+		t.Errorf("Didn't call Get once, but %d times\n", m.GetMethod()["Get"])
 	}
 
-	if m.Method["Get"] != 1 {
-		t.Errorf("Didn't call Get once, but %d times\n", m.Method["Delete"])
+	if m.GetID() != resource.ID {
+		t.Errorf(".Get() called with wrong ID:\ngot:%s\nexp:%s\n",
+			m.GetID(), resource.ID)
 	}
 
 	obj, err := json.Marshal(resource)
 	if err != nil {
 		t.Errorf("Failed to formulate expected response")
 	}
-	expected := string(obj)
 	checkStatusCodeIs(t, resp, http.StatusOK)
 	checkContentTypeContains(t, resp, "application/json")
-	checkBodyEquals(t, resp, expected)
-
+	checkBodyEquals(t, resp, string(obj))
 }
-func TestHandleIDPost(t *testing.T) {
+
+func TestHandleCategoryGetWaitTimeout(t *testing.T) {
 
 	// set up store
 	m := mock.New()
+	m.SetError(dr.ErrResourceNotFound)
 
-	ID1 := "some_id"
-	category := "cat23"
-
-	resource1 := dr.Dr{
-		Category:    category,
-		Description: "desc",
-		ID:          ID1,
-		Resource:    "res",
-		Reusable:    true,
-		TTL:         123}
-
-	resource, err := json.Marshal(resource1)
-	if err != nil {
-		t.Error(err)
-	}
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	r := bytes.NewReader(resource)
-	req, err := http.NewRequest("POST", "", r)
+	req, err := http.NewRequest("GET", "/?wait=10ms", nil)
 	if err != nil {
-		t.Error(err)
+		t.Error(err.Error())
 	}
 	req = mux.SetURLVars(req, map[string]string{
-		"category": category,
-		"id":       ID1,
+		"category": "cat",
 	})
 
-	handleIDPost(resp, req, m)
+	handleCategoryGet(resp, req, m, nil)
 
-	if m.Method["Add"] != 1 {
-		t.Errorf("Didn't call Add once, but %d times\n", m.Method["List"])
-	}
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrResourceNotFound.Error()+"\n")
+}
 
-	if m.GetResource() != resource1 {
-		t.Errorf("Added resource did not match request")
-	}
+func TestHandleCategoryGetWaitBadDuration(t *testing.T) {
 
-	checkStatusCodeIs(t, resp, http.StatusOK)
+	// set up store
+	m := mock.New()
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/?wait=forever", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleCategoryGet(resp, req, m, nil)
+
+	if m.GetMethod()["List"] != 0 {
+		t.Errorf("Called List despite bad wait\n")
+	}
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
 }
 
-func TestHandleIDPostCategoryError(t *testing.T) {
+func TestHandleCategoryDelete(t *testing.T) {
 
 	// set up store
 	m := mock.New()
 
+	resource := dr.Dr{
+		Category:    "cat",
+		Description: "desc",
+		ID:          "id",
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	m.SetResource(resource)
+
+	//let's hope API doesn't notice that we've got inconsistency between
+	//list ID and resource.ID - else need to enhance mock to give
+	//multiple responses for multiple calls (#TODO but hopefully #YAGNI!)
 	ID1 := "some_id"
-	category := "cat23"
+	ID2 := "other_id"
+	l := map[string]dr.Dr{ID1: resource, ID2: resource}
+	m.SetList(l)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	category := "importantcategory99"
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+	})
+
+	handleCategoryDelete(resp, req, m, newGuard(DestructiveAllow))
+
+	if m.GetMethod()["List"] < 1 {
+		t.Errorf("Didn't call List once, but %d times\n", m.GetMethod()["List"])
+	}
+	if m.GetMethod()["DeleteBatch"] != 1 || m.GetMethod()["Delete"] != 0 {
+		t.Errorf("Didn't call DeleteBatch once, but %d times (and Delete %d times)\n", m.GetMethod()["DeleteBatch"], m.GetMethod()["Delete"])
+	}
+
+	if m.GetCategory() != category {
+		t.Errorf(".DeleteBatch() called with wrong category:\ngot:%s\nexp:%s\n",
+			m.GetCategory(), category)
+	}
+
+	ids := m.GetIDs()
+	if len(ids) != 2 || !((ids[0] == ID1 && ids[1] == ID2) || (ids[0] == ID2 && ids[1] == ID1)) { //sometimes the operation order changes
+		t.Errorf(".DeleteBatch() called with wrong IDs:\ngot:%v\nexp:%s and %s\n",
+			ids, ID1, ID2)
+	}
+
+	if m.GetBatchMode() != dr.AllOrNothing {
+		t.Errorf(".DeleteBatch() not called all-or-nothing by default")
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"other_id":"ok","some_id":"ok"}`)
+}
+
+func TestHandleCategoryDeleteBestEffort(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	category := "importantcategory99"
+	m.SetList(map[string]dr.Dr{"some_id": dr.Dr{}, "other_id": dr.Dr{}})
+	m.SetResults([]dr.BatchResult{
+		dr.BatchResult{Category: category, ID: "some_id"},
+		dr.BatchResult{Category: category, ID: "other_id", Err: dr.ErrResourceNotFound},
+	})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/?mode=best-effort", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+	})
+
+	handleCategoryDelete(resp, req, m, newGuard(DestructiveAllow))
+
+	// mock returns nil error with a failed item, so report it as a success
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	if m.GetBatchMode() != dr.BestEffort {
+		t.Errorf(".DeleteBatch() not called best-effort")
+	}
+}
+
+func TestHandleCategoryPost(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	ID1 := "some_id"
+	ID2 := "other_id"
 
 	resource1 := dr.Dr{
-		Category:    "secretCategory!", //attack is here!
+		Category:    "cat23",
 		Description: "desc",
 		ID:          ID1,
 		Resource:    "res",
 		Reusable:    true,
 		TTL:         123}
 
-	resource, err := json.Marshal(resource1)
+	resource2 := dr.Dr{
+		Category:    "cat23",
+		Description: "desc",
+		ID:          ID2,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
 	if err != nil {
 		t.Error(err)
 	}
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	r := bytes.NewReader(resource)
+	category := "cat23"
+	r := bytes.NewReader(list)
 	req, err := http.NewRequest("POST", "", r)
 	if err != nil {
 		t.Error(err)
 	}
 	req = mux.SetURLVars(req, map[string]string{
 		"category": category,
-		"id":       ID1,
 	})
 
-	handleIDPost(resp, req, m)
+	handleCategoryPost(resp, req, m, m)
+
+	if m.GetMethod()["AddBatch"] != 1 || m.GetMethod()["Add"] != 0 {
+		t.Errorf("Didn't call AddBatch once, but %d times (and Add %d times)\n", m.GetMethod()["AddBatch"], m.GetMethod()["Add"])
+	}
+
+	if len(m.GetResources()) != 2 {
+		t.Errorf("Didn't add both resources in the batch, but %d\n", len(m.GetResources()))
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkBodyEquals(t, resp, `{"other_id":"ok","some_id":"ok"}`)
+}
+
+func TestHandleCategoryPostGenerate(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetResource(dr.Dr{Category: "labs/ed", ID: "0190", Resource: "secret", TTL: 60})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"Category":"labs/ed","Resource":"secret"}`)
+	req, err := http.NewRequest("POST", "/api/resources/labs/ed/?generate=true", body)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "labs/ed",
+	})
+
+	handleCategoryPost(resp, req, m, m)
+
+	if m.GetMethod()["AddGenerated"] != 1 || m.GetAdd().Resource != "secret" {
+		t.Errorf(".AddGenerated() not called with resource, got %v", m.GetAdd())
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusCreated)
+	checkContentTypeContains(t, resp, "application/json")
+	if location := resp.Header().Get("Location"); location != "/api/resources/labs/ed/0190" {
+		t.Errorf("wrong location %s", location)
+	}
+	checkBodyEquals(t, resp, `{"Category":"labs/ed","Description":"","ID":"0190","Resource":"","Reusable":false,"TTL":60}`)
+}
+
+func TestHandleCategoryPostGenerateWithID(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"Category":"cat","ID":"mine"}`)
+	req, err := http.NewRequest("POST", "/api/resources/cat?generate=true", body)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleCategoryPost(resp, req, m, m)
+
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
+	if m.GetMethod()["AddGenerated"] != 0 {
+		t.Errorf(".AddGenerated() should not be called")
+	}
+}
+
+func TestHandleCategoryPostGenerateFalse(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"a":{"Category":"cat","ID":"a"}}`)
+	req, err := http.NewRequest("POST", "/api/resources/cat?generate=false", body)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleCategoryPost(resp, req, m, m)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	if m.GetMethod()["AddGenerated"] != 0 || m.GetMethod()["AddBatch"] != 1 {
+		t.Errorf("generate=false should add the batch, not generate, got %v", m.GetMethod())
+	}
+}
+
+func TestHandleCategoryPostBatchFailed(t *testing.T) {
+
+	for _, test := range []struct {
+		query  string
+		mode   dr.BatchMode
+		result error
+		status int
+		body   string
+	}{
+		{"", dr.AllOrNothing, dr.ErrBatchAborted, http.StatusInternalServerError,
+			`{"other_id":"Illegal ID","some_id":"Batch aborted"}`},
+		{"?mode=best-effort", dr.BestEffort, nil, http.StatusMultiStatus,
+			`{"other_id":"Illegal ID","some_id":"ok"}`},
+	} {
+
+		// set up store
+		m := mock.New()
+		m.SetError(dr.ErrBatchFailed)
+		m.SetResults([]dr.BatchResult{
+			dr.BatchResult{Category: "cat23", ID: "some_id", Err: test.result},
+			dr.BatchResult{Category: "cat23", ID: "other_id", Err: dr.ErrIllegalID},
+		})
+
+		list, err := json.Marshal(map[string]dr.Dr{
+			"some_id":  dr.Dr{Category: "cat23", ID: "some_id"},
+			"other_id": dr.Dr{Category: "cat23", ID: "other_id"},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		// set up req & resp
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/"+test.query, bytes.NewReader(list))
+		if err != nil {
+			t.Error(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{
+			"category": "cat23",
+		})
+
+		handleCategoryPost(resp, req, m, m)
+
+		if m.GetBatchMode() != test.mode {
+			t.Errorf(".AddBatch() called with wrong mode:\ngot:%v\nexp:%v\n", m.GetBatchMode(), test.mode)
+		}
+		checkStatusCodeIs(t, resp, test.status)
+		checkContentTypeContains(t, resp, "application/json")
+		checkBodyEquals(t, resp, test.body)
+	}
+}
+
+func TestHandleCategoryPostCategoryError(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	ID1 := "some_id"
+	ID2 := "other_id"
+
+	resource1 := dr.Dr{
+		Category:    "secretCategory!", //Here's the cross end-point attack!
+		Description: "desc",
+		ID:          ID1,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	resource2 := dr.Dr{
+		Category:    "cat23",
+		Description: "desc",
+		ID:          ID2,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
 
-	if m.Method["Add"] != 0 {
-		t.Errorf("Didn't call Add zero times, but %d times\n", m.Method["List"])
+	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
+	if err != nil {
+		t.Error(err)
+	}
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	category := "cat23"
+	r := bytes.NewReader(list)
+	req, err := http.NewRequest("POST", "", r)
+	if err != nil {
+		t.Error(err)
 	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+	})
 
+	handleCategoryPost(resp, req, m, m)
+
+	if m.GetMethod()["AddBatch"] != 0 {
+		t.Errorf("Didn't call AddBatch zero times, but %d times\n", m.GetMethod()["AddBatch"])
+	}
 	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
 	checkBodyEquals(t, resp, dr.ErrIllegalCategory.Error()+":secretCategory!\n")
 }
 
-func TestHandleIDPostIDError(t *testing.T) {
+func TestHandleCategoryPostIDError(t *testing.T) {
 
 	// set up store
 	m := mock.New()
 
 	ID1 := "some_id"
 	ID2 := "other_id"
-	category := "cat23"
 
 	resource1 := dr.Dr{
-		Category:    category,
+		Category:    "cat23",
 		Description: "desc",
 		ID:          ID1,
 		Resource:    "res",
 		Reusable:    true,
 		TTL:         123}
 
-	resource, err := json.Marshal(resource1)
+	resource2 := dr.Dr{
+		Category:    "cat23",
+		Description: "desc",
+		ID:          ID1, //Here's the deliberate error!
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	list, err := json.Marshal(map[string]dr.Dr{ID1: resource1, ID2: resource2})
 	if err != nil {
 		t.Error(err)
 	}
 	// set up req & resp
 	resp := httptest.NewRecorder()
-	r := bytes.NewReader(resource)
+	category := "cat23"
+	r := bytes.NewReader(list)
 	req, err := http.NewRequest("POST", "", r)
 	if err != nil {
 		t.Error(err)
 	}
 	req = mux.SetURLVars(req, map[string]string{
 		"category": category,
-		"id":       ID2, //deliberately different to resource1
 	})
 
-	handleIDPost(resp, req, m)
+	handleCategoryPost(resp, req, m, m)
 
-	if m.Method["Add"] != 0 {
-		t.Errorf("Didn't call Add zero times, but %d times\n", m.Method["List"])
+	if m.GetMethod()["AddBatch"] != 0 {
+		t.Errorf("Didn't call AddBatch zero times, but %d times\n", m.GetMethod()["AddBatch"])
 	}
-
 	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
 	checkBodyEquals(t, resp, dr.ErrUndefinedID.Error()+": did you mean some_id or other_id?\n")
 }
 
+func TestHandleCategoryPostSchemaProblems(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetSchemaReturn(`{"type":"object","required":["lab"]}`)
+
+	list, err := json.Marshal(map[string]dr.Dr{
+		"good": dr.Dr{Category: "cat23", ID: "good", Description: `{"lab":"ed"}`},
+		"bad":  dr.Dr{Category: "cat23", ID: "bad", Description: `{"lba":"ed"}`},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "", bytes.NewReader(list))
+	if err != nil {
+		t.Error(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat23",
+	})
+
+	handleCategoryPost(resp, req, m, m)
+
+	if m.GetMethod()["AddBatch"] != 0 {
+		t.Errorf("Called AddBatch despite schema problems\n")
+	}
+
+	if m.GetCategory() != "cat23" {
+		t.Errorf(".GetSchema() called with wrong category:\ngot:%s\nexp:cat23\n", m.GetCategory())
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"bad":["(root): lab is required"]}`)
+}
+
+func TestHandleIDDelete(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	category := "some_category"
+	ID := "some_id"
+	resource := dr.Dr{
+		Category:    category,
+		Description: "desc",
+		ID:          ID,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	m.SetResource(resource)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+		"id":       ID,
+	})
+
+	handleIDDelete(resp, req, m)
+
+	if m.GetMethod()["Delete"] != 1 {
+		t.Errorf("Didn't call Delete once, but %d times\n", m.GetMethod()["Delete"])
+	}
+
+	if m.GetCategory() != category {
+		t.Errorf(".Delete() called with wrong category:\ngot:%s\nexp:%s\n",
+			m.GetCategory(), category)
+	}
+
+	if m.GetID() != ID {
+		t.Errorf(".Delete() called with wrong ID:\ngot:%s\nexp:%s\n",
+			m.GetID(), ID)
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkBodyEquals(t, resp, "") //don't return the resource, could be trying to recover a resource issue by deleting a huge resource etc
+}
+
+func TestHandleIDGet(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	category := "some_category"
+	ID := "some_id"
+	resource := dr.Dr{
+		Category:    category,
+		Description: "desc",
+		ID:          ID,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+	m.SetResource(resource)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+		"id":       ID,
+	})
+
+	handleIDGet(resp, req, m, nil)
+
+	if m.GetCategory() != category {
+		t.Errorf(".List() called with wrong category:\ngot:%s\nexp:%s\n",
+			m.GetCategory(), category)
+	}
+
+	if m.GetID() != ID {
+		t.Errorf(".Delete() called with wrong ID:\ngot:%s\nexp:%s\n",
+			m.GetID(), ID)
+	}
+
+	if m.GetMethod()["Get"] != 1 {
+		t.Errorf("Didn't call Get once, but %d times\n", m.GetMethod()["Delete"])
+	}
+
+	obj, err := json.Marshal(resource)
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
+	expected := string(obj)
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, expected)
+
+}
+func TestHandleIDGetSealed(t *testing.T) {
+
+	public, private, err := seal.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// set up store
+	m := mock.New()
+	m.SetResource(dr.Dr{Category: "cat", ID: "id", Resource: "topsecret"})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources/cat/id", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req.Header.Set(seal.PublicKeyHeader, seal.EncodeKey(public))
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+		"id":       "id",
+	})
+
+	handleIDGet(resp, req, m, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	if resp.Header().Get(seal.SealedHeader) != seal.Scheme {
+		t.Errorf("response not marked as sealed")
+	}
+
+	var resource dr.Dr
+	if err := json.Unmarshal(resp.Body.Bytes(), &resource); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := seal.Open(resource, public, private)
+	if err != nil || opened.Resource != "topsecret" || resource.Resource == "topsecret" {
+		t.Errorf("unexpected %v %v", opened, err)
+	}
+}
+
+func TestHandleIDGetBadPublicKey(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources/cat/id", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req.Header.Set(seal.PublicKeyHeader, "tooshort")
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+		"id":       "id",
+	})
+
+	handleIDGet(resp, req, m, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusBadRequest)
+	if m.GetMethod()["Get"] != 0 {
+		t.Errorf("resource used up despite bad key")
+	}
+}
+
+func TestHandleIDGetCancelled(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	// set up req & resp, with client already gone
+	resp := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "some_category",
+		"id":       "some_id",
+	})
+
+	handleIDGet(resp, req, m, nil)
+
+	if m.GetMethod()["Get"] != 0 {
+		t.Errorf("Called Get despite cancelled request\n")
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, context.Canceled.Error()+"\n")
+}
+
+func TestHandleIDPost(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	ID1 := "some_id"
+	category := "cat23"
+
+	resource1 := dr.Dr{
+		Category:    category,
+		Description: "desc",
+		ID:          ID1,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	resource, err := json.Marshal(resource1)
+	if err != nil {
+		t.Error(err)
+	}
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	r := bytes.NewReader(resource)
+	req, err := http.NewRequest("POST", "", r)
+	if err != nil {
+		t.Error(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+		"id":       ID1,
+	})
+
+	handleIDPost(resp, req, m, m)
+
+	if m.GetMethod()["Add"] != 1 {
+		t.Errorf("Didn't call Add once, but %d times\n", m.GetMethod()["List"])
+	}
+
+	if !reflect.DeepEqual(m.GetResource(), resource1) {
+		t.Errorf("Added resource did not match request")
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+}
+
+func TestHandleIDPostCategoryError(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	ID1 := "some_id"
+	category := "cat23"
+
+	resource1 := dr.Dr{
+		Category:    "secretCategory!", //attack is here!
+		Description: "desc",
+		ID:          ID1,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	resource, err := json.Marshal(resource1)
+	if err != nil {
+		t.Error(err)
+	}
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	r := bytes.NewReader(resource)
+	req, err := http.NewRequest("POST", "", r)
+	if err != nil {
+		t.Error(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+		"id":       ID1,
+	})
+
+	handleIDPost(resp, req, m, m)
+
+	if m.GetMethod()["Add"] != 0 {
+		t.Errorf("Didn't call Add zero times, but %d times\n", m.GetMethod()["List"])
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrIllegalCategory.Error()+":secretCategory!\n")
+}
+
+func TestHandleIDPostIDError(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	ID1 := "some_id"
+	ID2 := "other_id"
+	category := "cat23"
+
+	resource1 := dr.Dr{
+		Category:    category,
+		Description: "desc",
+		ID:          ID1,
+		Resource:    "res",
+		Reusable:    true,
+		TTL:         123}
+
+	resource, err := json.Marshal(resource1)
+	if err != nil {
+		t.Error(err)
+	}
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	r := bytes.NewReader(resource)
+	req, err := http.NewRequest("POST", "", r)
+	if err != nil {
+		t.Error(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": category,
+		"id":       ID2, //deliberately different to resource1
+	})
+
+	handleIDPost(resp, req, m, m)
+
+	if m.GetMethod()["Add"] != 0 {
+		t.Errorf("Didn't call Add zero times, but %d times\n", m.GetMethod()["List"])
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrUndefinedID.Error()+": did you mean some_id or other_id?\n")
+}
+
+func TestHandleExport(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	resources := []dr.Dr{
+		dr.Dr{Category: "a", ID: "b", Resource: "secret", TTL: 10},
+		dr.Dr{Category: "c", ID: "d", Resource: "other", Reusable: true},
+	}
+	m.SetExport(resources)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/export", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleExport(resp, req, m)
+
+	expected := ""
+	for _, resource := range resources {
+		obj, err := json.Marshal(resource)
+		if err != nil {
+			t.Errorf("Failed to formulate expected response")
+		}
+		expected += string(obj) + "\n"
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/x-ndjson")
+	checkBodyEquals(t, resp, expected)
+}
+
+func TestHandleExportError(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetError(dr.ErrUnhealthy)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/export", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleExport(resp, req, m)
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrUnhealthy.Error()+"\n")
+}
+
+func TestHandleImport(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+
+	doc := `{"Category":"a","ID":"b","Resource":"secret","TTL":10}
+{"Category":"c","ID":"d","Resource":"other","Reusable":true}
+`
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/admin/import", bytes.NewReader([]byte(doc)))
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleImport(resp, req, m)
+
+	expected := []dr.Dr{
+		dr.Dr{Category: "a", ID: "b", Resource: "secret", TTL: 10},
+		dr.Dr{Category: "c", ID: "d", Resource: "other", Reusable: true},
+	}
+
+	if !reflect.DeepEqual(m.GetResources(), expected) {
+		t.Errorf("Imported wrong resources:\ngot:%v\nexp:%v\n", m.GetResources(), expected)
+	}
+
+	if m.GetBatchMode() != dr.AllOrNothing {
+		t.Errorf("Import not all-or-nothing by default")
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"Added":2,"Failed":{}}`)
+}
+
+func TestHandleImportFailed(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetError(dr.ErrBatchFailed)
+	m.SetResults([]dr.BatchResult{
+		dr.BatchResult{Category: "a", ID: "b"},
+		dr.BatchResult{Category: "a", ID: "c.d", Err: dr.ErrIllegalID},
+	})
+
+	doc := `{"Category":"a","ID":"b"}
+{"Category":"a","ID":"c.d"}
+`
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/admin/import?mode=best-effort", bytes.NewReader([]byte(doc)))
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleImport(resp, req, m)
+
+	checkStatusCodeIs(t, resp, http.StatusMultiStatus)
+	checkBodyEquals(t, resp, `{"Added":1,"Failed":{"a.c.d":"Illegal ID"}}`)
+}
+
+func TestHandlePoliciesGet(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetPolicies(map[string]dr.Policy{"a": dr.Policy{MaxTTL: 60}})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/policies", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handlePoliciesGet(resp, req, m)
+
+	obj, err := json.Marshal(dr.Policy{MaxTTL: 60})
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"a":`+string(obj)+`}`)
+}
+
+func TestHandlePoliciesNotImplemented(t *testing.T) {
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/policies", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handlePoliciesGet(resp, req, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusNotImplemented)
+}
+
+func TestHandlePolicyGet(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	policy := dr.Policy{DefaultTTL: 30, MaxTTL: 60, RequiredDescriptionKeys: []string{"lab"}}
+	m.SetPolicyReturn(policy)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handlePolicyGet(resp, req, m)
+
+	if m.GetCategory() != "cat" {
+		t.Errorf(".GetPolicy() called with wrong category:\ngot:%s\nexp:cat\n", m.GetCategory())
+	}
+
+	obj, err := json.Marshal(policy)
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, string(obj))
+}
+
+func TestHandlePolicyPost(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	policy := dr.Policy{MaxResources: 10, ForbidReusable: true}
+
+	obj, err := json.Marshal(policy)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "", bytes.NewReader(obj))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handlePolicyPost(resp, req, m)
+
+	if m.GetMethod()["SetPolicy"] != 1 {
+		t.Errorf("Didn't call SetPolicy once, but %d times\n", m.GetMethod()["SetPolicy"])
+	}
+
+	if m.GetCategory() != "cat" || !reflect.DeepEqual(m.GetPolicyArg(), policy) {
+		t.Errorf(".SetPolicy() called with wrong arguments: %s %v\n", m.GetCategory(), m.GetPolicyArg())
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+}
+
+func TestHandlePolicyDelete(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetError(dr.ErrPolicyNotFound)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handlePolicyDelete(resp, req, m)
+
+	if m.GetMethod()["DeletePolicy"] != 1 {
+		t.Errorf("Didn't call DeletePolicy once, but %d times\n", m.GetMethod()["DeletePolicy"])
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrPolicyNotFound.Error()+"\n")
+}
+
+func TestHandleSchemasGet(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetSchemas(map[string]string{"a": `{"type":"object"}`})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/schemas", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleSchemasGet(resp, req, m)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/json")
+	checkBodyEquals(t, resp, `{"a":{"type":"object"}}`)
+}
+
+func TestHandleSchemaGet(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetSchemaReturn(`{"type":"object"}`)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleSchemaGet(resp, req, m)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/schema+json")
+	checkBodyEquals(t, resp, `{"type":"object"}`)
+}
+
+func TestHandleSchemaPost(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetError(dr.ErrIllegalSchema)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "", bytes.NewReader([]byte(`{"type":7}`)))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleSchemaPost(resp, req, m)
+
+	if m.GetCategory() != "cat" || m.GetSchemaArg() != `{"type":7}` {
+		t.Errorf(".SetSchema() called with wrong arguments: %s %s\n", m.GetCategory(), m.GetSchemaArg())
+	}
+
+	checkStatusCodeIs(t, resp, http.StatusInternalServerError)
+	checkBodyEquals(t, resp, dr.ErrIllegalSchema.Error()+"\n")
+}
+
+func TestHandleSchemaDelete(t *testing.T) {
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "cat",
+	})
+
+	handleSchemaDelete(resp, req, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusNotImplemented)
+}
+
+func TestHandleJWKS(t *testing.T) {
+
+	keys := jwt.NewKeySet()
+	keys.Rotate("k1")
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleJWKS(resp, req, keys)
+
+	obj, err := json.Marshal(keys.JWKS())
+	if err != nil {
+		t.Errorf("Failed to formulate expected response")
+	}
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	checkContentTypeContains(t, resp, "application/jwk-set+json")
+	checkBodyEquals(t, resp, string(obj))
+}
+
+func TestHandleJWKSNotImplemented(t *testing.T) {
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/jwks", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleJWKS(resp, req, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusNotImplemented)
+}
+
+func TestRouterMintsTokenForConsumer(t *testing.T) {
+
+	keys := jwt.NewKeySet()
+	keys.Rotate("k1")
+
+	storage := ram.New()
+	template := dr.Dr{Category: "pendulum", ID: "p1", TTL: 60}
+	if err := storage.(dr.TemplateStorage).AddTemplate(template, jwt.Generator(keys, "dr")); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewWithKeys(storage, keys)
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources/pendulum/p1", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req.Header.Set(ConsumerHeader, "alice")
+
+	router.ServeHTTP(resp, req)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	var resource dr.Dr
+	if err := json.Unmarshal(resp.Body.Bytes(), &resource); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := keys.Verify(resource.Resource)
+	if err != nil || claims.Subject != "alice" || claims.ResourceID != "p1" {
+		t.Errorf("unexpected claims %+v %v", claims, err)
+	}
+}
+
+func TestRouterLimits(t *testing.T) {
+
+	limits, err := limit.New(
+		limit.Rule{Category: "labs/**", Quota: 2, Period: time.Hour},
+		limit.Rule{Category: "busy", Rate: 0.001, Burst: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := ram.New()
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "shared", Resource: "s", Reusable: true})
+	for _, id := range []string{"a", "b", "c"} {
+		storage.Add(dr.Dr{Category: "labs/ed", ID: id, Resource: id})
+	}
+
+	router := NewWithOptions(storage, Options{Limits: limits})
+
+	get := func(path string, consumer string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ConsumerHeader, consumer)
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// reusable resources don't count against the quota, nor do missing ones
+	get("/api/resources/labs/ed/shared", "alice")
+	get("/api/resources/labs/ed/missing", "alice")
+
+	resp := get("/api/resources/labs/ed/a", "alice")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	if resp.Header().Get("X-Quota-Limit") != "2" || resp.Header().Get("X-Quota-Remaining") != "1" {
+		t.Errorf("unexpected quota headers %v", resp.Header())
+	}
+
+	get("/api/resources/labs/ed/b", "alice")
+
+	resp = get("/api/resources/labs/ed/c", "alice")
+	checkStatusCodeIs(t, resp, http.StatusTooManyRequests)
+	if strings.TrimSpace(resp.Body.String()) != limit.ErrQuotaExceeded.Error() || resp.Header().Get("Retry-After") != "3600" {
+		t.Errorf("unexpected refusal %s %v", resp.Body.String(), resp.Header())
+	}
+
+	// the refused request must not have used up the resource
+	resp = get("/api/resources/labs/ed/c", "bob")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	// rate limits apply to every request in the category
+	get("/api/resources/busy", "alice")
+	resp = get("/api/resources/busy", "alice")
+	if resp.Header().Get("X-RateLimit-Limit") != "2" || resp.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("unexpected rate limit headers %v", resp.Header())
+	}
+
+	resp = get("/api/resources/busy", "alice")
+	checkStatusCodeIs(t, resp, http.StatusTooManyRequests)
+	if strings.TrimSpace(resp.Body.String()) != limit.ErrRateLimited.Error() {
+		t.Errorf("unexpected refusal %s", resp.Body.String())
+	}
+
+	// but not to requests outside categories
+	resp = get("/api/healthcheck", "alice")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+}
+
+func TestRouterTenants(t *testing.T) {
+
+	router := NewWithOptions(ram.New(), Options{Destructive: DestructiveAllow})
+
+	do := func(method string, path string, tenant string, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(TenantHeader, tenant)
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resource := `{"Category":"c","ID":"a","Resource":"r","Reusable":true,"TTL":60}`
+
+	// tenants must be created before use
+	checkStatusCodeIs(t, do("POST", "/api/resources/c/a", "physics", resource), http.StatusNotFound)
+	checkStatusCodeIs(t, do("POST", "/api/admin/tenants/physics", "", ""), http.StatusOK)
+	checkStatusCodeIs(t, do("POST", "/api/admin/tenants/maths", "", ""), http.StatusOK)
+
+	// but only by the default tenant
+	checkStatusCodeIs(t, do("POST", "/api/admin/tenants/chemistry", "physics", ""), http.StatusNotFound)
+
+	checkStatusCodeIs(t, do("POST", "/api/resources/c/a", "physics", resource), http.StatusOK)
+	checkStatusCodeIs(t, do("POST", "/api/resources/c/a", "maths", resource), http.StatusOK)
+	checkStatusCodeIs(t, do("POST", "/api/resources/c/a", "", resource), http.StatusOK)
+
+	// resetting one tenant leaves the others alone
+	checkStatusCodeIs(t, do("DELETE", "/api/resources", "physics", ""), http.StatusOK)
+	checkStatusCodeIs(t, do("GET", "/api/resources/c/a", "physics", ""), http.StatusInternalServerError)
+	checkStatusCodeIs(t, do("GET", "/api/resources/c/a", "maths", ""), http.StatusOK)
+	checkStatusCodeIs(t, do("GET", "/api/resources/c/a", "", ""), http.StatusOK)
+
+	resp := do("GET", "/api/admin/tenants", "", "")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	if strings.TrimSpace(resp.Body.String()) != `["maths","physics"]` {
+		t.Errorf("unexpected tenants %s", resp.Body.String())
+	}
+
+	checkStatusCodeIs(t, do("GET", "/api/resources/c/a", "bad.tenant", ""), http.StatusBadRequest)
+}
+
+func TestRouterTenantsNotImplemented(t *testing.T) {
+
+	router := New(dr.Storage(struct{ dr.Storage }{mock.New()}))
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/resources/c/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TenantHeader, "physics")
+
+	router.ServeHTTP(resp, req)
+
+	checkStatusCodeIs(t, resp, http.StatusNotImplemented)
+}
+
+func TestHandleTrashRestore(t *testing.T) {
+
+	// set up store
+	m := mock.New()
+	m.SetResource(dr.Dr{Category: "labs/ed", ID: "a", Resource: "r", TTL: 42})
+
+	// set up req & resp
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/admin/trash/labs/ed/a", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"category": "labs/ed",
+		"id":       "a",
+	})
+
+	handleTrashRestore(resp, req, m)
+
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	if m.GetCategory() != "labs/ed" || m.GetID() != "a" || m.GetMethod()["Restore"] != 1 {
+		t.Errorf("unexpected restore of %s %s", m.GetCategory(), m.GetID())
+	}
+
+	var resource dr.Dr
+	if err := json.Unmarshal(resp.Body.Bytes(), &resource); err != nil || resource.TTL != 42 {
+		t.Errorf("unexpected %v %v", resource, err)
+	}
+}
+
+func TestHandleTrashNotImplemented(t *testing.T) {
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/api/admin/trash", nil)
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	handleTrashGet(resp, req, nil)
+
+	checkStatusCodeIs(t, resp, http.StatusNotImplemented)
+}
+
+func TestRouterTrash(t *testing.T) {
+
+	storage := ram.New()
+	storage.(dr.TrashStorage).SetGracePeriod(60)
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "a", Resource: "r", TTL: 100})
+
+	router := NewWithOptions(storage, Options{Destructive: DestructiveAllow})
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	checkStatusCodeIs(t, do("DELETE", "/api/resources"), http.StatusOK)
+
+	resp := do("GET", "/api/admin/trash")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	var trash map[string]map[string]dr.Dr
+	if err := json.Unmarshal(resp.Body.Bytes(), &trash); err != nil || trash["labs/ed"]["a"].ID != "a" || trash["labs/ed"]["a"].Resource != "" {
+		t.Errorf("unexpected trash %v %v", trash, err)
+	}
+
+	// only restoring reveals the Resource
+	resp = do("POST", "/api/admin/trash/labs/ed/a")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+
+	var restored dr.Dr
+	if err := json.Unmarshal(resp.Body.Bytes(), &restored); err != nil || restored.Resource != "r" {
+		t.Errorf("unexpected restored %v %v", restored, err)
+	}
+
+	checkStatusCodeIs(t, do("GET", "/api/resources/labs/ed/a"), http.StatusOK)
+}
+
+func TestRouterConfirmDestructive(t *testing.T) {
+
+	storage := ram.New()
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "b", Resource: "r", TTL: 100})
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "a", Resource: "r", TTL: 100})
+	storage.Add(dr.Dr{Category: "labs/gl", ID: "c", Resource: "r", TTL: 100})
+
+	router := New(storage)
+
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	confirmation := func(resp *httptest.ResponseRecorder) Confirmation {
+		var c Confirmation
+		if err := json.Unmarshal(resp.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// a dry run lists what would go, without deleting it
+	resp := do("DELETE", "/api/resources?dry-run=true")
+	checkStatusCodeIs(t, resp, http.StatusOK)
+	expected := map[string][]string{"labs/ed": {"a", "b"}, "labs/gl": {"c"}}
+	if c := confirmation(resp); !reflect.DeepEqual(c.Deletes, expected) || c.Confirm != "" {
+		t.Errorf("unexpected dry run %+v", c)
+	}
+
+	// without confirmation, nothing is deleted, but a token is given
+	resp = do("DELETE", "/api/resources/labs/ed/")
+	checkStatusCodeIs(t, resp, http.StatusPreconditionRequired)
+	c := confirmation(resp)
+	if !reflect.DeepEqual(c.Deletes, map[string][]string{"labs/ed": {"a", "b"}}) || c.Confirm == "" || c.Expires != 60 {
+		t.Errorf("unexpected confirmation %+v", c)
+	}
+
+	if categories, _ := storage.Categories(); categories["labs/ed"] != 2 {
+		t.Errorf("deleted without confirmation %v", categories)
+	}
+
+	// the token only confirms the request it was given for
+	checkStatusCodeIs(t, do("DELETE", "/api/resources?confirm="+c.Confirm), http.StatusBadRequest)
+	checkStatusCodeIs(t, do("DELETE", "/api/resources/labs/gl/?confirm="+c.Confirm), http.StatusBadRequest)
+	checkStatusCodeIs(t, do("DELETE", "/api/resources/labs/ed/?confirm=1."+c.Confirm), http.StatusBadRequest)
+
+	// nor once what it would delete has changed
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "d", Resource: "r", TTL: 100})
+	checkStatusCodeIs(t, do("DELETE", "/api/resources/labs/ed/?confirm="+c.Confirm), http.StatusBadRequest)
+	storage.Delete("labs/ed", "d")
+
+	checkStatusCodeIs(t, do("DELETE", "/api/resources/labs/ed/?confirm="+c.Confirm), http.StatusOK)
+
+	if categories, _ := storage.Categories(); categories["labs/ed"] != 0 || categories["labs/gl"] != 1 {
+		t.Errorf("unexpected categories after confirmed delete %v", categories)
+	}
+
+	// and only once
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "a", Resource: "r", TTL: 100})
+	storage.Add(dr.Dr{Category: "labs/ed", ID: "b", Resource: "r", TTL: 100})
+	checkStatusCodeIs(t, do("DELETE", "/api/resources/labs/ed/?confirm="+c.Confirm), http.StatusBadRequest)
+}
+
+func TestGuardExpiry(t *testing.T) {
+
+	g := newGuard(DestructiveConfirm)
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	req, err := http.NewRequest("DELETE", "/api/resources", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := g.token(req, now.Add(confirmTTL), nil)
+
+	if !g.valid(req, token, nil) {
+		t.Errorf("fresh token should be valid")
+	}
+
+	now = now.Add(confirmTTL)
+
+	if g.valid(req, token, nil) {
+		t.Errorf("expired token should not be valid")
+	}
+
+	if newGuard(DestructiveConfirm).valid(req, g.token(req, now.Add(confirmTTL), nil), nil) {
+		t.Errorf("token from another guard should not be valid")
+	}
+
+	if g.valid(req, g.token(req, now.Add(confirmTTL), map[string][]string{"c": {"a"}}), nil) {
+		t.Errorf("token for other deletes should not be valid")
+	}
+
+	token = g.token(req, now.Add(confirmTTL), nil)
+
+	if !g.spend(token) || g.spend(token) {
+		t.Errorf("token should only be spent once")
+	}
+
+	now = now.Add(confirmTTL)
+	g.spend(g.token(req, now.Add(confirmTTL), nil))
+
+	if len(g.spent) != 1 {
+		t.Errorf("expired tokens should be forgotten, still have %d", len(g.spent))
+	}
+}
+
+func TestRouterDenyDestructive(t *testing.T) {
+
+	storage := ram.New()
+	storage.Add(dr.Dr{Category: "c", ID: "a", Resource: "r", TTL: 100})
+
+	router := NewWithOptions(storage, Options{Destructive: DestructiveDeny})
+
+	for _, path := range []string{"/api/resources", "/api/resources/c", "/api/resources?dry-run=true"} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("DELETE", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(resp, req)
+		checkStatusCodeIs(t, resp, http.StatusForbidden)
+	}
+
+	if _, err := storage.Get("c", "a"); err != nil {
+		t.Errorf("resource should not have been deleted, got %v", err)
+	}
+}
+
 func TestHandleHealthCheck(t *testing.T) {
 
 	// set up store
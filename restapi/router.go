@@ -2,35 +2,198 @@ package restapi
 
 import (
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/jwt"
+	"github.com/timdrysdale/dr/limit"
 )
 
 // RESTful API methods from general to specific
 //
 // ------  GET  ----  ------  /api/healthcheck
+// ------  GET  ----  ------  /api/jwks (also at /.well-known/jwks.json)
+// ------  GET  ----  ------  /api/search
+// ------  GET  ----  ------  /api/admin/export
+// ------  ---  POST  ------  /api/admin/import
+// ------  GET  ----  ------  /api/admin/policies
+// DELETE  GET  POST  UPDATE  /api/admin/policies/<category>
+// ------  GET  ----  ------  /api/admin/schemas
+// ------  GET  ----  ------  /api/admin/tenants
+// ------  ---  POST  ------  /api/admin/tenants/<tenant>
+// ------  GET  ----  ------  /api/admin/trash
+// ------  ---  POST  ------  /api/admin/trash/<category>/<id>
+// DELETE  GET  POST  UPDATE  /api/admin/schemas/<category>
 // DELETE  GET  ----  ------  /api/resources/
 // DELETE  GET  POST  UPDATE  /api/resources/<category>
+// DELETE  GET  POST  UPDATE  /api/resources/<category>/
+// ------  GET  ----  ------  /api/resources/<pattern>
 // DELETE  GET  POST  UPDATE  /api/resources/<category>/<id>
+//
+// GET /api/resources/<category> accepts sort=id|expiry|added, order=asc|desc,
+// limit=<n> and cursor=<next> to return one page at a time, and wait=<duration>
+// to long-poll an empty category (adding take=true gets one resource from it).
+// POST and DELETE on a category are all-or-nothing unless mode=best-effort,
+// and report on each ID in the response body. POST on a category with
+// generate=true adds one resource without an ID, and replies 201 Created with
+// the ID it was given (in the category policy's IDScheme) and a Location.
+// Export and import use newline-delimited JSON, one resource per line, including
+// secrets and remaining TTL, with import all-or-nothing unless mode=best-effort.
+// Resources POSTed to a category with a schema are refused with 400 Bad Request
+// and a list of problems with each description, if they don't match it.
+//
+// DELETE on /api/resources, or a whole category, is answered with 428
+// Precondition Required, listing what would be deleted, and a token to
+// confirm it with, by repeating the DELETE with confirm=<token> within a
+// minute. The token can only be used once, and not if what would be deleted
+// has changed in the meantime. dry-run=true just lists what would be
+// deleted. Options.Destructive can instead allow these without
+// confirmation, or turn them off entirely.
+//
+// Categories can be hierarchical, e.g. labs/edinburgh/pendulum, in which case
+// the category itself is addressed with a trailing slash, to tell it apart
+// from ID pendulum in category labs/edinburgh. GET on a pattern such as
+// labs/*/pendulum or labs/** lists every matching category, and GET on
+// /api/resources counts resources at every level, for those matching
+// match=<pattern> if given.
+//
+// Resources can carry labels, e.g. {"lab":"ed","type":"sim"}, and GET on
+// /api/resources, a category, or a pattern accepts selector=<selector>, e.g.
+// selector=lab=ed,type!=sim, to only count or list those with matching
+// labels. GET /api/search?selector=<selector> finds them in any category.
+//
+// Templates with a jwt.Generator reveal a freshly signed token on each GET,
+// naming the consumer given in the X-Consumer header as its subject, which
+// hardware can check offline against the public keys at /api/jwks.
+//
+// A GET that reveals a Resource (on an ID, or with take=true) seals it to the
+// X25519 public key in the X-Public-Key header, if there is one, so that only
+// the consumer can read it. See ./client for opening it.
+//
+// Storage with a dr.TrashStorage grace period keeps what is deleted or reset
+// for that long, so GET /api/admin/trash lists it, with the TTL it has left
+// but without the Resource, and POST on a resource in the trash restores it,
+// replying with the whole resource.
+//
+// Every request, admin included, is for the tenant named in the X-Tenant
+// header, or the default tenant if there is none, so that e.g. DELETE on
+// /api/resources only resets that tenant. Tenants must first be created by
+// a POST on /api/admin/tenants/<tenant> (for the default tenant), and
+// requests for any other tenant are refused with 404 Not Found. Storage that
+// isn't a dr.TenantStorage only has the default tenant.
+//
+// With a limit.Limiter, each consumer (or address, if there is no X-Consumer)
+// is rate limited on every request in a category, and held to a quota of
+// single-use resources revealed to them, with the limits shared by all
+// tenants. Responses carry X-RateLimit-Limit, -Remaining and -Reset, and
+// X-Quota-Limit, -Remaining and -Reset (in seconds), and a request over
+// either is refused with 429 Too Many Requests, a Retry-After, and a body
+// of "Rate limited" or "Quota exceeded". As a GET on an ID can't know in
+// advance if it reveals a single-use resource, any such GET is refused once
+// the quota is used up.
 
 const pathApi = "/api"
 const pathResources = pathApi + "/resources"
-const pathCategory = pathResources + `/{category:[a-zA-Z0-9\-\/]+}`
-const pathID = pathCategory + `/{id:[a-zA-Z0-9\-\/]+}`
+const pathCategory = pathResources + `/{category:[a-zA-Z0-9\-\/\*]+}`
+const pathCategorySlash = pathCategory + "/"
+const pathID = pathResources + `/{category:[a-zA-Z0-9\-\/]+}/{id:[a-zA-Z0-9\-]+}`
 const pathHealthcheck = pathApi + "/healthcheck"
+const pathSearch = pathApi + "/search"
+const pathJWKS = pathApi + "/jwks"
+const pathWellKnownJWKS = "/.well-known/jwks.json"
+const pathAdmin = pathApi + "/admin"
+const pathExport = pathAdmin + "/export"
+const pathImport = pathAdmin + "/import"
+const pathPolicies = pathAdmin + "/policies"
+const pathPolicy = pathPolicies + `/{category:[a-zA-Z0-9\-\/]+}`
+const pathSchemas = pathAdmin + "/schemas"
+const pathSchema = pathSchemas + `/{category:[a-zA-Z0-9\-\/]+}`
+const pathTenants = pathAdmin + "/tenants"
+const pathTenant = pathTenants + `/{tenant:[a-zA-Z0-9\-_]+}`
+const pathTrash = pathAdmin + "/trash"
+const pathTrashID = pathTrash + `/{category:[a-zA-Z0-9\-\/]+}/{id:[a-zA-Z0-9\-]+}`
+
+// ConsumerHeader identifies who is asking, e.g. for the subject of tokens
+// minted by a jwt.Generator. It must be set by whatever authenticates
+// requests before they reach us, such as a reverse proxy, and stripped from
+// requests that arrive any other way.
+const ConsumerHeader = "X-Consumer"
+
+// TenantHeader picks which tenant a request is for, where the storage is a
+// dr.TenantStorage. Like ConsumerHeader, it should be set by whatever
+// authenticates requests, so that no tenant can reach another's resources.
+const TenantHeader = "X-Tenant"
 
-func New(store dr.Storage) *mux.Router {
+// Options turn on optional features of the API
+type Options struct {
+	Destructive Destructive    // guard on deleting everything, or a category
+	Keys        *jwt.KeySet    // public keys of tokens minted by a jwt.Generator
+	Limits      *limit.Limiter // quotas and rate limits for each consumer
+}
+
+func New(storage dr.Storage) *mux.Router {
+	return NewWithOptions(storage, Options{})
+}
+
+// NewWithKeys also publishes the public keys that tokens minted by a
+// jwt.Generator are signed with, for hardware to check them offline
+func NewWithKeys(storage dr.Storage, keys *jwt.KeySet) *mux.Router {
+	return NewWithOptions(storage, Options{Keys: keys})
+}
+
+func NewWithOptions(storage dr.Storage, options Options) *mux.Router {
 
 	var router = mux.NewRouter()
 
+	// first, so that requests for a tenant get all their other middleware
+	// from the tenant's own router
+	router.Use(withTenant(storage, options))
+
+	addRoutes(router, storage, options)
+
+	// tenants are only managed from the default tenant
+	tenants, _ := storage.(dr.TenantStorage)
+
+	router.HandleFunc(pathTenants,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleTenantsGet(w, r, tenants)
+		}).Methods("GET")
+
+	router.HandleFunc(pathTenant,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleTenantPost(w, r, tenants)
+		}).Methods("POST")
+
+	return router
+}
+
+// addRoutes sets up router to serve storage
+func addRoutes(router *mux.Router, storage dr.Storage, options Options) {
+
+	keys := options.Keys
+	limits := options.Limits
+	guard := newGuard(options.Destructive)
+
+	router.Use(withConsumer)
+	router.Use(withRateLimit(limits))
+
+	// handlers pass on each request's context, to stop work for departed clients
+	store := dr.WithContext(storage)
+
+	// optional features are nil if the storage doesn't offer them
+	policies, _ := storage.(dr.PolicyStorage)
+	schemas, _ := storage.(dr.SchemaStorage)
+	trash, _ := storage.(dr.TrashStorage)
+
 	// on root
 	router.HandleFunc("/", handleRoot)
 
 	// on all resources
 	router.HandleFunc(pathResources,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleResourcesDelete(w, r, store)
+			handleResourcesDelete(w, r, store, guard)
 		}).Methods("DELETE")
 
 	router.HandleFunc(pathResources,
@@ -38,6 +201,23 @@ func New(store dr.Storage) *mux.Router {
 			handleResourcesGet(w, r, store)
 		}).Methods("GET")
 
+	// on a specific category, given with a trailing slash, which must be
+	// matched before IDs so labs/edinburgh/ isn't mistaken for ID edinburgh
+	router.HandleFunc(pathCategorySlash,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCategoryDelete(w, r, store, guard)
+		}).Methods("DELETE")
+
+	router.HandleFunc(pathCategorySlash,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCategoryGet(w, r, store, limits)
+		}).Methods("GET")
+
+	router.HandleFunc(pathCategorySlash,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCategoryPost(w, r, store, schemas)
+		}).Methods("POST", "UPDATE")
+
 	// on a specific ID
 	router.HandleFunc(pathID,
 		func(w http.ResponseWriter, r *http.Request) {
@@ -46,35 +226,216 @@ func New(store dr.Storage) *mux.Router {
 
 	router.HandleFunc(pathID,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleIDGet(w, r, store)
+			handleIDGet(w, r, store, limits)
 		}).Methods("GET")
 
 	router.HandleFunc(pathID,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleIDPost(w, r, store)
+			handleIDPost(w, r, store, schemas)
 		}).Methods("POST", "UPDATE")
 
 	// on a specific category
 	router.HandleFunc(pathCategory,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleCategoryDelete(w, r, store)
+			handleCategoryDelete(w, r, store, guard)
 		}).Methods("DELETE")
 
 	router.HandleFunc(pathCategory,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleCategoryGet(w, r, store)
+			handleCategoryGet(w, r, store, limits)
 		}).Methods("GET")
 
 	router.HandleFunc(pathCategory,
 		func(w http.ResponseWriter, r *http.Request) {
-			handleCategoryPost(w, r, store)
+			handleCategoryPost(w, r, store, schemas)
+		}).Methods("POST", "UPDATE")
+
+	// on admin
+	router.HandleFunc(pathExport,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleExport(w, r, store)
+		}).Methods("GET")
+
+	router.HandleFunc(pathImport,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleImport(w, r, store)
+		}).Methods("POST")
+
+	router.HandleFunc(pathPolicies,
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePoliciesGet(w, r, policies)
+		}).Methods("GET")
+
+	router.HandleFunc(pathPolicy,
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePolicyDelete(w, r, policies)
+		}).Methods("DELETE")
+
+	router.HandleFunc(pathPolicy,
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePolicyGet(w, r, policies)
+		}).Methods("GET")
+
+	router.HandleFunc(pathPolicy,
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePolicyPost(w, r, policies)
+		}).Methods("POST", "UPDATE")
+
+	router.HandleFunc(pathTrash,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleTrashGet(w, r, trash)
+		}).Methods("GET")
+
+	router.HandleFunc(pathTrashID,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleTrashRestore(w, r, trash)
+		}).Methods("POST")
+
+	router.HandleFunc(pathSchemas,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSchemasGet(w, r, schemas)
+		}).Methods("GET")
+
+	router.HandleFunc(pathSchema,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSchemaDelete(w, r, schemas)
+		}).Methods("DELETE")
+
+	router.HandleFunc(pathSchema,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSchemaGet(w, r, schemas)
+		}).Methods("GET")
+
+	router.HandleFunc(pathSchema,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSchemaPost(w, r, schemas)
 		}).Methods("POST", "UPDATE")
 
 	// on other
+	router.HandleFunc(pathSearch,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSearch(w, r, store)
+		}).Methods("GET")
+
+	router.HandleFunc(pathJWKS,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleJWKS(w, r, keys)
+		}).Methods("GET")
+
+	router.HandleFunc(pathWellKnownJWKS,
+		func(w http.ResponseWriter, r *http.Request) {
+			handleJWKS(w, r, keys)
+		}).Methods("GET")
+
 	router.HandleFunc(pathHealthcheck,
 		func(w http.ResponseWriter, r *http.Request) {
 			handleHealthcheck(w, r, store)
 		}).Methods("GET")
+}
 
-	return router
+// withConsumer passes on who is asking to the storage, via the request context
+func withConsumer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if consumer := r.Header.Get(ConsumerHeader); consumer != "" {
+			r = r.WithContext(dr.WithConsumer(r.Context(), consumer))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRateLimit refuses requests in a category from consumers who are making
+// them too fast. Requests that don't name a category, such as admin, aren't
+// limited.
+func withRateLimit(limits *limit.Limiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			category, ok := mux.Vars(r)["category"]
+
+			if limits == nil || !ok || !strings.HasPrefix(r.URL.Path, pathResources+"/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			status, err := limits.Allow(consumerOf(r), category)
+			writeLimitHeaders(w, "X-RateLimit-", status)
+
+			if err != nil {
+				writeTooManyRequests(w, status, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withTenant passes requests for a tenant to a router of their own, which
+// serves the tenant's storage, and is kept for the tenant's next request.
+// Only tenants that have been created are served, so that a header can't
+// make storage, or a router, for every name it is given.
+func withTenant(storage dr.Storage, options Options) mux.MiddlewareFunc {
+
+	tenants, _ := storage.(dr.TenantStorage)
+	routers := make(map[string]*mux.Router)
+	var lock sync.Mutex
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			name := r.Header.Get(TenantHeader)
+
+			if name == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if tenants == nil {
+				http.Error(w, notImplemented, http.StatusNotImplemented)
+				return
+			}
+
+			if !dr.LegalTenant(name) {
+				http.Error(w, dr.ErrIllegalTenant.Error(), http.StatusBadRequest)
+				return
+			}
+
+			lock.Lock()
+			router, ok := routers[name]
+			if !ok {
+				created, err := tenants.Tenants()
+				if err != nil {
+					lock.Unlock()
+					writeStorageError(w, err)
+					return
+				}
+				if !contains(created, name) {
+					lock.Unlock()
+					http.Error(w, dr.ErrTenantNotFound.Error(), http.StatusNotFound)
+					return
+				}
+				tenant, err := tenants.Tenant(name)
+				if err != nil {
+					lock.Unlock()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				router = mux.NewRouter()
+				addRoutes(router, tenant, options)
+				routers[name] = router
+			}
+			lock.Unlock()
+
+			router.ServeHTTP(w, r)
+		})
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,47 @@
+// package schema checks resource descriptions against a JSON Schema, so that
+// suppliers can't file descriptions with misspelled or missing keys
+package schema
+
+import (
+	"github.com/timdrysdale/dr"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type Schema struct {
+	category string
+	schema   *gojsonschema.Schema
+}
+
+// Compile parses a JSON Schema for the descriptions in a category, and
+// returns dr.ErrIllegalSchema if it is not one
+func Compile(category string, text string) (*Schema, error) {
+
+	s, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(text))
+	if err != nil {
+		return nil, dr.ErrIllegalSchema
+	}
+
+	return &Schema{category: category, schema: s}, nil
+}
+
+// Validate returns a *dr.SchemaError listing every problem with the
+// description, or nil if it matches the schema
+func (s *Schema) Validate(description string) error {
+
+	result, err := s.schema.Validate(gojsonschema.NewStringLoader(description))
+	if err != nil {
+		// not JSON at all
+		return &dr.SchemaError{Category: s.category, Problems: []string{err.Error()}}
+	}
+
+	if result.Valid() {
+		return nil
+	}
+
+	problems := []string{}
+	for _, problem := range result.Errors() {
+		problems = append(problems, problem.String())
+	}
+
+	return &dr.SchemaError{Category: s.category, Problems: problems}
+}
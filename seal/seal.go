@@ -0,0 +1,85 @@
+// package seal encrypts a revealed Resource to a public key that the consumer
+// sends with the request, so that only the consumer can read it, and not the
+// TLS terminators, proxies and logs it passes through on the way. It uses
+// NaCl anonymous sealed boxes (X25519, XSalsa20-Poly1305).
+package seal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"github.com/timdrysdale/dr"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// PublicKeyHeader carries the consumer's X25519 public key, base64 encoded
+const PublicKeyHeader = "X-Public-Key"
+
+// SealedHeader is set on a response whose Resource is sealed, to Scheme
+const SealedHeader = "X-Resource-Sealed"
+
+const Scheme = "nacl-box-seal"
+
+var ErrIllegalKey = errors.New("Illegal public key")
+var ErrCannotOpen = errors.New("Cannot open sealed resource")
+
+// GenerateKey makes a key pair for a consumer
+func GenerateKey() (*[32]byte, *[32]byte, error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+// EncodeKey gives a public key in the form used in PublicKeyHeader
+func EncodeKey(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// ParseKey reads a public key from PublicKeyHeader, in standard or URL-safe
+// base64, with or without padding
+func ParseKey(s string) (*[32]byte, error) {
+
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if b, err := encoding.DecodeString(s); err == nil && len(b) == 32 {
+			var key [32]byte
+			copy(key[:], b)
+			return &key, nil
+		}
+	}
+
+	return nil, ErrIllegalKey
+}
+
+// Seal replaces the Resource with a sealed box, base64 encoded, that only the
+// holder of the private key matching the public key can open
+func Seal(resource dr.Dr, publicKey *[32]byte) (dr.Dr, error) {
+
+	sealed, err := box.SealAnonymous(nil, []byte(resource.Resource), publicKey, rand.Reader)
+	if err != nil {
+		return resource, err
+	}
+
+	resource.Resource = base64.StdEncoding.EncodeToString(sealed)
+
+	return resource, nil
+}
+
+// Open recovers the Resource from a resource returned by Seal
+func Open(resource dr.Dr, publicKey *[32]byte, privateKey *[32]byte) (dr.Dr, error) {
+
+	sealed, err := base64.StdEncoding.DecodeString(resource.Resource)
+	if err != nil {
+		return resource, ErrCannotOpen
+	}
+
+	opened, ok := box.OpenAnonymous(nil, sealed, publicKey, privateKey)
+	if !ok {
+		return resource, ErrCannotOpen
+	}
+
+	resource.Resource = string(opened)
+
+	return resource, nil
+}
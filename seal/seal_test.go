@@ -0,0 +1,57 @@
+package seal
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/timdrysdale/dr"
+)
+
+func TestSealOpen(t *testing.T) {
+
+	public, private, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := dr.Dr{Category: "a", ID: "b", Resource: "topsecret"}
+
+	sealed, err := Seal(resource, public)
+	if err != nil || sealed.Resource == "topsecret" || sealed.ID != "b" {
+		t.Fatalf("unexpected %v %v", sealed, err)
+	}
+
+	opened, err := Open(sealed, public, private)
+	if err != nil || !reflect.DeepEqual(opened, resource) {
+		t.Errorf("unexpected %v %v", opened, err)
+	}
+
+	otherPublic, otherPrivate, _ := GenerateKey()
+	if _, err := Open(sealed, otherPublic, otherPrivate); err != ErrCannotOpen {
+		t.Errorf("other key should not open, got %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+
+	public, _, _ := GenerateKey()
+
+	for _, encoded := range []string{
+		EncodeKey(public),
+		base64.RawStdEncoding.EncodeToString(public[:]),
+		base64.URLEncoding.EncodeToString(public[:]),
+		base64.RawURLEncoding.EncodeToString(public[:]),
+	} {
+		key, err := ParseKey(encoded)
+		if err != nil || *key != *public {
+			t.Errorf("ParseKey(%s) = %v, %v", encoded, key, err)
+		}
+	}
+
+	for _, encoded := range []string{"", "notbase64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKey(encoded); err != ErrIllegalKey {
+			t.Errorf("ParseKey(%q) should be illegal, got %v", encoded, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package dr
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Operator is how a Requirement compares a label
+type Operator string
+
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	Exists       Operator = ""
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is one term of a Selector, e.g. lab=ed, type!=sim, lab or !lab
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Value    string
+}
+
+// Selector picks out resources by their labels, matching those that meet
+// every one of its requirements. An empty Selector matches everything.
+type Selector []Requirement
+
+// label keys may have a prefix, e.g. example.org/lab, but values may not
+var labelKey = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._\-/]*[a-zA-Z0-9])?$`)
+var labelValue = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9._\-]*[a-zA-Z0-9])?)?$`)
+
+// ParseSelector reads a Kubernetes-style selector, i.e. comma separated
+// requirements such as lab=ed,type!=sim,!retired (== may be used for =)
+func ParseSelector(s string) (Selector, error) {
+
+	selector := Selector{}
+
+	if strings.TrimSpace(s) == "" {
+		return selector, nil
+	}
+
+	for _, term := range strings.Split(s, ",") {
+
+		term = strings.TrimSpace(term)
+		requirement := Requirement{Operator: Exists}
+
+		switch {
+		case strings.HasPrefix(term, "!") && !strings.Contains(term, "="):
+			requirement.Operator = DoesNotExist
+			requirement.Key = strings.TrimSpace(term[1:])
+		case strings.Contains(term, "!="):
+			requirement.Operator = NotEquals
+			requirement.Key, requirement.Value = split(term, "!=")
+		case strings.Contains(term, "=="):
+			requirement.Operator = Equals
+			requirement.Key, requirement.Value = split(term, "==")
+		case strings.Contains(term, "="):
+			requirement.Operator = Equals
+			requirement.Key, requirement.Value = split(term, "=")
+		default:
+			requirement.Key = term
+		}
+
+		if !labelKey.MatchString(requirement.Key) || !labelValue.MatchString(requirement.Value) {
+			return Selector{}, ErrIllegalSelector
+		}
+
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+func split(term string, operator string) (string, string) {
+	parts := strings.SplitN(term, operator, 2)
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// Matches reports whether labels meet every requirement of the selector
+func (s Selector) Matches(labels map[string]string) bool {
+
+	for _, requirement := range s {
+
+		value, ok := labels[requirement.Key]
+
+		switch requirement.Operator {
+		case Equals:
+			if !ok || value != requirement.Value {
+				return false
+			}
+		case NotEquals:
+			if ok && value == requirement.Value {
+				return false
+			}
+		case Exists:
+			if !ok {
+				return false
+			}
+		case DoesNotExist:
+			if ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// String gives the selector in the form read by ParseSelector
+func (s Selector) String() string {
+
+	terms := []string{}
+
+	for _, requirement := range s {
+		switch requirement.Operator {
+		case DoesNotExist:
+			terms = append(terms, "!"+requirement.Key)
+		case Exists:
+			terms = append(terms, requirement.Key)
+		default:
+			terms = append(terms, requirement.Key+string(requirement.Operator)+requirement.Value)
+		}
+	}
+
+	return strings.Join(terms, ",")
+}
+
+// LegalLabels reports whether every label key and value is well formed
+func LegalLabels(labels map[string]string) bool {
+
+	for key, value := range labels {
+		if !labelKey.MatchString(key) || !labelValue.MatchString(value) {
+			return false
+		}
+	}
+
+	return true
+}
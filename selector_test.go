@@ -0,0 +1,83 @@
+package dr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+
+	for _, test := range []struct {
+		selector string
+		expected Selector
+	}{
+		{"", Selector{}},
+		{"lab=ed", Selector{{"lab", Equals, "ed"}}},
+		{"lab==ed", Selector{{"lab", Equals, "ed"}}},
+		{"lab = ed, type != sim", Selector{{"lab", Equals, "ed"}, {"type", NotEquals, "sim"}}},
+		{"lab,!retired", Selector{{"lab", Exists, ""}, {"retired", DoesNotExist, ""}}},
+		{"example.org/lab=ed", Selector{{"example.org/lab", Equals, "ed"}}},
+		{"lab=", Selector{{"lab", Equals, ""}}},
+	} {
+		got, err := ParseSelector(test.selector)
+		if err != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("ParseSelector(%q) = %v, %v, expected %v", test.selector, got, err, test.expected)
+		}
+	}
+
+	for _, selector := range []string{",", "lab=ed,", "=ed", "!", "!lab=ed", "lab=e d", "lab=a/b", "-lab"} {
+		if _, err := ParseSelector(selector); err != ErrIllegalSelector {
+			t.Errorf("ParseSelector(%q) should be illegal, got %v", selector, err)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+
+	labels := map[string]string{"lab": "ed", "type": "real"}
+
+	for selector, expected := range map[string]bool{
+		"":                   true,
+		"lab=ed":             true,
+		"lab=gla":            false,
+		"lab=ed,type!=sim":   true,
+		"lab=ed,type!=real":  false,
+		"colour!=red":        true,
+		"lab":                true,
+		"colour":             false,
+		"!colour":            true,
+		"!lab":               false,
+		"lab=ed,type=real,x": false,
+	} {
+		s, err := ParseSelector(selector)
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %v", selector, err)
+			continue
+		}
+		if got := s.Matches(labels); got != expected {
+			t.Errorf("%q matches %v = %v, expected %v", selector, labels, got, expected)
+		}
+		if got, _ := ParseSelector(s.String()); !reflect.DeepEqual(got, s) {
+			t.Errorf("%q did not survive String(), got %q", selector, s.String())
+		}
+	}
+}
+
+func TestLegalLabels(t *testing.T) {
+
+	for _, test := range []struct {
+		labels   map[string]string
+		expected bool
+	}{
+		{nil, true},
+		{map[string]string{"lab": "ed", "example.org/type": "sim-2"}, true},
+		{map[string]string{"lab": ""}, true},
+		{map[string]string{"": "ed"}, false},
+		{map[string]string{"lab": "a,b"}, false},
+		{map[string]string{"lab!": "ed"}, false},
+	} {
+		if got := LegalLabels(test.labels); got != test.expected {
+			t.Errorf("LegalLabels(%v) = %v, expected %v", test.labels, got, test.expected)
+		}
+	}
+}
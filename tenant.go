@@ -0,0 +1,15 @@
+package dr
+
+// LegalTenant reports whether name can be used for a tenant, i.e. it is the
+// default tenant "", or only has letters, digits, '-' and '_', so it can be
+// used in headers, paths and keys without escaping
+func LegalTenant(name string) bool {
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,18 @@
+package dr
+
+import "testing"
+
+func TestLegalTenant(t *testing.T) {
+
+	for _, name := range []string{"", "physics-101", "Course_2"} {
+		if !LegalTenant(name) {
+			t.Errorf("%q should be legal", name)
+		}
+	}
+
+	for _, name := range []string{"a/b", "a.b", "a b", "*", "é"} {
+		if LegalTenant(name) {
+			t.Errorf("%q should be illegal", name)
+		}
+	}
+}
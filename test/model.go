@@ -0,0 +1,353 @@
+package test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/timdrysdale/dr"
+)
+
+// ModelSeed, if set, replays the sequences from a failed TestModel run,
+// which logs the seed it used. It can also be set with DR_MODEL_SEED, e.g.
+// DR_MODEL_SEED=1234 go test -run TestModel ./ram
+var ModelSeed int64
+
+// modelTTLSlack is how far a storage's remaining TTL may be from the
+// model's, since a storage may round to the second differently
+const modelTTLSlack = 1
+
+// Op is one step in a sequence run against the storage and the model
+type Op struct {
+	Kind     string // Add, Get, List, Delete, Categories, Reset or Wait
+	Category string
+	ID       string
+	TTL      int64
+	Reusable bool
+	Seconds  int64 // for Wait
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case "Add":
+		return fmt.Sprintf("Add(%s.%s, TTL %d, reusable %v)", o.Category, o.ID, o.TTL, o.Reusable)
+	case "Get", "Delete":
+		return fmt.Sprintf("%s(%s.%s)", o.Kind, o.Category, o.ID)
+	case "List":
+		return fmt.Sprintf("List(%s)", o.Category)
+	case "Wait":
+		return fmt.Sprintf("Wait(%ds)", o.Seconds)
+	default:
+		return o.Kind + "()"
+	}
+}
+
+// model is the reference for what the storage should do, kept as simple as
+// possible. Unlike a storage, it removes expired resources straight away,
+// which a storage must appear to do too.
+type model struct {
+	now       int64
+	resources map[string]map[string]modelResource
+}
+
+type modelResource struct {
+	resource   dr.Dr
+	validUntil int64 // zero for never
+}
+
+func newModel(now int64) *model {
+	return &model{
+		now:       now,
+		resources: make(map[string]map[string]modelResource),
+	}
+}
+
+// expire removes expired resources
+func (m *model) expire() {
+	for category, resources := range m.resources {
+		for id, e := range resources {
+			if e.validUntil > 0 && m.now > e.validUntil {
+				m.remove(category, id)
+			}
+		}
+	}
+}
+
+// current returns the resource as it is now, with its remaining TTL
+func (m *model) current(e modelResource) dr.Dr {
+	resource := e.resource
+	if e.validUntil > 0 {
+		resource.TTL = e.validUntil - m.now
+	}
+	return resource
+}
+
+func (m *model) remove(category string, id string) {
+	delete(m.resources[category], id)
+	if len(m.resources[category]) == 0 {
+		delete(m.resources, category)
+	}
+}
+
+// step applies op to both the model and the storage, and describes how they
+// disagree, if they do
+func (m *model) step(storage dr.Storage, clock clockwork.FakeClock, op Op) string {
+
+	switch op.Kind {
+
+	case "Add":
+		resource := dr.Dr{
+			Category:    op.Category,
+			ID:          op.ID,
+			Resource:    "Resource-" + op.Category + "." + op.ID,
+			Description: "Item-" + op.Category + "." + op.ID,
+			TTL:         op.TTL,
+			Reusable:    op.Reusable,
+		}
+		var expected error
+		if op.ID == "" {
+			expected = dr.ErrUndefinedID
+		} else {
+			if _, ok := m.resources[op.Category]; !ok {
+				m.resources[op.Category] = make(map[string]modelResource)
+			}
+			e := modelResource{resource: resource}
+			if op.TTL > 0 {
+				e.validUntil = m.now + op.TTL
+			}
+			m.resources[op.Category][op.ID] = e
+		}
+		if err := storage.Add(resource); err != expected {
+			return fmt.Sprintf("got error %v, expected %v", err, expected)
+		}
+
+	case "Get":
+		m.expire()
+		resource, err := storage.Get(op.Category, op.ID)
+		e, ok := m.resources[op.Category][op.ID]
+		if !ok {
+			if err != dr.ErrResourceNotFound || !reflect.DeepEqual(resource, dr.Dr{}) {
+				return fmt.Sprintf("got %v %v, expected not found", resource, err)
+			}
+			break
+		}
+		expected := m.current(e)
+		if !e.resource.Reusable {
+			m.remove(op.Category, op.ID)
+		}
+		if err != nil || !reflect.DeepEqual(resource, expected) {
+			return fmt.Sprintf("got %v %v, expected %v", resource, err, expected)
+		}
+
+	case "List":
+		m.expire()
+		list, err := storage.List(op.Category)
+		expected := make(map[string]dr.Dr)
+		for id, e := range m.resources[op.Category] {
+			resource := m.current(e)
+			resource.Resource = ""
+			expected[id] = resource
+		}
+		if len(expected) == 0 {
+			// a storage may not notice a category has emptied until it looks
+			if len(list) != 0 || (err != nil && err != dr.ErrResourceNotFound && err != dr.ErrEmptyList) {
+				return fmt.Sprintf("got %v %v, expected nothing", list, err)
+			}
+			break
+		}
+		if err != nil || !reflect.DeepEqual(list, expected) {
+			return fmt.Sprintf("got %v %v, expected %v", list, err, expected)
+		}
+
+	case "Delete":
+		m.expire()
+		resource, err := storage.Delete(op.Category, op.ID)
+		e, ok := m.resources[op.Category][op.ID]
+		if !ok {
+			// including expired resources the storage hasn't cleaned yet
+			if err != dr.ErrResourceNotFound || !reflect.DeepEqual(resource, dr.Dr{}) {
+				return fmt.Sprintf("got %v %v, expected not found", resource, err)
+			}
+			break
+		}
+		m.remove(op.Category, op.ID)
+		expected := m.current(e)
+		if err != nil || !closeTTL(resource.TTL, expected.TTL) {
+			return fmt.Sprintf("got %v %v, expected %v", resource, err, expected)
+		}
+		resource.TTL = expected.TTL
+		if !reflect.DeepEqual(resource, expected) {
+			return fmt.Sprintf("got %v, expected %v", resource, expected)
+		}
+
+	case "Categories":
+		m.expire()
+		categories, err := storage.Categories()
+		expected := make(map[string]int)
+		for category, resources := range m.resources {
+			expected[category] = len(resources)
+		}
+		if len(expected) == 0 {
+			if err != dr.ErrEmptyStorage || len(categories) != 0 {
+				return fmt.Sprintf("got %v %v, expected empty storage", categories, err)
+			}
+			break
+		}
+		if err != nil || !reflect.DeepEqual(categories, expected) {
+			return fmt.Sprintf("got %v %v, expected %v", categories, err, expected)
+		}
+
+	case "Reset":
+		m.resources = make(map[string]map[string]modelResource)
+		if err := storage.Reset(); err != nil {
+			return fmt.Sprintf("got error %v", err)
+		}
+
+	case "Wait":
+		m.now += op.Seconds
+		clock.Advance(time.Duration(op.Seconds) * time.Second)
+	}
+
+	return ""
+}
+
+// closeTTL reports whether a remaining TTL is within modelTTLSlack of what
+// was expected, or exactly zero for a resource that never expires
+func closeTTL(got int64, expected int64) bool {
+
+	if expected == 0 {
+		return got == 0
+	}
+
+	return got > 0 && got >= expected-modelTTLSlack && got <= expected+modelTTLSlack
+}
+
+// run plays ops against a new storage, returning the index of the first op
+// on which the storage and model disagree, and how, or -1
+func run(tester Tester, ops []Op) (int, string) {
+
+	clock := clockwork.NewFakeClock()
+	storage := tester.NewWithClock(clock)
+	m := newModel(clock.Now().Unix())
+
+	for i, op := range ops {
+		if diff := m.step(storage, clock, op); diff != "" {
+			return i, diff
+		}
+	}
+
+	return -1, ""
+}
+
+// shrink removes ops from a failing sequence for as long as it still fails
+func shrink(tester Tester, ops []Op) []Op {
+
+	for i := 0; i < len(ops); {
+		candidate := append(append([]Op{}, ops[:i]...), ops[i+1:]...)
+		if failed, _ := run(tester, candidate); failed >= 0 {
+			ops = candidate
+		} else {
+			i++
+		}
+	}
+
+	return ops
+}
+
+var modelCategories = []string{"a", "b", "c/d"}
+var modelIDs = []string{"x", "y", "z"}
+var modelTTLs = []int64{0, 1, 2, 5}
+
+func randomOps(rng *rand.Rand, n int) []Op {
+
+	ops := make([]Op, n)
+
+	for i := range ops {
+		op := Op{
+			Category: modelCategories[rng.Intn(len(modelCategories))],
+			ID:       modelIDs[rng.Intn(len(modelIDs))],
+		}
+		switch k := rng.Intn(100); {
+		case k < 30:
+			op.Kind = "Add"
+			op.TTL = modelTTLs[rng.Intn(len(modelTTLs))]
+			op.Reusable = rng.Intn(2) == 0
+			if rng.Intn(20) == 0 {
+				op.ID = ""
+			}
+		case k < 50:
+			op.Kind = "Get"
+		case k < 62:
+			op.Kind = "List"
+		case k < 74:
+			op.Kind = "Delete"
+		case k < 84:
+			op.Kind = "Categories"
+		case k < 87:
+			op.Kind = "Reset"
+		default:
+			op.Kind = "Wait"
+			op.Seconds = rng.Int63n(3) + 1
+		}
+		ops[i] = op
+	}
+
+	return ops
+}
+
+// TestModel runs random sequences of operations against the storage and a
+// reference model, with a fake clock, and reports the shortest sequence it
+// can find that makes them disagree
+func TestModel(t *testing.T, tester Tester) {
+
+	if tester.NewWithClock == nil {
+		t.Skip("tester has no NewWithClock")
+	}
+
+	seed := ModelSeed
+	if env := os.Getenv("DR_MODEL_SEED"); seed == 0 && env != "" {
+		var err error
+		if seed, err = strconv.ParseInt(env, 10, 64); err != nil {
+			t.Fatalf("DR_MODEL_SEED: %v", err)
+		}
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("model seed %d", seed)
+
+	rng := rand.New(rand.NewSource(seed))
+
+	sequences := 500
+	if testing.Short() {
+		sequences = 50
+	}
+
+	for i := 0; i < sequences; i++ {
+
+		ops := randomOps(rng, 40)
+
+		if failed, _ := run(tester, ops); failed < 0 {
+			continue
+		}
+
+		ops = shrink(tester, ops)
+		failed, diff := run(tester, ops)
+
+		steps := make([]string, len(ops))
+		for j, op := range ops {
+			steps[j] = fmt.Sprintf("  %d: %v", j, op)
+		}
+
+		t.Errorf("**FAIL** storage disagrees with model at step %d: %s\n%s", failed, diff, strings.Join(steps, "\n"))
+		return
+	}
+
+	processResult(t, true, fmt.Sprintf("%d random sequences agree with model", sequences))
+}
@@ -1,10 +1,15 @@
 package test
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/timdrysdale/dr"
 )
 
@@ -15,6 +20,9 @@ type Tester struct {
 	New  func() dr.Storage
 	Done func(*dr.Storage)
 
+	// for tests that need time to pass quickly
+	NewWithClock func(clockwork.Clock) dr.Storage
+
 	// whatever you need. Leave nil if function does not apply
 }
 
@@ -555,3 +563,1118 @@ func processResult(t *testing.T, result bool, name string) {
 		t.Errorf("**FAIL** %s\n", name)
 	}
 }
+
+var addForPageTests = []dr.Dr{
+	dr.Dr{Category: "p", ID: "c", Description: "Item-p.c", Resource: "Resource-p.c", TTL: 300},
+	dr.Dr{Category: "p", ID: "a", Description: "Item-p.a", Resource: "Resource-p.a", TTL: 100},
+	dr.Dr{Category: "p", ID: "d", Description: "Item-p.d", Resource: "Resource-p.d", Reusable: true},
+	dr.Dr{Category: "p", ID: "b", Description: "Item-p.b", Resource: "Resource-p.b", TTL: 200},
+}
+
+var pageTests = []struct {
+	name        string
+	options     dr.ListOptions
+	idsExpected []string
+}{
+	{"page through category by ID", dr.ListOptions{Limit: 3}, []string{"a", "b", "c", "d"}},
+	{"page through category by ID descending", dr.ListOptions{Limit: 3, Descending: true}, []string{"d", "c", "b", "a"}},
+	{"page through category by expiry", dr.ListOptions{Limit: 2, Sort: dr.SortByExpiry}, []string{"a", "b", "c", "d"}},
+	{"page through category by insertion", dr.ListOptions{Limit: 1, Sort: dr.SortByAdded}, []string{"c", "a", "d", "b"}},
+	{"page through category by insertion descending", dr.ListOptions{Limit: 3, Sort: dr.SortByAdded, Descending: true}, []string{"b", "d", "a", "c"}},
+	{"unlimited page returns whole category", dr.ListOptions{Sort: dr.SortByExpiry}, []string{"a", "b", "c", "d"}},
+}
+
+func TestListPage(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	for _, resource := range addForPageTests {
+		processResult(t, storage.Add(resource) == nil, "add resource p."+resource.ID+" for page test")
+	}
+
+	for _, test := range pageTests {
+		ids, err := pageIDs(storage, "p", test.options)
+		result := (err == nil) && reflect.DeepEqual(ids, test.idsExpected)
+		if debugTest {
+			t.Log(ids)
+		}
+		processResult(t, result, test.name)
+	}
+
+	// resources must not have been revealed or consumed by paging
+	page, err := storage.ListPage("p", dr.ListOptions{})
+	result := (err == nil) && (len(page.Resources) == 4) && (page.Next == "")
+	for _, resource := range page.Resources {
+		if resource.Resource != "" || resource.TTL == 0 && !resource.Reusable {
+			result = false
+		}
+	}
+	processResult(t, result, "page omits resource field and keeps TTL")
+
+	// cursor stays valid when resources are taken between pages
+	page, err = storage.ListPage("p", dr.ListOptions{Limit: 2})
+	result = (err == nil) && (len(page.Resources) == 2)
+	_, _ = storage.Get("p", "b")
+	_, _ = storage.Get("p", "c")
+	page, err = storage.ListPage("p", dr.ListOptions{Limit: 2, Cursor: page.Next})
+	result = result && (err == nil) && (len(page.Resources) == 1) && (page.Resources[0].ID == "d") && (page.Next == "")
+	processResult(t, result, "cursor survives concurrent consumption")
+
+	_, err = storage.ListPage("p", dr.ListOptions{Sort: "colour"})
+	processResult(t, err == dr.ErrIllegalSort, "reject unknown sort order")
+
+	_, err = storage.ListPage("p", dr.ListOptions{Cursor: "not-a-cursor"})
+	processResult(t, err == dr.ErrIllegalCursor, "reject malformed cursor")
+
+	page, err = storage.ListPage("p", dr.ListOptions{Limit: 1})
+	_, err = storage.ListPage("p", dr.ListOptions{Limit: 1, Sort: dr.SortByAdded, Cursor: page.Next})
+	processResult(t, err == dr.ErrIllegalCursor, "reject cursor from a different sort order")
+
+	_, err = storage.ListPage("foo", dr.ListOptions{})
+	processResult(t, err == dr.ErrResourceNotFound, "throw error on paging nonexistent category")
+}
+
+// pageIDs follows the cursors through a category and returns the IDs in order
+func pageIDs(storage dr.Storage, category string, options dr.ListOptions) ([]string, error) {
+	ids := []string{}
+	for {
+		page, err := storage.ListPage(category, options)
+		if err != nil {
+			return ids, err
+		}
+		if options.Limit > 0 && len(page.Resources) > options.Limit {
+			return ids, errors.New("page exceeds limit")
+		}
+		for _, resource := range page.Resources {
+			ids = append(ids, resource.ID)
+		}
+		if page.Next == "" {
+			return ids, nil
+		}
+		options.Cursor = page.Next
+	}
+}
+
+func TestContext(t *testing.T, tester Tester) {
+
+	storage := dr.WithContext(tester.New())
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	live := context.Background()
+
+	result := (storage.AddContext(live, dr.Dr{Category: "c", ID: "a", Resource: "Resource-c.a"}) == nil)
+	processResult(t, result, "add resource c.a with live context")
+
+	err := storage.AddContext(cancelled, dr.Dr{Category: "c", ID: "b", Resource: "Resource-c.b"})
+	_, getErr := storage.GetContext(live, "c", "b")
+	result = (err == context.Canceled) && (getErr == dr.ErrResourceNotFound)
+	processResult(t, result, "add with cancelled context is refused")
+
+	resource, err := storage.GetContext(cancelled, "c", "a")
+	result = (err == context.Canceled) && reflect.DeepEqual(resource, dr.Dr{})
+	processResult(t, result, "get with cancelled context is refused")
+
+	resource, err = storage.GetContext(live, "c", "a")
+	result = (err == nil) && (resource.Resource == "Resource-c.a")
+	processResult(t, result, "single-use resource not consumed by cancelled get")
+
+	_, err = storage.CategoriesContext(cancelled)
+	processResult(t, err == context.Canceled, "categories with cancelled context is refused")
+
+	_, err = storage.ListContext(cancelled, "c")
+	processResult(t, err == context.Canceled, "list with cancelled context is refused")
+
+	_, err = storage.ListPageContext(cancelled, "c", dr.ListOptions{})
+	processResult(t, err == context.Canceled, "list page with cancelled context is refused")
+
+	_, err = storage.DeleteContext(cancelled, "c", "a")
+	processResult(t, err == context.Canceled, "delete with cancelled context is refused")
+
+	processResult(t, storage.HealthCheckContext(cancelled) == context.Canceled, "healthcheck with cancelled context is refused")
+
+	storage.AddContext(live, dr.Dr{Category: "c", ID: "d", Reusable: true})
+	err = storage.ResetContext(cancelled)
+	_, getErr = storage.GetContext(live, "c", "d")
+	result = (err == context.Canceled) && (getErr == nil)
+	processResult(t, result, "reset with cancelled context is refused")
+}
+
+var addBatchTests = []struct {
+	name           string
+	resources      []dr.Dr
+	mode           dr.BatchMode
+	errExpected    error
+	errsExpected   []error
+	listExpected   []string
+	categoryExists bool
+}{
+	{"all-or-nothing batch with a bad item adds nothing",
+		[]dr.Dr{
+			dr.Dr{Category: "b", ID: "a"},
+			dr.Dr{Category: "b", ID: "b.b"},
+		},
+		dr.AllOrNothing,
+		dr.ErrBatchFailed,
+		[]error{dr.ErrBatchAborted, dr.ErrIllegalID},
+		[]string{},
+		false},
+	{"best-effort batch with a bad item adds the rest",
+		[]dr.Dr{
+			dr.Dr{Category: "b", ID: "a"},
+			dr.Dr{Category: "b"},
+			dr.Dr{Category: "b", ID: "c"},
+		},
+		dr.BestEffort,
+		dr.ErrBatchFailed,
+		[]error{nil, dr.ErrUndefinedID, nil},
+		[]string{"a", "c"},
+		true},
+	{"all-or-nothing batch of good items adds them all",
+		[]dr.Dr{
+			dr.Dr{Category: "b", ID: "d"},
+			dr.Dr{Category: "b", ID: "e"},
+		},
+		dr.AllOrNothing,
+		nil,
+		[]error{nil, nil},
+		[]string{"a", "c", "d", "e"},
+		true},
+}
+
+var deleteBatchTests = []struct {
+	name         string
+	ids          []string
+	mode         dr.BatchMode
+	errExpected  error
+	errsExpected []error
+	listExpected []string
+}{
+	{"all-or-nothing delete with a missing item deletes nothing",
+		[]string{"a", "z"},
+		dr.AllOrNothing,
+		dr.ErrBatchFailed,
+		[]error{dr.ErrBatchAborted, dr.ErrResourceNotFound},
+		[]string{"a", "c", "d", "e"}},
+	{"all-or-nothing delete rejects the same item twice",
+		[]string{"a", "a"},
+		dr.AllOrNothing,
+		dr.ErrBatchFailed,
+		[]error{dr.ErrBatchAborted, dr.ErrResourceNotFound},
+		[]string{"a", "c", "d", "e"}},
+	{"best-effort delete with a missing item deletes the rest",
+		[]string{"a", "z", "c"},
+		dr.BestEffort,
+		dr.ErrBatchFailed,
+		[]error{nil, dr.ErrResourceNotFound, nil},
+		[]string{"d", "e"}},
+	{"all-or-nothing delete of existing items deletes them all",
+		[]string{"d", "e"},
+		dr.AllOrNothing,
+		nil,
+		[]error{nil, nil},
+		[]string{}},
+}
+
+func TestBatch(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	for _, test := range addBatchTests {
+		results, err := storage.AddBatch(test.resources, test.mode)
+		result := (err == test.errExpected) && batchErrs(results, test.resources) == nil &&
+			reflect.DeepEqual(resultErrs(results), test.errsExpected)
+		ids, listErr := pageIDs(storage, "b", dr.ListOptions{})
+		if test.categoryExists {
+			result = result && (listErr == nil) && reflect.DeepEqual(ids, test.listExpected)
+		} else {
+			result = result && (listErr == dr.ErrResourceNotFound)
+		}
+		if debugTest {
+			t.Log(results, err, ids)
+		}
+		processResult(t, result, test.name)
+	}
+
+	for _, test := range deleteBatchTests {
+		results, err := storage.DeleteBatch("b", test.ids, test.mode)
+		result := (err == test.errExpected) && reflect.DeepEqual(resultErrs(results), test.errsExpected)
+		for i, id := range test.ids {
+			result = result && (results[i].Category == "b") && (results[i].ID == id)
+		}
+		ids, _ := pageIDs(storage, "b", dr.ListOptions{})
+		result = result && reflect.DeepEqual(ids, test.listExpected)
+		if debugTest {
+			t.Log(results, err, ids)
+		}
+		processResult(t, result, test.name)
+	}
+
+	categories, _ := storage.Categories()
+	_, ok := categories["b"]
+	processResult(t, !ok, "DeleteBatch deletes empty categories")
+
+	if tester.NewWithClock == nil {
+		return
+	}
+
+	clock := clockwork.NewFakeClock()
+	storage = tester.NewWithClock(clock)
+
+	storage.Add(dr.Dr{Category: "c", ID: "a", TTL: 1})
+	storage.Add(dr.Dr{Category: "c", ID: "b", TTL: 1})
+	storage.Add(dr.Dr{Category: "c", ID: "c", TTL: 100})
+	clock.Advance(2 * time.Second)
+
+	_, err := storage.Delete("c", "a")
+	results, batchErr := storage.DeleteBatch("c", []string{"b", "c"}, dr.BestEffort)
+	result := (err == dr.ErrResourceNotFound) && (batchErr == dr.ErrBatchFailed) &&
+		reflect.DeepEqual(resultErrs(results), []error{dr.ErrResourceNotFound, nil})
+	processResult(t, result, "Delete and DeleteBatch treat expired resources as not found")
+}
+
+func resultErrs(results []dr.BatchResult) []error {
+	errs := []error{}
+	for _, result := range results {
+		errs = append(errs, result.Err)
+	}
+	return errs
+}
+
+// batchErrs checks results are in the same order as the batch
+func batchErrs(results []dr.BatchResult, resources []dr.Dr) error {
+	if len(results) != len(resources) {
+		return errors.New("wrong number of results")
+	}
+	for i, resource := range resources {
+		if results[i].Category != resource.Category || results[i].ID != resource.ID {
+			return errors.New("results out of order")
+		}
+	}
+	return nil
+}
+
+func TestExport(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	err := storage.Export(func(resource dr.Dr) error {
+		return errors.New("should not be called on empty storage")
+	})
+	processResult(t, err == nil, "export empty storage")
+
+	resources := []dr.Dr{
+		dr.Dr{Category: "e", ID: "b", Description: "Item-e.b", Resource: "Resource-e.b", TTL: 100},
+		dr.Dr{Category: "d", ID: "a", Description: "Item-d.a", Resource: "Resource-d.a", Reusable: true},
+		dr.Dr{Category: "e", ID: "a", Description: "Item-e.a", Resource: "Resource-e.a"},
+	}
+
+	for _, resource := range resources {
+		storage.Add(resource)
+	}
+
+	exported := []dr.Dr{}
+	err = storage.Export(func(resource dr.Dr) error {
+		exported = append(exported, resource)
+		return nil
+	})
+
+	expected := []dr.Dr{resources[1], resources[2], resources[0]}
+	result := (err == nil) && (len(exported) == 3)
+	if result {
+		ttl := exported[2].TTL
+		result = (ttl == 100 || ttl == 99) //in case we crossed a second boundary
+		exported[2].TTL = 100
+	}
+	result = result && reflect.DeepEqual(exported, expected)
+	processResult(t, result, "export everything in order, with resource and remaining TTL")
+
+	// export must not consume single-use resources
+	resource, err := storage.Get("e", "a")
+	processResult(t, (err == nil) && (resource.Resource == "Resource-e.a"), "export does not consume resources")
+
+	stop := errors.New("stop")
+	count := 0
+	err = storage.Export(func(resource dr.Dr) error {
+		count++
+		return stop
+	})
+	processResult(t, (err == stop) && (count == 1), "export stops at first error")
+}
+
+var policyTests = []struct {
+	name        string
+	policy      dr.Policy
+	resource    dr.Dr
+	errExpected error
+}{
+	{"reject TTL over maximum",
+		dr.Policy{MaxTTL: 10},
+		dr.Dr{Category: "q", ID: "a", TTL: 11},
+		dr.ErrTTLTooLong},
+	{"reject living forever when there is a maximum TTL",
+		dr.Policy{MaxTTL: 10},
+		dr.Dr{Category: "q", ID: "a"},
+		dr.ErrTTLTooLong},
+	{"accept living forever by default TTL when there is a maximum TTL",
+		dr.Policy{MaxTTL: 10, DefaultTTL: 5},
+		dr.Dr{Category: "q", ID: "a"},
+		nil},
+	{"reject reusable when forbidden",
+		dr.Policy{ForbidReusable: true},
+		dr.Dr{Category: "q", ID: "a", Reusable: true},
+		dr.ErrReusableNotAllowed},
+	{"reject large description",
+		dr.Policy{MaxDescriptionSize: 4},
+		dr.Dr{Category: "q", ID: "a", Description: "12345"},
+		dr.ErrDescriptionTooLarge},
+	{"reject large resource",
+		dr.Policy{MaxResourceSize: 4},
+		dr.Dr{Category: "q", ID: "a", Resource: "12345"},
+		dr.ErrResourceTooLarge},
+	{"reject description missing required key",
+		dr.Policy{RequiredDescriptionKeys: []string{"lab", "type"}},
+		dr.Dr{Category: "q", ID: "a", Description: `{"lab":"ed"}`},
+		dr.ErrDescriptionKeys},
+	{"reject description that is not a JSON object",
+		dr.Policy{RequiredDescriptionKeys: []string{"lab"}},
+		dr.Dr{Category: "q", ID: "a", Description: "lab"},
+		dr.ErrDescriptionKeys},
+	{"accept description with required keys",
+		dr.Policy{RequiredDescriptionKeys: []string{"lab", "type"}},
+		dr.Dr{Category: "q", ID: "a", Description: `{"lab":"ed","type":"pendulum","extra":1}`},
+		nil},
+}
+
+func TestPolicy(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	policies, ok := storage.(dr.PolicyStorage)
+	if !ok {
+		t.Skip("storage does not implement dr.PolicyStorage")
+	}
+
+	_, err := policies.GetPolicy("q")
+	processResult(t, err == dr.ErrPolicyNotFound, "throw error getting nonexistent policy")
+
+	err = policies.SetPolicy("q", dr.Policy{MaxTTL: 5, DefaultTTL: 10})
+	processResult(t, err == dr.ErrIllegalPolicy, "reject default TTL over maximum TTL")
+
+	for _, test := range policyTests {
+		policies.SetPolicy("q", test.policy)
+		err := storage.Add(test.resource)
+		processResult(t, err == test.errExpected, test.name)
+	}
+
+	// default TTL
+	policies.SetPolicy("q", dr.Policy{DefaultTTL: 100})
+	storage.Add(dr.Dr{Category: "q", ID: "b", Reusable: true})
+	resource, err := storage.Get("q", "b")
+	result := (err == nil) && (resource.TTL == 100 || resource.TTL == 99)
+	processResult(t, result, "apply default TTL")
+
+	// capacity, including batches and replacements
+	storage.Reset()
+	policies.SetPolicy("q", dr.Policy{MaxResources: 2})
+	results, err := storage.AddBatch([]dr.Dr{
+		dr.Dr{Category: "q", ID: "a"},
+		dr.Dr{Category: "q", ID: "a"},
+		dr.Dr{Category: "q", ID: "b"},
+		dr.Dr{Category: "q", ID: "c"},
+	}, dr.BestEffort)
+	result = (err == dr.ErrBatchFailed) && reflect.DeepEqual(resultErrs(results), []error{nil, nil, nil, dr.ErrCategoryFull})
+	processResult(t, result, "reject batch items over category maximum")
+
+	processResult(t, storage.Add(dr.Dr{Category: "q", ID: "a", Description: "new"}) == nil, "accept replacement in full category")
+	processResult(t, storage.Add(dr.Dr{Category: "q", ID: "c"}) == dr.ErrCategoryFull, "reject addition to full category")
+
+	storage.Get("q", "a")
+	processResult(t, storage.Add(dr.Dr{Category: "q", ID: "c"}) == nil, "accept addition once category has room")
+
+	// other categories unaffected
+	processResult(t, storage.Add(dr.Dr{Category: "r", ID: "a", Reusable: true, TTL: 1000}) == nil, "policy only applies to its category")
+
+	policies.SetPolicy("r", dr.Policy{ForbidReusable: true})
+	all, err := policies.Policies()
+	result = (err == nil) && reflect.DeepEqual(all, map[string]dr.Policy{
+		"q": dr.Policy{MaxResources: 2},
+		"r": dr.Policy{ForbidReusable: true},
+	})
+	processResult(t, result, "list policies")
+
+	processResult(t, policies.DeletePolicy("q") == nil, "delete policy")
+	processResult(t, storage.Add(dr.Dr{Category: "q", ID: "d"}) == nil, "accept addition once policy deleted")
+	processResult(t, policies.DeletePolicy("q") == dr.ErrPolicyNotFound, "throw error deleting nonexistent policy")
+}
+
+const pendulumSchema = `{
+	"type": "object",
+	"properties": {
+		"lab": {"type": "string"},
+		"length": {"type": "number"}
+	},
+	"required": ["lab"],
+	"additionalProperties": false
+}`
+
+var schemaTests = []struct {
+	name        string
+	description string
+	errExpected error
+}{
+	{"accept description matching schema", `{"lab":"ed","length":0.5}`, nil},
+	{"reject description missing required key", `{"length":0.5}`, dr.ErrDescriptionSchema},
+	{"reject description with misspelled key", `{"lab":"ed","lenght":0.5}`, dr.ErrDescriptionSchema},
+	{"reject description with wrong type", `{"lab":"ed","length":"long"}`, dr.ErrDescriptionSchema},
+	{"reject description that is not JSON", `pendulum`, dr.ErrDescriptionSchema},
+}
+
+func TestSchema(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	schemas, ok := storage.(dr.SchemaStorage)
+	if !ok {
+		t.Skip("storage does not implement dr.SchemaStorage")
+	}
+
+	_, err := schemas.GetSchema("s")
+	processResult(t, err == dr.ErrSchemaNotFound, "throw error getting nonexistent schema")
+
+	processResult(t, schemas.SetSchema("s", `{"type": 7}`) == dr.ErrIllegalSchema, "reject illegal schema")
+	processResult(t, schemas.SetSchema("s", pendulumSchema) == nil, "set schema")
+
+	text, err := schemas.GetSchema("s")
+	processResult(t, (err == nil) && (text == pendulumSchema), "get schema")
+
+	for _, test := range schemaTests {
+		err := storage.Add(dr.Dr{Category: "s", ID: "a", Description: test.description})
+		result := errors.Is(err, test.errExpected)
+		if schemaErr, ok := err.(*dr.SchemaError); ok {
+			result = result && (schemaErr.Category == "s") && (len(schemaErr.Problems) > 0)
+		} else {
+			result = result && (err == nil)
+		}
+		if debugTest {
+			t.Log(err)
+		}
+		processResult(t, result, test.name)
+	}
+
+	results, err := storage.AddBatch([]dr.Dr{
+		dr.Dr{Category: "s", ID: "b", Description: `{"lab":"ed"}`},
+		dr.Dr{Category: "s", ID: "c", Description: `{}`},
+	}, dr.AllOrNothing)
+	result := (err == dr.ErrBatchFailed) && (results[0].Err == dr.ErrBatchAborted) && errors.Is(results[1].Err, dr.ErrDescriptionSchema)
+	processResult(t, result, "reject batch with description not matching schema")
+
+	processResult(t, storage.Add(dr.Dr{Category: "t", ID: "a", Description: "free text"}) == nil, "schema only applies to its category")
+
+	all, err := schemas.Schemas()
+	result = (err == nil) && reflect.DeepEqual(all, map[string]string{"s": pendulumSchema})
+	processResult(t, result, "list schemas")
+
+	processResult(t, schemas.DeleteSchema("s") == nil, "delete schema")
+	processResult(t, storage.Add(dr.Dr{Category: "s", ID: "a", Description: "free text"}) == nil, "accept any description once schema deleted")
+	processResult(t, schemas.DeleteSchema("s") == dr.ErrSchemaNotFound, "throw error deleting nonexistent schema")
+}
+
+func TestHierarchy(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	_, err := storage.ListMatching("labs/**")
+	processResult(t, err == dr.ErrResourceNotFound, "list matching on empty storage")
+
+	for _, category := range []string{"labs//pendulum", "labs/*", "/labs", "labs/"} {
+		err = storage.Add(dr.Dr{Category: category, ID: "a"})
+		processResult(t, err == dr.ErrIllegalCategory, "reject illegal hierarchical category "+category)
+	}
+
+	err = storage.Add(dr.Dr{Category: "labs", ID: "a/b"})
+	processResult(t, err == dr.ErrIllegalID, "reject path separator in ID")
+
+	resources := []dr.Dr{
+		dr.Dr{Category: "labs/ed/pendulum", ID: "a", Description: "Item-a", Resource: "Resource-a"},
+		dr.Dr{Category: "labs/ed/pendulum", ID: "b", Description: "Item-b", Resource: "Resource-b"},
+		dr.Dr{Category: "labs/ed/spinner", ID: "c", Description: "Item-c", Resource: "Resource-c"},
+		dr.Dr{Category: "labs/gla/pendulum", ID: "d", Description: "Item-d", Resource: "Resource-d"},
+		dr.Dr{Category: "labs", ID: "e", Description: "Item-e", Resource: "Resource-e"},
+		dr.Dr{Category: "other", ID: "f", Description: "Item-f", Resource: "Resource-f"},
+	}
+
+	for _, resource := range resources {
+		err = storage.Add(resource)
+		processResult(t, err == nil, "add to hierarchical category "+resource.Category)
+	}
+
+	list, err := storage.List("labs/ed/pendulum")
+	processResult(t, (err == nil) && (len(list) == 2), "list exact hierarchical category")
+
+	lists, err := storage.ListMatching("labs/*/pendulum")
+	result := (err == nil) && (len(lists) == 2) &&
+		(len(lists["labs/ed/pendulum"]) == 2) && (len(lists["labs/gla/pendulum"]) == 1)
+	processResult(t, result, "list matching single level wildcard")
+
+	result = (lists["labs/ed/pendulum"]["a"].Description == "Item-a") &&
+		(lists["labs/ed/pendulum"]["a"].Resource == "")
+	processResult(t, result, "list matching hides resources")
+
+	lists, err = storage.ListMatching("labs/**")
+	processResult(t, (err == nil) && (len(lists) == 4), "list matching subtree, including its root")
+
+	lists, err = storage.ListMatching("labs/ed")
+	processResult(t, err == dr.ErrResourceNotFound, "pattern without wildcards only matches itself")
+
+	categories, err := storage.CategoriesMatching("labs/ed/**")
+	expected := map[string]int{"labs/ed/pendulum": 2, "labs/ed/spinner": 1}
+	processResult(t, (err == nil) && reflect.DeepEqual(categories, expected), "categories matching subtree")
+
+	// empty a category by getting its only single-use resource
+	resource, err := storage.Get("labs/ed/spinner", "c")
+	processResult(t, (err == nil) && (resource.Resource == "Resource-c"), "get from hierarchical category")
+
+	categories, err = storage.CategoriesMatching("labs/ed/**")
+	expected = map[string]int{"labs/ed/pendulum": 2}
+	processResult(t, (err == nil) && reflect.DeepEqual(categories, expected), "categories matching omits emptied category")
+}
+
+func TestLabels(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	selector, _ := dr.ParseSelector("lab=ed")
+
+	_, err := storage.Search(selector)
+	processResult(t, err == dr.ErrResourceNotFound, "search empty storage")
+
+	err = storage.Add(dr.Dr{Category: "a", ID: "a", Labels: map[string]string{"lab": "e d"}})
+	processResult(t, err == dr.ErrIllegalLabel, "reject illegal label")
+
+	resources := []dr.Dr{
+		dr.Dr{Category: "pendulum", ID: "a", Resource: "Resource-a", Labels: map[string]string{"lab": "ed", "type": "real"}},
+		dr.Dr{Category: "pendulum", ID: "b", Resource: "Resource-b", Labels: map[string]string{"lab": "ed", "type": "sim"}},
+		dr.Dr{Category: "pendulum", ID: "c", Resource: "Resource-c", Labels: map[string]string{"lab": "gla", "type": "real"}},
+		dr.Dr{Category: "spinner", ID: "d", Resource: "Resource-d", Labels: map[string]string{"lab": "ed"}, Reusable: true},
+		dr.Dr{Category: "spinner", ID: "e", Resource: "Resource-e"},
+	}
+
+	for _, resource := range resources {
+		storage.Add(resource)
+	}
+
+	// the store must keep its own copy of the labels
+	resources[0].Labels["lab"] = "changed"
+
+	lists, err := storage.Search(selector)
+	result := (err == nil) && (len(lists) == 2) && (len(lists["pendulum"]) == 2) && (len(lists["spinner"]) == 1)
+	processResult(t, result, "search across categories")
+
+	result = result && (lists["pendulum"]["a"].Labels["lab"] == "ed") && (lists["pendulum"]["a"].Resource == "")
+	processResult(t, result, "search returns labels but hides resources")
+
+	selector, _ = dr.ParseSelector("lab=ed,type!=sim")
+	list, err := storage.ListSelected("pendulum", selector)
+	_, ok := list["a"]
+	processResult(t, (err == nil) && (len(list) == 1) && ok, "list selected in category")
+
+	selector, _ = dr.ParseSelector("!type")
+	categories, err := storage.CategoriesSelected(selector)
+	expected := map[string]int{"spinner": 2}
+	processResult(t, (err == nil) && reflect.DeepEqual(categories, expected), "categories selected without positive requirement")
+
+	selector, _ = dr.ParseSelector("type")
+	categories, err = storage.CategoriesSelected(selector)
+	expected = map[string]int{"pendulum": 3}
+	processResult(t, (err == nil) && reflect.DeepEqual(categories, expected), "categories selected by existence")
+
+	_, err = storage.ListSelected("spinner", selector)
+	processResult(t, err == dr.ErrResourceNotFound, "list selected with no matches")
+
+	// labels are dropped from the selection when the resource goes
+	storage.Get("pendulum", "a")
+	storage.Delete("pendulum", "b")
+
+	storage.Add(dr.Dr{Category: "spinner", ID: "d", Resource: "Resource-d", Labels: map[string]string{"lab": "gla"}})
+
+	selector, _ = dr.ParseSelector("lab=ed")
+	_, err = storage.Search(selector)
+	processResult(t, err == dr.ErrResourceNotFound, "search after removing and relabelling")
+
+	selector, _ = dr.ParseSelector("lab=gla")
+	categories, err = storage.CategoriesSelected(selector)
+	expected = map[string]int{"pendulum": 1, "spinner": 1}
+	processResult(t, (err == nil) && reflect.DeepEqual(categories, expected), "search finds relabelled resource")
+
+	if testing.Short() {
+		return
+	}
+
+	storage.Reset()
+	storage.Add(dr.Dr{Category: "a", ID: "a", TTL: 1, Labels: map[string]string{"lab": "ed"}})
+	time.Sleep(2 * time.Second)
+
+	selector, _ = dr.ParseSelector("lab=ed")
+	_, err = storage.Search(selector)
+	processResult(t, err == dr.ErrResourceNotFound, "search omits expired resources")
+}
+
+func TestAddGenerated(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	rejected, err := storage.AddGenerated(dr.Dr{Category: "a", ID: "a"})
+	processResult(t, (err == dr.ErrIllegalID) && (rejected.ID == "") && (rejected.Category == ""), "reject generating over a given ID")
+
+	_, err = storage.AddGenerated(dr.Dr{Category: "a.b"})
+	processResult(t, err == dr.ErrIllegalCategory, "reject generating in illegal category")
+
+	seen := make(map[string]bool)
+	result := true
+
+	for i := 0; i < 100; i++ {
+		resource, err := storage.AddGenerated(dr.Dr{Category: "a", Resource: "Resource-a", TTL: 100})
+		result = result && (err == nil) && (resource.ID != "") && !seen[resource.ID] &&
+			(resource.Category == "a") && (resource.TTL == 100)
+		seen[resource.ID] = true
+	}
+	processResult(t, result, "generate distinct IDs")
+
+	categories, err := storage.Categories()
+	processResult(t, (err == nil) && (categories["a"] == 100), "generated resources are stored")
+
+	for id := range seen {
+		resource, err := storage.Get("a", id)
+		processResult(t, (err == nil) && (resource.Resource == "Resource-a"), "get by generated ID")
+		break
+	}
+
+	policies, ok := storage.(dr.PolicyStorage)
+	if !ok {
+		return
+	}
+
+	err = policies.SetPolicy("b", dr.Policy{IDScheme: "serial"})
+	processResult(t, err == dr.ErrIllegalPolicy, "reject unknown ID scheme")
+
+	err = policies.SetPolicy("b", dr.Policy{IDScheme: dr.IDSchemeULID, DefaultTTL: 60})
+	processResult(t, err == nil, "set ULID scheme")
+
+	resource, err := storage.AddGenerated(dr.Dr{Category: "b"})
+	processResult(t, (err == nil) && (len(resource.ID) == 26) && (resource.TTL == 60), "generate ULID, applying policy")
+}
+
+func TestTemplate(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	templates, ok := storage.(dr.TemplateStorage)
+	if !ok {
+		t.Skip("storage does not support templates")
+	}
+
+	count := 0
+	generator := dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+		count++
+		return template.Resource + "-" + strconv.Itoa(count), nil
+	})
+
+	err := templates.AddTemplate(dr.Dr{Category: "a", ID: "t"}, nil)
+	processResult(t, err == dr.ErrIllegalTemplate, "reject template without generator")
+
+	err = templates.AddTemplate(dr.Dr{Category: "a", ID: "t", Reusable: true}, generator)
+	processResult(t, err == dr.ErrIllegalTemplate, "reject reusable template")
+
+	err = templates.AddTemplate(dr.Dr{Category: "a.b", ID: "t"}, generator)
+	processResult(t, err == dr.ErrIllegalCategory, "reject template in illegal category")
+
+	template := dr.Dr{Category: "a", ID: "t", Description: "Item-t", Resource: "token", TTL: 100}
+	err = templates.AddTemplate(template, generator)
+	processResult(t, err == nil, "add template")
+
+	storage.Add(dr.Dr{Category: "a", ID: "r", Resource: "Resource-r"})
+
+	list, err := storage.List("a")
+	result := (err == nil) && (len(list) == 2) && (list["t"].Description == "Item-t") &&
+		(list["t"].Resource == "") && !list["t"].Reusable
+	processResult(t, result, "list template alongside ordinary resources")
+
+	first, err := storage.Get("a", "t")
+	result = (err == nil) && (first.Resource == "token-1") && (first.ID == "t") && !first.Reusable &&
+		(first.TTL == 100 || first.TTL == 99)
+	processResult(t, result, "get mints a resource from the template")
+
+	second, err := storage.Get("a", "t")
+	processResult(t, (err == nil) && (second.Resource == "token-2"), "get mints a fresh resource each time")
+
+	err = storage.Export(func(resource dr.Dr) error {
+		if resource.ID == "t" {
+			return errors.New("template exported")
+		}
+		return nil
+	})
+	processResult(t, err == nil, "export leaves out templates")
+
+	failing := dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+		return "", errors.New("out of stock")
+	})
+	templates.AddTemplate(dr.Dr{Category: "b", ID: "t"}, failing)
+	_, err = storage.Get("b", "t")
+	processResult(t, err != nil && err.Error() == "out of stock", "get passes on generator error")
+
+	_, err = storage.Delete("a", "t")
+	processResult(t, err == nil, "delete template")
+
+	_, err = storage.Get("a", "t")
+	processResult(t, err == dr.ErrResourceNotFound, "get deleted template")
+
+	if tester.NewWithClock == nil {
+		return
+	}
+
+	clock := clockwork.NewFakeClock()
+	storage = tester.NewWithClock(clock)
+	templates = storage.(dr.TemplateStorage)
+
+	var seen int64
+	templates.AddTemplate(template, dr.GeneratorFunc(func(template dr.Dr) (string, error) {
+		seen = template.TTL
+		return template.Resource, nil
+	}))
+
+	clock.Advance(90 * time.Second)
+
+	minted, err := storage.Get("a", "t")
+	processResult(t, (err == nil) && (minted.TTL == 10) && (seen == 10), "mint from template with the TTL it has left")
+}
+
+func TestTenants(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	tenants, ok := storage.(dr.TenantStorage)
+	if !ok {
+		t.Skip("storage does not implement dr.TenantStorage")
+	}
+
+	_, err := tenants.Tenant("a/b")
+	processResult(t, err == dr.ErrIllegalTenant, "reject illegal tenant")
+
+	self, err := tenants.Tenant("")
+	processResult(t, err == nil, "get default tenant")
+
+	a, errA := tenants.Tenant("a")
+	b, errB := tenants.Tenant("b")
+	processResult(t, (errA == nil) && (errB == nil), "create tenants")
+
+	again, err := tenants.Tenant("a")
+	processResult(t, err == nil, "get existing tenant")
+
+	names, err := tenants.Tenants()
+	processResult(t, (err == nil) && reflect.DeepEqual(names, []string{"a", "b"}), "list tenants")
+
+	storage.Add(dr.Dr{Category: "c", ID: "default", Resource: "Resource-default", TTL: 100})
+	a.Add(dr.Dr{Category: "c", ID: "a", Resource: "Resource-a", TTL: 100})
+	b.Add(dr.Dr{Category: "c", ID: "b", Resource: "Resource-b", TTL: 100})
+
+	_, err = a.Get("c", "b")
+	processResult(t, err == dr.ErrResourceNotFound, "tenants can't see each other's resources")
+
+	_, err = storage.Get("c", "a")
+	processResult(t, err == dr.ErrResourceNotFound, "default tenant can't see other tenants' resources")
+
+	list, err := again.List("c")
+	processResult(t, (err == nil) && (len(list) == 1) && (list["a"].ID == "a"), "tenant lists only its own resources")
+
+	list, err = self.List("c")
+	processResult(t, (err == nil) && (len(list) == 1) && (list["default"].ID == "default"), "default tenant is the storage itself")
+
+	err = a.Reset()
+	processResult(t, err == nil, "reset tenant")
+
+	_, errB = b.Get("c", "b")
+	_, err = storage.Get("c", "default")
+	processResult(t, (errB == nil) && (err == nil), "reset leaves other tenants alone")
+
+	b.Add(dr.Dr{Category: "c", ID: "b2", Resource: "Resource-b2", TTL: 100})
+
+	err = storage.Reset()
+	processResult(t, err == nil, "reset default tenant")
+
+	_, errB = b.Get("c", "b2")
+	processResult(t, errB == nil, "default reset leaves other tenants alone")
+}
+
+func TestTrash(t *testing.T, tester Tester) {
+
+	storage := tester.New()
+
+	trash, ok := storage.(dr.TrashStorage)
+	if !ok {
+		t.Skip("storage does not implement dr.TrashStorage")
+	}
+
+	grace, err := trash.GracePeriod()
+	processResult(t, (err == nil) && (grace == 0), "trash off by default")
+
+	storage.Add(dr.Dr{Category: "a", ID: "off", Resource: "Resource-off", TTL: 100})
+	storage.Delete("a", "off")
+	trashed, err := trash.Trash()
+	processResult(t, (err == nil) && (len(trashed) == 0), "nothing kept while trash is off")
+
+	err = trash.SetGracePeriod(-1)
+	processResult(t, err == dr.ErrIllegalGracePeriod, "reject negative grace period")
+
+	err = trash.SetGracePeriod(100)
+	processResult(t, err == nil, "set grace period")
+
+	labels := map[string]string{"lab": "ed"}
+	storage.Add(dr.Dr{Category: "a", ID: "a", Resource: "Resource-a", Labels: labels, TTL: 100})
+	storage.Add(dr.Dr{Category: "a", ID: "b", Resource: "Resource-b", Reusable: true})
+	storage.Add(dr.Dr{Category: "a", ID: "c", Resource: "Resource-c", TTL: 100})
+	storage.Add(dr.Dr{Category: "b", ID: "d", Resource: "Resource-d", TTL: 100})
+
+	storage.Get("a", "c") // used up, not deleted
+	storage.Delete("a", "a")
+	storage.DeleteBatch("a", []string{"b"}, dr.AllOrNothing)
+	storage.Reset()
+
+	trashed, err = trash.Trash()
+	result := (err == nil) && (len(trashed["a"]) == 2) && (len(trashed["b"]) == 1) &&
+		(trashed["a"]["a"].Resource == "") && (trashed["a"]["a"].TTL > 98) && (trashed["a"]["a"].TTL <= 100) &&
+		(trashed["a"]["b"].TTL == 0)
+	processResult(t, result, "deleted and reset resources in trash, without secrets, but not those used up")
+
+	_, err = trash.Restore("a", "c")
+	processResult(t, err == dr.ErrResourceNotFound, "can't restore what isn't in the trash")
+
+	resource, err := trash.Restore("a", "a")
+	processResult(t, (err == nil) && (resource.Resource == "Resource-a") && (resource.TTL > 98), "restore resource")
+
+	selected, err := storage.Search(dr.Selector{{Key: "lab", Operator: dr.Equals, Value: "ed"}})
+	processResult(t, (err == nil) && (len(selected["a"]) == 1), "restored resource can be found by its labels")
+
+	resource, err = storage.Get("a", "a")
+	result = (err == nil) && (resource.Resource == "Resource-a") && (resource.TTL > 98) && (resource.TTL <= 100) &&
+		reflect.DeepEqual(resource.Labels, labels)
+	processResult(t, result, "restored resource keeps remaining TTL and labels")
+
+	storage.Add(dr.Dr{Category: "b", ID: "d", Resource: "Resource-d2", TTL: 100})
+	_, err = trash.Restore("b", "d")
+	processResult(t, err == dr.ErrResourceExists, "don't restore over a newer resource")
+
+	trashed, _ = trash.Trash()
+	processResult(t, (len(trashed["a"]) == 1) && (len(trashed["b"]) == 1), "restored resource leaves trash")
+
+	err = trash.SetGracePeriod(0)
+	trashed, _ = trash.Trash()
+	processResult(t, (err == nil) && (len(trashed) == 0), "shortening grace period purges trash")
+
+	if testing.Short() {
+		return
+	}
+
+	trash.SetGracePeriod(1)
+	storage.Add(dr.Dr{Category: "c", ID: "a", Resource: "Resource-a", TTL: 100})
+	storage.Add(dr.Dr{Category: "c", ID: "b", Resource: "Resource-b", TTL: 100})
+	storage.Delete("c", "a")
+	time.Sleep(2 * time.Second)
+	storage.Delete("c", "b")
+
+	trashed, _ = trash.Trash()
+	processResult(t, (len(trashed["c"]) == 1) && (trashed["c"]["b"].ID == "b"), "purge after grace period")
+}
+
+// TestConcurrency checks the storage holds together when used from many
+// goroutines at once; run it with -race
+func TestConcurrency(t *testing.T, tester Tester) {
+
+	const callers = 20
+
+	storage := tester.New()
+	withContext := dr.WithContext(storage)
+
+	// single-use resources are revealed to exactly one of many callers
+	for _, id := range []string{"a", "b", "c"} {
+		storage.Add(dr.Dr{Category: "single", ID: id, Resource: "Resource-" + id, TTL: 100})
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	revealed := make(map[string]int)
+	unexpected := 0
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, id := range []string{"a", "b", "c"} {
+				var resource dr.Dr
+				var err error
+				if i%2 == 0 {
+					resource, err = storage.Get("single", id)
+				} else {
+					resource, err = withContext.GetContext(context.Background(), "single", id)
+				}
+				lock.Lock()
+				switch {
+				case err == nil && resource.Resource == "Resource-"+id:
+					revealed[id]++
+				case err != dr.ErrResourceNotFound:
+					unexpected++
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	result := (unexpected == 0) && reflect.DeepEqual(revealed, map[string]int{"a": 1, "b": 1, "c": 1})
+	processResult(t, result, "single-use resource revealed to exactly one concurrent Get")
+
+	// add racing delete leaves exactly what was added and not then deleted
+	storage.Reset()
+
+	present := make(map[string]bool)
+	unexpected = 0
+
+	for i := 0; i < callers; i++ {
+		id := strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := storage.Add(dr.Dr{Category: "race", ID: id, Resource: "Resource-" + id, Reusable: true}); err != nil {
+				lock.Lock()
+				unexpected++
+				lock.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := storage.Delete("race", id)
+			lock.Lock()
+			switch err {
+			case nil:
+			case dr.ErrResourceNotFound:
+				present[id] = true // delete came first, so add wins
+			default:
+				unexpected++
+			}
+			lock.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	list, err := storage.List("race")
+	if len(present) == 0 && err == dr.ErrResourceNotFound {
+		err = nil
+	}
+	result = (err == nil) && (unexpected == 0) && (len(list) == len(present))
+	for id := range list {
+		result = result && present[id]
+	}
+	processResult(t, result, "add racing delete leaves only resources added after their delete")
+
+	// reset under load leaves storage empty and healthy
+	storage.Reset()
+
+	stop := make(chan struct{})
+	unexpected = 0
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				errs := []error{
+					storage.Add(dr.Dr{Category: "load", ID: id, Resource: "Resource-" + id, TTL: 100}),
+				}
+				_, err := storage.Get("load", id)
+				errs = append(errs, err)
+				_, err = storage.List("load")
+				errs = append(errs, err)
+				_, err = storage.Categories()
+				errs = append(errs, err)
+				for _, err := range errs {
+					switch err {
+					case nil, dr.ErrResourceNotFound, dr.ErrEmptyStorage, dr.ErrEmptyList:
+					default:
+						lock.Lock()
+						unexpected++
+						lock.Unlock()
+					}
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := storage.Reset(); err != nil {
+			lock.Lock()
+			unexpected++
+			lock.Unlock()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	storage.Reset()
+	categories, err := storage.Categories()
+	result = (unexpected == 0) && (err == dr.ErrEmptyStorage) && (len(categories) == 0) && (storage.HealthCheck() == nil)
+	processResult(t, result, "reset under load leaves storage empty and healthy")
+
+	// nothing after this point will run if the test is -short
+	if testing.Short() {
+		t.Skip("**SKIP** skipping concurrent expiry test")
+	}
+
+	// list during expiry never shows expired resources, nor errors
+	for i := 0; i < callers; i++ {
+		id := strconv.Itoa(i)
+		storage.Add(dr.Dr{Category: "expiry", ID: id, Resource: "Resource-" + id, TTL: 1})
+	}
+	storage.Add(dr.Dr{Category: "expiry", ID: "keep", Resource: "Resource-keep", TTL: 100})
+
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	unexpected = 0
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				list, err := storage.List("expiry")
+				if err != nil || list["keep"].ID != "keep" {
+					lock.Lock()
+					unexpected++
+					lock.Unlock()
+				}
+				for _, resource := range list {
+					if resource.TTL < 0 {
+						lock.Lock()
+						unexpected++
+						lock.Unlock()
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	list, err = storage.List("expiry")
+	result = (unexpected == 0) && (err == nil) && (len(list) == 1)
+	processResult(t, result, "list during expiry shows only unexpired resources")
+}
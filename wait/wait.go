@@ -0,0 +1,103 @@
+// package wait provides long-poll helpers on top of any dr.ContextStorage, so
+// consumers can block until a category has something in it instead of polling
+package wait
+
+import (
+	"context"
+	"time"
+
+	"github.com/timdrysdale/dr"
+)
+
+// PollInterval is how often storage that is not a dr.Notifier is re-checked
+var PollInterval = 250 * time.Millisecond
+
+// List waits until the category has at least one resource, then lists it.
+// If ctx is done first, List returns the error from the last attempt
+// (typically dr.ErrResourceNotFound), as if it had not waited.
+func List(ctx context.Context, store dr.ContextStorage, category string) (map[string]dr.Dr, error) {
+
+	for {
+		arrival := notify(store, category) //before List so we can't miss an Add
+
+		list, err := store.ListContext(ctx, category)
+		if err == nil && len(list) > 0 {
+			return list, nil
+		}
+
+		if !await(ctx, arrival) {
+			return list, err
+		}
+	}
+}
+
+// Take waits until the category has a resource, then gets it. Resources
+// expiring soonest are taken first. Single-use resources are revealed to
+// only one caller, because a resource taken by someone else in the meantime
+// is passed over and the wait continues.
+func Take(ctx context.Context, store dr.ContextStorage, category string) (dr.Dr, error) {
+
+	for {
+		arrival := notify(store, category)
+
+		page, err := store.ListPageContext(ctx, category, dr.ListOptions{Sort: dr.SortByExpiry})
+
+		for _, candidate := range page.Resources {
+			resource, err := store.GetContext(ctx, category, candidate.ID)
+			if err == nil {
+				return resource, nil
+			}
+			if err != dr.ErrResourceNotFound && ctx.Err() == nil {
+				return dr.Dr{}, err
+			}
+		}
+
+		if err == nil {
+			err = dr.ErrResourceNotFound
+		}
+
+		if !await(ctx, arrival) {
+			return dr.Dr{}, err
+		}
+	}
+}
+
+// notify returns a channel that is closed when the category might have
+// changed
+func notify(store dr.ContextStorage, category string) <-chan struct{} {
+	return Notify(store, category)
+}
+
+// Notify is the store's own Notify, if it is a dr.Notifier, or else a timer
+// that fires after PollInterval. Storage that wraps another can use it to
+// pass on Notify whether the wrapped storage has it or not.
+func Notify(store interface{}, category string) <-chan struct{} {
+
+	if notifier, ok := store.(dr.Notifier); ok {
+		return notifier.Notify(category)
+	}
+
+	arrival := make(chan struct{})
+
+	time.AfterFunc(PollInterval, func() {
+		close(arrival)
+	})
+
+	return arrival
+}
+
+// await blocks until arrival, and reports false if ctx was done first
+func await(ctx context.Context, arrival <-chan struct{}) bool {
+
+	// no point waiting if the deadline has passed already
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case <-arrival:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package wait
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/timdrysdale/dr"
+	"github.com/timdrysdale/dr/generator"
+	"github.com/timdrysdale/dr/mock"
+	"github.com/timdrysdale/dr/ram"
+)
+
+func TestListWaitsForAdd(t *testing.T) {
+
+	store := dr.WithContext(ram.New())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.AddContext(context.Background(), dr.Dr{Category: "a", ID: "b", Resource: "secret"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	list, err := List(ctx, store, "a")
+
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, ok := list["b"]; !ok || len(list) != 1 {
+		t.Errorf("Unexpected list %v", list)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Waited for poll instead of notification")
+	}
+}
+
+func TestListTimesOut(t *testing.T) {
+
+	store := dr.WithContext(ram.New())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := List(ctx, store, "a")
+
+	if err != dr.ErrResourceNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestListPollsStorageWithoutNotifier(t *testing.T) {
+
+	m := mock.New()
+	m.SetList(map[string]dr.Dr{"b": dr.Dr{Category: "a", ID: "b"}})
+
+	list, err := List(context.Background(), m, "a")
+
+	if err != nil || len(list) != 1 {
+		t.Errorf("Unexpected result %v %v", list, err)
+	}
+
+	m = mock.New()
+	m.SetError(dr.ErrResourceNotFound)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*PollInterval+PollInterval/2)
+	defer cancel()
+
+	_, err = List(ctx, m, "a")
+
+	if err != dr.ErrResourceNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if m.GetMethod()["List"] < 2 {
+		t.Errorf("Didn't poll List repeatedly, but %d times", m.GetMethod()["List"])
+	}
+}
+
+func TestTakeRevealsSingleUseOnce(t *testing.T) {
+
+	store := dr.WithContext(ram.New())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	results := make(chan error)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			resource, err := Take(ctx, store, "a")
+			if err == nil && resource.Resource != "secret" {
+				t.Errorf("Unexpected resource %v", resource)
+			}
+			results <- err
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	store.AddContext(context.Background(), dr.Dr{Category: "a", ID: "b", Resource: "secret"})
+
+	taken := 0
+	for i := 0; i < 2; i++ {
+		err := <-results
+		switch err {
+		case nil:
+			taken++
+		case dr.ErrResourceNotFound:
+		default:
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+
+	if taken != 1 {
+		t.Errorf("Single-use resource taken %d times", taken)
+	}
+}
+
+func TestTakeSoonestExpiring(t *testing.T) {
+
+	store := dr.WithContext(ram.New())
+	store.AddContext(context.Background(), dr.Dr{Category: "a", ID: "later", TTL: 100})
+	store.AddContext(context.Background(), dr.Dr{Category: "a", ID: "forever"})
+	store.AddContext(context.Background(), dr.Dr{Category: "a", ID: "sooner", TTL: 10})
+
+	resource, err := Take(context.Background(), store, "a")
+
+	if err != nil || resource.ID != "sooner" {
+		t.Errorf("Unexpected result %v %v", resource, err)
+	}
+}
+
+func TestTakeMintsFromTemplate(t *testing.T) {
+
+	storage := ram.New()
+	storage.(dr.TemplateStorage).AddTemplate(dr.Dr{Category: "a", ID: "t"}, generator.Counter(1))
+	store := dr.WithContext(storage)
+
+	first, err := Take(context.Background(), store, "a")
+	second, err2 := Take(context.Background(), store, "a")
+
+	if err != nil || err2 != nil || first.Resource != "1" || second.Resource != "2" {
+		t.Errorf("Unexpected result %v %v %v %v", first, err, second, err2)
+	}
+}